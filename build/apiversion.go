@@ -0,0 +1,65 @@
+package build
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	// the oldest API habitus works with. It has container archive downloads, build args,
+	// networks and volumes
+	minAPIVersion = "1.21"
+	// the newest API the docker client is known to work with
+	maxAPIVersion = "1.25"
+)
+
+// creates the docker client for the endpoint using the API version, or the daemon
+// version when it's empty. TCP endpoints use TLS when there's a TLS config
+func newDockerClient(endpoint *url.URL, tlsConfig *tls.Config, apiVersion string) (*docker.Client, error) {
+	switch {
+	case endpoint.Scheme == "ssh":
+		return newSSHClient(endpoint, apiVersion)
+	case endpoint.Scheme != "unix" && tlsConfig != nil:
+		return newTLSClient(endpoint, tlsConfig, apiVersion)
+	default:
+		return docker.NewVersionedClient(endpoint.String(), apiVersion)
+	}
+}
+
+// the part of the client negotiating the API version
+type versionClient interface {
+	Version() (*docker.Env, error)
+}
+
+// picks the API version to use with the daemon: its own version up to the newest one habitus
+// knows. Daemons older than the oldest version habitus needs are an error
+func negotiateAPIVersion(client versionClient) (string, error) {
+	env, err := client.Version()
+	if err != nil {
+		return "", err
+	}
+
+	server, err := docker.NewAPIVersion(env.Get("ApiVersion"))
+	if err != nil {
+		return "", fmt.Errorf("invalid Docker API version '%s'", env.Get("ApiVersion"))
+	}
+	min, _ := docker.NewAPIVersion(minAPIVersion)
+	max, _ := docker.NewAPIVersion(maxAPIVersion)
+
+	if server.LessThan(min) {
+		return "", fmt.Errorf("the Docker API version %s of the daemon is too old. Habitus needs %s or newer for artifact downloads, build args, networks and volumes", server, min)
+	}
+	if server.LessThanOrEqualTo(max) {
+		return server.String(), nil
+	}
+
+	// daemons drop support for old versions. Their oldest one is used then
+	if daemonMin, err := docker.NewAPIVersion(env.Get("MinAPIVersion")); err == nil && daemonMin.GreaterThan(max) {
+		return daemonMin.String(), nil
+	}
+
+	return max.String(), nil
+}
@@ -0,0 +1,195 @@
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// credential helper settings as stored in docker's config.json
+type dockerConfigFile struct {
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// the username of credential helper responses whose secret is an identity token
+const identityTokenUsername = "<token>"
+
+// credentials habitus uses with a registry itself, like to check base images. Next
+// to the auth config passed to the daemon, they hold the identity token returned by
+// a credential helper, which the vendored docker client has no field for
+type registryCredentials struct {
+	docker.AuthConfiguration
+	IdentityToken string
+}
+
+// response of a docker-credential-* helper get call
+type credentialHelperResponse struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// finds the docker config.json. DOCKER_CONFIG takes precedence over the home folder
+func dockerConfigPath(homeDir string) string {
+	if dockerConfig := os.Getenv("DOCKER_CONFIG"); dockerConfig != "" {
+		return filepath.Join(dockerConfig, "config.json")
+	}
+
+	return filepath.Join(homeDir, ".docker", "config.json")
+}
+
+// loads credentials from the credential helpers (credsStore and credHelpers)
+// configured in docker's config.json and adds them to the builder auth configs
+func (b *Builder) loadCredentialHelpers(homeDir string) error {
+	configPath := dockerConfigPath(homeDir)
+	data, err := ioutil.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var cfg dockerConfigFile
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("invalid %s: %s", configPath, err.Error())
+	}
+
+	// registry -> helper
+	helpers := make(map[string]string)
+	if cfg.CredsStore != "" {
+		registries, err := listCredentialHelper(cfg.CredsStore)
+		if err != nil {
+			b.Conf.Logger.Warningf("Failed to list registries from credential store %s: %s", cfg.CredsStore, err.Error())
+		}
+		for _, registry := range registries {
+			helpers[registry] = cfg.CredsStore
+		}
+	}
+	// registry specific helpers override the store
+	for registry, helper := range cfg.CredHelpers {
+		helpers[registry] = helper
+	}
+
+	if len(helpers) == 0 {
+		return nil
+	}
+
+	if b.auth == nil {
+		b.auth = &docker.AuthConfigurations{}
+	}
+	if b.auth.Configs == nil {
+		b.auth.Configs = make(map[string]docker.AuthConfiguration)
+	}
+
+	for registry, helper := range helpers {
+		b.Conf.Logger.Debugf("Fetching credentials for %s from docker-credential-%s", registry, helper)
+		creds, err := getCredentialHelper(helper, registry)
+		if err != nil {
+			// a broken helper for one registry shouldn't stop builds which don't use it
+			b.Conf.Logger.Warningf("Failed to fetch credentials for %s from docker-credential-%s: %s", registry, helper, err.Error())
+			continue
+		}
+
+		// identity tokens are exchanged for registry tokens rather than used as a password
+		if creds.Username == identityTokenUsername {
+			b.Conf.Logger.Warningf("docker-credential-%s returned an identity token for %s. It is only used to check base images as it can't be passed to the daemon", helper, registry)
+			if b.identityTokens == nil {
+				b.identityTokens = make(map[string]string)
+			}
+			b.identityTokens[registry] = creds.Secret
+			continue
+		}
+
+		b.auth.Configs[registry] = docker.AuthConfiguration{
+			Username:      creds.Username,
+			Password:      creds.Secret,
+			ServerAddress: registry,
+		}
+	}
+
+	return nil
+}
+
+// the credentials of a registry with the identity token of its credential helper
+func (b *Builder) registryCredentials(registry string) registryCredentials {
+	creds := registryCredentials{AuthConfiguration: b.registryAuth(registry)}
+	for server, token := range b.identityTokens {
+		if isRegistryServer(server, registry) {
+			creds.IdentityToken = token
+		}
+	}
+
+	return creds
+}
+
+// true when a server of the credentials is the registry. Docker Hub is used for an empty registry
+func isRegistryServer(server string, registry string) bool {
+	if registry == "" {
+		registry = "https://index.docker.io/v1/"
+	}
+
+	return server == registry || strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://") == registry
+}
+
+// returns the registries a credential helper holds credentials for
+func listCredentialHelper(helper string) ([]string, error) {
+	out, err := runCredentialHelper(helper, "list", "")
+	if err != nil {
+		return nil, err
+	}
+
+	var list map[string]string
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, err
+	}
+
+	var registries []string
+	for registry := range list {
+		registries = append(registries, registry)
+	}
+
+	return registries, nil
+}
+
+// fetches the credentials for a registry from a credential helper
+func getCredentialHelper(helper string, registry string) (*credentialHelperResponse, error) {
+	out, err := runCredentialHelper(helper, "get", registry)
+	if err != nil {
+		return nil, err
+	}
+
+	creds := &credentialHelperResponse{}
+	if err := json.Unmarshal(out, creds); err != nil {
+		return nil, err
+	}
+
+	return creds, nil
+}
+
+func runCredentialHelper(helper string, action string, input string) ([]byte, error) {
+	cmd := exec.Command("docker-credential-"+helper, action)
+	cmd.Stdin = strings.NewReader(input)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// helpers report errors such as missing credentials on stdout
+		msg := strings.TrimSpace(stderr.String() + string(out))
+		if msg != "" {
+			return nil, fmt.Errorf("%s (%s)", err.Error(), msg)
+		}
+		return nil, err
+	}
+
+	return out, nil
+}
@@ -0,0 +1,243 @@
+package build
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+const registryCheckTimeout = 30 * time.Second
+
+// media types accepted for a manifest HEAD so registries don't convert the manifest
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.v1+prettyjws",
+}
+
+// checks the FROM images of all steps which aren't other steps exist locally or in
+// their registry. A missing image is reported with the step referring to it. Registries
+// which can't be reached or don't give access are only warned about as the build will
+// find out for sure. Dockerfiles written by a pre_build command or copied by an earlier
+// step don't exist yet, so these steps are left to their build
+func (b *Builder) checkBaseImages() error {
+	checked := make(map[string]bool)
+	var missing []string
+	for _, step := range b.Build.Steps {
+		if step.PreBuild != "" {
+			b.Conf.Logger.Debugf("Not checking the base images of step %s as its pre build command runs first", step.Name)
+			continue
+		}
+
+		parsed, err := b.parseDockerfile(&step)
+		if err != nil {
+			b.Conf.Logger.Debugf("Not checking the base images of step %s: %s", step.Name, err.Error())
+			continue
+		}
+
+		for _, image := range parsed.BaseImages {
+			exists, ok := checked[image]
+			if !ok {
+				exists = b.baseImageExists(image)
+				checked[image] = exists
+			}
+			if !exists {
+				missing = append(missing, fmt.Sprintf("step %s uses base image %s which doesn't exist", step.Name, image))
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		return errors.New(strings.Join(missing, "\n"))
+	}
+
+	return nil
+}
+
+// returns false only when the image isn't local and its registry says it doesn't exist
+func (b *Builder) baseImageExists(image string) bool {
+	if _, err := b.docker.InspectImage(image); err == nil {
+		return true
+	} else if err != docker.ErrNoSuchImage {
+		b.Conf.Logger.Warningf("Failed to inspect base image %s: %s", image, err.Error())
+		return true
+	}
+
+	registry, repo, ref := manifestReference(image)
+	b.Conf.Logger.Debugf("Checking %s for base image %s", registry, image)
+
+	client := &http.Client{Timeout: registryCheckTimeout}
+	exists, err := manifestExists(client, "https://"+registry, repo, ref, b.registryCredentials(registryFromRepo(image)))
+	if err != nil {
+		b.Conf.Logger.Warningf("Failed to check base image %s in %s: %s", image, registry, err.Error())
+		return true
+	}
+
+	return exists
+}
+
+// splits an image into the registry host, the repository in the registry and
+// the tag or digest. Docker Hub images get its registry and library namespace
+func manifestReference(image string) (string, string, string) {
+	ref := "latest"
+	if idx := strings.Index(image, "@"); idx >= 0 {
+		ref = image[idx+1:]
+		image = image[:idx]
+	} else if repo, tag := splitImageTag(image); tag != "" {
+		ref = tag
+		image = repo
+	}
+
+	registry := registryFromRepo(image)
+	repo := strings.TrimPrefix(image, registry+"/")
+	if registry == "" || registry == "docker.io" || registry == "index.docker.io" {
+		registry = "registry-1.docker.io"
+		if !strings.Contains(repo, "/") {
+			repo = "library/" + repo
+		}
+	}
+
+	return registry, repo, ref
+}
+
+// sends a HEAD for the manifest of repo:ref to a registry. The registry auth challenge
+// is answered with a bearer token or basic auth using the given credentials
+func manifestExists(client *http.Client, baseURL string, repo string, ref string, auth registryCredentials) (bool, error) {
+	manifestURL := strings.TrimRight(baseURL, "/") + "/v2/" + repo + "/manifests/" + ref
+
+	resp, err := headManifest(client, manifestURL, "")
+	if err != nil {
+		return false, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		authorization, err := answerChallenge(client, resp.Header.Get("WWW-Authenticate"), auth)
+		if err != nil {
+			return false, err
+		}
+
+		resp, err = headManifest(client, manifestURL, authorization)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
+
+func headManifest(client *http.Client, manifestURL string, authorization string) (*http.Response, error) {
+	req, err := http.NewRequest("HEAD", manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return resp, nil
+}
+
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// returns the Authorization header for a WWW-Authenticate challenge
+func answerChallenge(client *http.Client, challenge string, auth registryCredentials) (string, error) {
+	parts := strings.SplitN(challenge, " ", 2)
+	scheme := strings.ToLower(parts[0])
+
+	if scheme == "basic" {
+		if auth.Username == "" {
+			return "", errors.New("the registry needs credentials")
+		}
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.SetBasicAuth(auth.Username, auth.Password)
+		return req.Header.Get("Authorization"), nil
+	}
+
+	if scheme != "bearer" || len(parts) == 1 {
+		return "", fmt.Errorf("unsupported registry auth challenge %q", challenge)
+	}
+
+	params := make(map[string]string)
+	for _, m := range challengeParam.FindAllStringSubmatch(parts[1], -1) {
+		params[strings.ToLower(m[1])] = m[2]
+	}
+	if params["realm"] == "" {
+		return "", fmt.Errorf("no realm in registry auth challenge %q", challenge)
+	}
+
+	query := url.Values{}
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	if params["scope"] != "" {
+		query.Set("scope", params["scope"])
+	}
+
+	var req *http.Request
+	var err error
+	if auth.IdentityToken != "" {
+		// identity tokens are OAuth refresh tokens exchanged for an access token
+		query.Set("grant_type", "refresh_token")
+		query.Set("refresh_token", auth.IdentityToken)
+		query.Set("client_id", "habitus")
+		req, err = http.NewRequest("POST", params["realm"], strings.NewReader(query.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req, err = http.NewRequest("GET", params["realm"]+"?"+query.Encode(), nil)
+		if err != nil {
+			return "", err
+		}
+		if auth.Username != "" {
+			req.SetBasicAuth(auth.Username, auth.Password)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get a registry token: %s", resp.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+
+	return "Bearer " + token.Token, nil
+}
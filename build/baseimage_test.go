@@ -0,0 +1,142 @@
+package build
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/fsouza/go-dockerclient"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Base images", func() {
+	It("lists the FROM images which aren't steps or stages", func() {
+		conf := testConfig()
+		manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    base:
+      name: base
+      dockerfile: Dockerfile
+    app:
+      name: app
+      dockerfile_inline: |
+        FROM golang:1.8 AS build
+        FROM build
+        FROM base
+        FROM scratch
+        FROM registry.example.com/team/runtime@sha256:abcdef
+`)
+		Expect(err).NotTo(HaveOccurred())
+
+		b := &Builder{Conf: conf, Build: manifest, UniqueID: "ci"}
+		step, _ := manifest.FindStepByLabel("app")
+		parsed, err := b.parseDockerfile(step)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parsed.BaseImages).To(Equal([]string{"golang:1.8", "registry.example.com/team/runtime@sha256:abcdef"}))
+	})
+
+	It("leaves Dockerfiles which don't exist yet to the step build", func() {
+		conf := testConfig()
+		manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    generated:
+      name: generated
+      dockerfile: Dockerfile.generated
+      pre_build: echo FROM scratch > Dockerfile.generated
+    copied:
+      name: copied
+      dockerfile: artifacts/Dockerfile
+    app:
+      name: app
+      dockerfile_inline: FROM golang:1.8
+`)
+		Expect(err).NotTo(HaveOccurred())
+
+		fake := &fakeDocker{images: map[string]*docker.Image{"golang:1.8": {ID: "sha256:abc"}}}
+		b := &Builder{Conf: conf, Build: manifest, docker: fake}
+		Expect(b.checkBaseImages()).To(Succeed())
+	})
+
+	It("finds the registry manifest of an image", func() {
+		registry, repo, ref := manifestReference("ubuntu")
+		Expect([]string{registry, repo, ref}).To(Equal([]string{"registry-1.docker.io", "library/ubuntu", "latest"}))
+
+		registry, repo, ref = manifestReference("cloud66/habitus:1.0")
+		Expect([]string{registry, repo, ref}).To(Equal([]string{"registry-1.docker.io", "cloud66/habitus", "1.0"}))
+
+		registry, repo, ref = manifestReference("localhost:5000/team/app@sha256:abcdef")
+		Expect([]string{registry, repo, ref}).To(Equal([]string{"localhost:5000", "team/app", "sha256:abcdef"}))
+	})
+
+	It("checks the manifest with a bearer token", func() {
+		var server *httptest.Server
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/token":
+				user, pass, _ := r.BasicAuth()
+				if user != "ci" || pass != "secret" || r.URL.Query().Get("scope") != "repository:team/app:pull" {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				w.Write([]byte(`{"token": "abc"}`))
+			case "/v2/team/app/manifests/1.0", "/v2/team/app/manifests/2.0":
+				if r.Header.Get("Authorization") != "Bearer abc" {
+					w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="registry",scope="repository:team/app:pull"`)
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				if r.URL.Path == "/v2/team/app/manifests/2.0" {
+					w.WriteHeader(http.StatusNotFound)
+				}
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer server.Close()
+
+		auth := registryCredentials{AuthConfiguration: docker.AuthConfiguration{Username: "ci", Password: "secret"}}
+		exists, err := manifestExists(http.DefaultClient, server.URL, "team/app", "1.0", auth)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(exists).To(BeTrue())
+
+		exists, err = manifestExists(http.DefaultClient, server.URL, "team/app", "2.0", auth)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(exists).To(BeFalse())
+
+		_, err = manifestExists(http.DefaultClient, server.URL, "team/app", "1.0", registryCredentials{})
+		Expect(err).To(MatchError(ContainSubstring("403 Forbidden")))
+	})
+
+	It("exchanges identity tokens for a bearer token", func() {
+		var server *httptest.Server
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/token":
+				r.ParseForm()
+				if r.Method != "POST" || r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("refresh_token") != "refresh-abc" ||
+					r.PostForm.Get("scope") != "repository:team/app:pull" {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				w.Write([]byte(`{"access_token": "abc"}`))
+			case "/v2/team/app/manifests/1.0":
+				if r.Header.Get("Authorization") != "Bearer abc" {
+					w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="registry",scope="repository:team/app:pull"`)
+					w.WriteHeader(http.StatusUnauthorized)
+				}
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		defer server.Close()
+
+		exists, err := manifestExists(http.DefaultClient, server.URL, "team/app", "1.0", registryCredentials{IdentityToken: "refresh-abc"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(exists).To(BeTrue())
+	})
+})
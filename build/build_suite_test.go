@@ -0,0 +1,69 @@
+package build
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloud66/habitus/configuration"
+	"github.com/op/go-logging"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestBuild(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Build Suite")
+}
+
+// loads a manifest from the given build.yml content
+func loadManifest(conf *configuration.Config, content string) (*Manifest, error) {
+	dir, err := ioutil.TempDir("", "habitus-test-")
+	Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+
+	conf.Buildfile = filepath.Join(dir, "build.yml")
+	Expect(ioutil.WriteFile(conf.Buildfile, []byte(content), 0644)).To(Succeed())
+
+	return LoadBuildFromFile(conf)
+}
+
+func testConfig() *configuration.Config {
+	conf := configuration.CreateConfig()
+	conf.Logger = *logging.MustGetLogger("habitus")
+	conf.SecretProviders = "file"
+	return &conf
+}
+
+// writes a self-signed cert.pem and key.pem to dir, like a docker cert folder without the CA
+func writeTestCerts(dir string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "habitus"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	Expect(ioutil.WriteFile(filepath.Join(dir, "cert.pem"), certPEM, 0644)).To(Succeed())
+	Expect(ioutil.WriteFile(filepath.Join(dir, "key.pem"), keyPEM, 0600)).To(Succeed())
+}
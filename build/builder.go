@@ -3,22 +3,30 @@ package build
 import (
 	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"text/template"
+	"time"
 
 	"github.com/cloud66/habitus/configuration"
-	"github.com/cloud66/habitus/squash"
 	"github.com/dchest/uniuri"
 	"github.com/docker/docker/builder/dockerfile/parser"
 	"github.com/fsouza/go-dockerclient"
@@ -30,83 +38,241 @@ type Builder struct {
 	Build    *Manifest
 	UniqueID string // unique id for this build sequence. This is used for multi-tenanted environments
 	Conf     *configuration.Config
+	// build and command output is written to these. They default to os.Stdout and os.Stderr
+	OutputStream io.Writer
+	ErrorStream  io.Writer
+	// Events receives structured build events. Defaults to discarding them
+	Events EventSink
 
 	config    *tls.Config
-	docker    docker.Client
+	docker    DockerClient
+	ctx       context.Context // of the running build
 	auth      *docker.AuthConfigurations
 	builderId string // unique id for this builder session (used internally)
 	wg        sync.WaitGroup
+	summaries map[string]*StepSummary // by step label
+	streams   map[string]*stepStreams // by step label
+	secrets   secretValues            // masked in the logs
+	gitSHA    string                  // short SHA of the workdir the images are tagged with
+	idMap     []idRange               // container to host ids of the artifact owners
+
+	// identity tokens of the credential helpers, by registry. They're not in auth as
+	// the vendored docker client can't pass them to the daemon
+	identityTokens map[string]string
+
+	// os/arch of the daemon, found once
+	platform     string
+	platformErr  error
+	platformOnce sync.Once
+
+	// containers created by the running build which are not removed yet
+	containers     map[string]bool
+	containersLock sync.Mutex
+
+	// host files copied for glob artifacts which weren't there before. The destination
+	// of a glob can exist, so they aren't under the artifact roots
+	globArtifactFiles     []string
+	globArtifactFilesLock sync.Mutex
 }
 
-// NewBuilder creates a new builder in a new session
+// NewBuilder creates a new builder in a new session with a docker client for conf.DockerHost
 func NewBuilder(manifest *Manifest, conf *configuration.Config) *Builder {
-	b := Builder{}
-	b.Build = manifest
-	b.UniqueID = conf.UniqueID
-	b.Conf = conf
-	b.builderId = uuid.NewV4().String()
+	endpoint, err := url.Parse(conf.DockerHost)
+	if err != nil {
+		conf.Logger.Fatalf("Invalid host: %s", err.Error())
+		return nil
+	}
+
+	var tlsConfig *tls.Config
+	if endpoint.Scheme != "unix" && endpoint.Scheme != "ssh" && conf.UseTLS {
+		if conf.InsecureSkipVerify {
+			conf.Logger.Warning("Not verifying the certificate of the Docker daemon. Anyone between habitus and the daemon can pretend to be it")
+		}
+		tlsConfig, err = daemonTLSConfig(conf)
+		if err != nil {
+			conf.Logger.Fatalf("Failed to connect to Docker daemon %s", err.Error())
+			return nil
+		}
+	}
 
-	endpoint, err := url.Parse(b.Conf.DockerHost)
+	client, err := newDockerClient(endpoint, tlsConfig, "")
 	if err != nil {
-		b.Conf.Logger.Fatalf("Invalid host: %s", err.Error())
+		conf.Logger.Fatalf("Failed to connect to Docker daemon %s", err.Error())
 		return nil
 	}
 
-	var client *docker.Client
-	if endpoint.Scheme == "unix" {
-		client, err = docker.NewClient(endpoint.String())
-	} else {
-		if conf.UseTLS {
-			certPath := b.Conf.DockerCert
-			ca := path.Join(certPath, "ca.pem")
-			cert := path.Join(certPath, "cert.pem")
-			key := path.Join(certPath, "key.pem")
-			client, err = docker.NewTLSClient(endpoint.String(), cert, key, ca)
-		} else {
-			client, err = docker.NewClient(endpoint.String())
+	// dry runs don't talk to the daemon
+	if !conf.DryRun {
+		version, err := negotiateAPIVersion(client)
+		if err != nil {
+			conf.Logger.Fatalf("Failed to connect to Docker daemon %s", err.Error())
+			return nil
+		}
+		conf.Logger.Debugf("Using the Docker API version %s", version)
+
+		if !conf.Podman && detectPodman(client, endpoint) {
+			conf.Logger.Notice("The daemon is podman. Using the podman compatibility mode")
+			conf.Podman = true
+		}
+
+		client, err = newDockerClient(endpoint, tlsConfig, version)
+		if err != nil {
+			conf.Logger.Fatalf("Failed to connect to Docker daemon %s", err.Error())
+			return nil
 		}
 	}
 
+	b, err := NewBuilderWithClient(manifest, conf, client)
 	if err != nil {
-		b.Conf.Logger.Fatal(err.Error())
+		conf.Logger.Fatal(err.Error())
 		return nil
 	}
+	b.config = tlsConfig
 
-	b.docker = *client
+	return b
+}
+
+// NewBuilderWithClient creates a new builder in a new session using the given docker
+// client. Registry credentials are loaded from the docker config of the current user
+func NewBuilderWithClient(manifest *Manifest, conf *configuration.Config, client DockerClient) (*Builder, error) {
+	b := Builder{}
+	b.Build = manifest
+	b.UniqueID = conf.UniqueID
+	b.builderId = uuid.NewV4().String()
+	b.OutputStream = os.Stdout
+	b.ErrorStream = os.Stderr
+	b.Events = noopEventSink{}
+	b.docker = client
+
+	// the secrets registered during the build are masked in everything it logs. The
+	// builder has its own copy of the config so the logger of conf is left as it is
+	builderConf := *conf
+	builderConf.Logger.SetBackend(newMaskingBackend(conf.Logger, &b.secrets))
+	b.secrets.addConfig(conf)
+	b.Conf = &builderConf
+
+	// errors of the build and the commands still go to the error stream
+	if conf.Quiet {
+		b.OutputStream = ioutil.Discard
+	}
 
 	homeDir := os.Getenv("HOME")
 	if homeDir == "" {
-		b.Conf.Logger.Fatalf("Failed to find the current home")
+		return nil, errors.New("Failed to find the current home")
 	}
 
 	if _, err := os.Stat(filepath.Join(homeDir, ".dockercfg")); err == nil {
 		authStream, err := os.Open(filepath.Join(homeDir, ".dockercfg"))
 		if err != nil {
-			b.Conf.Logger.Fatal("Unable to read .dockercfg file")
+			return nil, errors.New("Unable to read .dockercfg file")
 		}
 		defer authStream.Close()
 
 		auth, err := docker.NewAuthConfigurations(authStream)
 		if err != nil {
-			b.Conf.Logger.Fatalf("Invalid .dockercfg: %s", err.Error())
+			return nil, fmt.Errorf("Invalid .dockercfg: %s", err.Error())
 		}
 		b.auth = auth
 	}
 
+	if err := b.loadCredentialHelpers(homeDir); err != nil {
+		return nil, fmt.Errorf("Failed to load docker credential helpers: %s", err.Error())
+	}
+
+	idMap, err := parseIDMap(conf.IDMap)
 	if err != nil {
-		b.Conf.Logger.Fatalf("Failed to connect to Docker daemon %s", err.Error())
+		return nil, err
+	}
+	b.idMap = idMap
+
+	if err := b.loadPodmanAuth(homeDir); err != nil {
+		return nil, fmt.Errorf("Failed to load the podman auth file: %s", err.Error())
 	}
 
-	return &b
+	if b.auth != nil {
+		for _, auth := range b.auth.Configs {
+			b.AddSecretValue(auth.Password)
+		}
+	}
+	for _, token := range b.identityTokens {
+		b.AddSecretValue(token)
+	}
+
+	return &b, nil
 }
 
-// StartBuild runs the build process end to end
-func (b *Builder) StartBuild() error {
+// StartBuild runs the build process end to end. Once the steps start building, the
+// result holds the outcome of each step even when the build fails. Cancelling ctx stops
+// the running steps, removes their containers and returns the context error
+func (b *Builder) StartBuild(ctx context.Context) (result *BuildResult, err error) {
+	// registered first so every failed build is reported, once everything is cleaned up
+	start := time.Now()
+	if !b.Conf.DryRun && (b.Conf.NotifyURL != "" || b.Conf.SlackWebhook != "") {
+		defer func() {
+			// builds failing before the steps start have no result
+			notified := result
+			if notified == nil {
+				notified = b.buildResult(start, err)
+			}
+			b.notify(notified)
+		}()
+	}
+
+	if err := b.Build.Validate(); err != nil {
+		return nil, err
+	}
+
+	if b.Conf.HandleSignals {
+		var stop func()
+		ctx, stop = b.handleSignals(ctx)
+		defer stop()
+	}
+	if b.Conf.BuildTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.Conf.BuildTimeout)
+		defer cancel()
+	}
+	b.ctx = ctx
+
+	if b.Conf.DryRun {
+		return nil, b.printPlan()
+	}
+
+	if err := b.docker.Ping(); err != nil {
+		return nil, &DockerError{Err: err}
+	}
+
+	b.Conf.Logger.Debug("Checking base images")
+	if err := b.checkBaseImages(); err != nil {
+		return nil, err
+	}
+
+	if b.Conf.WriteBuildInfo != "" {
+		defer func() {
+			if infoErr := b.writeBuildInfo(result); infoErr != nil && err == nil {
+				err = infoErr
+			}
+		}()
+	}
+
+	b.emit(Event{Type: EventBuildStarted})
+	defer func() {
+		b.emit(Event{Type: EventBuildFinished, Error: errorString(err)})
+	}()
 
 	var hostArtifactRoots []string
 	if !b.Conf.KeepArtifacts {
 		b.Conf.Logger.Debug("Collecting artifact information")
 		hostArtifactRoots = b.collectHostArtifactRoots()
+		defer b.removeArtifactVolumes()
+	}
+
+	if b.Conf.TagGitSHA {
+		if sha, err := gitShortSHA(b.Conf.Workdir); err == nil {
+			b.gitSHA = sha
+		} else {
+			b.Conf.Logger.Warningf("Not tagging the images with the git SHA as %s isn't a git repository", b.Conf.Workdir)
+		}
 	}
 
 	b.Conf.Logger.Debugf("Building %d steps", len(b.Build.Steps))
@@ -114,23 +280,71 @@ func (b *Builder) StartBuild() error {
 		b.Conf.Logger.Debugf("Step %d - %s: %s", i, s.Label, s.Name)
 	}
 
+	if err := b.openStepStreams(); err != nil {
+		return nil, err
+	}
+	defer b.closeStepStreams()
+
+	b.initSummaries()
+	defer func() {
+		result = b.buildResult(start, err)
+	}()
+
+	// the first failed step. The other steps of its level finish before the build stops
+	var stepErr error
+	var errLock sync.Mutex
+	// steps still building when the build timeout fired
+	var timedOut []string
 	for _, levels := range b.Build.buildLevels {
+		if err := ctx.Err(); err != nil {
+			b.printSummary()
+			return nil, b.stoppedError(err, nil)
+		}
+
 		for _, s := range levels {
 			b.wg.Add(1)
 			go func(st Step) {
 				b.Conf.Logger.Debugf("Parallel build for %s", st.Name)
 				defer b.wg.Done()
 
+				b.emit(Event{Type: EventStepStarted, Step: st.Name})
+				start := time.Now()
 				err := b.BuildStep(&st)
+				duration := time.Since(start)
+				if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+					errLock.Lock()
+					timedOut = append(timedOut, st.Name)
+					errLock.Unlock()
+				}
+				b.recordStep(&st, duration, err)
+				b.emit(Event{Type: EventStepFinished, Step: st.Name, Duration: duration.Seconds(), Error: errorString(err)})
 				if err != nil {
-					b.Conf.Logger.Fatalf("Build for step %s failed due to %s", st.Name, err.Error())
+					b.Conf.Logger.Errorf("Build for step %s failed due to %s", st.Name, err.Error())
+					errLock.Lock()
+					if stepErr == nil {
+						stepErr = stepError(&st, err)
+					}
+					errLock.Unlock()
 				}
 			}(s)
 		}
 
 		b.wg.Wait()
+		// steps failing because of the cancellation aren't the reason the build stopped
+		if err := ctx.Err(); err != nil {
+			b.cleanupCancelledBuild()
+			b.printSummary()
+			sort.Strings(timedOut)
+			return nil, b.stoppedError(err, timedOut)
+		}
+		if stepErr != nil {
+			b.printSummary()
+			return nil, stepErr
+		}
 	}
 
+	b.printSummary()
+
 	if !b.Conf.KeepArtifacts {
 		// remove all artifacts created on the host
 		for _, hostArtifactRoot := range hostArtifactRoots {
@@ -139,10 +353,14 @@ func (b *Builder) StartBuild() error {
 			// values; so we don't care if this fails
 			os.RemoveAll(hostArtifactRoot)
 		}
+		for _, file := range b.globArtifactFiles {
+			b.Conf.Logger.Debugf("Removing artifact file: %s", file)
+			os.RemoveAll(file)
+		}
 	}
 
 	if b.Conf.KeepSteps {
-		return nil
+		return nil, nil
 	}
 
 	if len(b.Build.Steps) < 1 {
@@ -150,17 +368,139 @@ func (b *Builder) StartBuild() error {
 	}
 
 	// Clear after yourself: images, containers, etc (optional for premium users)
-	// except last step
-	for _, s := range b.Build.Steps[:len(b.Build.Steps)-1] {
-		b.Conf.Logger.Debugf("Removing unwanted image %s", b.uniqueStepName(&s))
-		rmiOptions := docker.RemoveImageOptions{Force: b.Conf.FroceRmImages, NoPrune: b.Conf.NoPruneRmImages}
-		err := b.docker.RemoveImageExtended(b.uniqueStepName(&s), rmiOptions)
+	// except the final steps. The build succeeded so cleanup failures are only
+	// fatal in strict cleanup mode
+	if errs := b.removeStepImages(); len(errs) > 0 {
+		var msgs []string
+		for _, e := range errs {
+			b.Conf.Logger.Warning(e.Error())
+			msgs = append(msgs, e.Error())
+		}
+
+		if b.Conf.StrictCleanup {
+			return nil, fmt.Errorf("failed to remove %d unwanted images: %s", len(errs), strings.Join(msgs, "; "))
+		}
+	}
+
+	return nil, nil
+}
+
+// the error of a build stopped by its context. Running past the build timeout is a
+// TimeoutError with the steps which were still building
+func (b *Builder) stoppedError(err error, steps []string) error {
+	if err == context.DeadlineExceeded && b.Conf.BuildTimeout > 0 {
+		return &TimeoutError{Timeout: b.Conf.BuildTimeout, Steps: steps}
+	}
+
+	return err
+}
+
+// steps whose images are removed at the end of the build. These are the steps other
+// steps depend on. Steps nothing depends on are the final images and are kept
+func (b *Builder) removableSteps() []Step {
+	var removable []Step
+	for _, s := range b.Build.Steps {
+		if b.hasDependents(&s) {
+			removable = append(removable, s)
+		}
+	}
+
+	return removable
+}
+
+func (b *Builder) hasDependents(step *Step) bool {
+	for _, s := range b.Build.Steps {
+		for _, d := range s.DependsOn {
+			if d.Label == step.Label {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// removes the images of the removable steps. Images which are still a parent of a kept
+// image (for example through FROM without depends_on) are skipped. Only the tag of this
+// build is removed when the image has other tags, as they may belong to other builds.
+// A failure doesn't stop the removal of the other images
+func (b *Builder) removeStepImages() []error {
+	parents, err := b.keptImageParents()
+	if err != nil {
+		// without the parents any removal could break a kept image
+		return []error{fmt.Errorf("failed to find the parents of the kept images: %s", err.Error())}
+	}
+
+	var errs []error
+
+	for _, s := range b.removableSteps() {
+		name := b.uniqueStepName(&s)
+		image, err := b.docker.InspectImage(name)
+		if err == docker.ErrNoSuchImage {
+			continue
+		}
 		if err != nil {
-			return err
+			errs = append(errs, fmt.Errorf("failed to inspect image %s: %s", name, err.Error()))
+			continue
+		}
+
+		if parents[image.ID] {
+			b.Conf.Logger.Noticef("Keeping image %s as it is a parent of a kept image", name)
+			continue
+		}
+
+		history, err := b.docker.ImageHistory(name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to inspect image %s: %s", name, err.Error()))
+			continue
+		}
+
+		rmiOptions := docker.RemoveImageOptions{Force: s.ForceRmImages, NoPrune: s.NoPruneRmImages}
+		if len(history) > 0 && len(history[0].Tags) > 1 {
+			b.Conf.Logger.Debugf("Image %s has other tags. Removing the tag only", name)
+			rmiOptions.Force = false
+		}
+
+		b.Conf.Logger.Debugf("Removing unwanted image %s", name)
+		err = b.docker.RemoveImageExtended(name, rmiOptions)
+		if e, ok := err.(*docker.Error); ok && e.Status == http.StatusConflict {
+			b.Conf.Logger.Warningf("Image %s was not removed as it is in use: %s", name, e.Message)
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove image %s: %s", name, err.Error()))
 		}
 	}
 
-	return nil
+	return errs
+}
+
+// returns the IDs of all the layers of the images which are kept at the end of the build
+func (b *Builder) keptImageParents() (map[string]bool, error) {
+	parents := make(map[string]bool)
+	for _, s := range b.Build.Steps {
+		if b.hasDependents(&s) {
+			continue
+		}
+
+		history, err := b.docker.ImageHistory(b.uniqueStepName(&s))
+		if err == docker.ErrNoSuchImage {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(history) == 0 {
+			continue
+		}
+		// the first entry is the kept image itself
+		for _, layer := range history[1:] {
+			parents[layer.ID] = true
+		}
+	}
+
+	return parents, nil
 }
 
 // collects all existing artifact roots that are created
@@ -171,20 +511,46 @@ func (b *Builder) collectHostArtifactRoots() []string {
 	if !b.Conf.KeepArtifacts {
 		for _, step := range b.Build.Steps {
 			for _, artifact := range step.Artifacts {
+				if artifact.Volume != "" {
+					continue
+				}
 				// get the projected relative path to the host file
-				absHostFile := path.Join(b.Conf.Workdir, artifact.Dest, filepath.Base(artifact.Source))
-				// use a regex to hand path expansion (ie. ../../)
-				relHostFile := regexp.MustCompile(fmt.Sprintf("^%s/+", b.Conf.Workdir)).ReplaceAllString(absHostFile, "")
-				// remove trailing /
-				relHostFile = regexp.MustCompile("/$").ReplaceAllString(relHostFile, "")
-				parts := strings.Split(relHostFile, "/")
-				currentPath := b.Conf.Workdir
-				for _, part := range parts {
-					currentPath = path.Join(currentPath, part)
-					if _, err := os.Stat(currentPath); os.IsNotExist(err) {
-						// everything from this point down should be deleted
-						hostArtifactRoots = append(hostArtifactRoots, currentPath)
-						break
+				absHostFile := b.artifactHostPath(&artifact)
+				if strings.ContainsAny(filepath.Base(artifact.Source), "*?[") {
+					// the matching files are not known yet, so only the destination can be removed
+					absHostFile = b.artifactDestPath(&artifact)
+					if absHostFile == path.Clean(b.Conf.Workdir) || absHostFile == "/" {
+						continue
+					}
+				}
+
+				// absolute destinations are walked from the root. Only the missing part
+				// of the path is removed so existing folders like /tmp are kept
+				basePath := path.Clean(b.Conf.Workdir)
+				if path.IsAbs(artifact.Dest) {
+					basePath = "/"
+				}
+				relHostFile, err := filepath.Rel(basePath, absHostFile)
+				if err != nil || relHostFile == "." || relHostFile == ".." || strings.HasPrefix(relHostFile, "../") {
+					// never remove anything outside the workdir. Validate rejects these destinations
+					b.Conf.Logger.Warningf("Not removing artifact %s of step %s as it is outside the work directory", absHostFile, step.Name)
+					continue
+				}
+				relHostFiles := []string{relHostFile}
+				if b.Conf.ArtifactChecksums && absHostFile == b.artifactHostPath(&artifact) {
+					// the checksum file is next to the artifact which may be in an existing folder
+					relHostFiles = append(relHostFiles, relHostFile+".sha256")
+				}
+				for _, relFile := range relHostFiles {
+					parts := strings.Split(relFile, "/")
+					currentPath := basePath
+					for _, part := range parts {
+						currentPath = path.Join(currentPath, part)
+						if _, err := os.Stat(currentPath); os.IsNotExist(err) {
+							// everything from this point down should be deleted
+							hostArtifactRoots = append(hostArtifactRoots, currentPath)
+							break
+						}
 					}
 				}
 			}
@@ -193,6 +559,65 @@ func (b *Builder) collectHostArtifactRoots() []string {
 	return hostArtifactRoots
 }
 
+// the host files of an artifact which don't exist yet. They are the ones copying it creates
+func (b *Builder) missingArtifactFiles(a *Artifact) []string {
+	files := []string{b.artifactHostPath(a)}
+	if b.Conf.ArtifactChecksums {
+		files = append(files, files[0]+".sha256")
+	}
+
+	var missing []string
+	for _, file := range files {
+		if _, err := os.Lstat(file); os.IsNotExist(err) {
+			missing = append(missing, file)
+		}
+	}
+
+	return missing
+}
+
+// keeps the files copied for a glob artifact so they are removed at the end of the build
+func (b *Builder) trackGlobArtifactFiles(files []string) {
+	if b.Conf.KeepArtifacts || len(files) == 0 {
+		return
+	}
+
+	b.globArtifactFilesLock.Lock()
+	defer b.globArtifactFilesLock.Unlock()
+	b.globArtifactFiles = append(b.globArtifactFiles, files...)
+}
+
+// returns the host folder of an artifact. Absolute destinations are used as they are
+// and relative ones are in the workdir
+func (b *Builder) artifactDestPath(a *Artifact) string {
+	if path.IsAbs(a.Dest) {
+		return path.Clean(a.Dest)
+	}
+
+	return path.Join(b.Conf.Workdir, a.Dest)
+}
+
+// artifact archive formats
+const archiveTarGz = "tar.gz"
+
+// returns the host file an artifact is copied to
+func (b *Builder) artifactHostPath(a *Artifact) string {
+	if a.Archive == archiveTarGz {
+		return path.Join(b.artifactDestPath(a), a.fileName()+".tar.gz")
+	}
+
+	return path.Join(b.artifactDestPath(a), a.fileName())
+}
+
+// the file name of an artifact in its destination
+func (a *Artifact) fileName() string {
+	if a.As != "" {
+		return a.As
+	}
+
+	return path.Base(a.Source)
+}
+
 // provides a name for the image
 // it always adds the UID (if provided) to the end of the name
 // keeping the tag intact if it exists
@@ -212,56 +637,303 @@ func (b *Builder) uniqueStepName(step *Step) string {
 	return strings.ToLower(newName)
 }
 
+// splits an image name into its repository and tag. tag is empty if the name has none
+func splitImageTag(name string) (string, string) {
+	idx := strings.LastIndex(name, ":")
+	// a colon before the last / is a registry port, not a tag
+	if idx < 0 || strings.Contains(name[idx:], "/") {
+		return name, ""
+	}
+
+	return name[:idx], name[idx+1:]
+}
+
+// returns the registry part of a repository name or an empty string for the Docker Hub
+func registryFromRepo(repo string) string {
+	parts := strings.SplitN(repo, "/", 2)
+	if len(parts) == 1 {
+		return ""
+	}
+
+	if strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost" {
+		return parts[0]
+	}
+
+	return ""
+}
+
+// finds the credentials for a registry. Docker Hub is used for an empty registry
+func (b *Builder) registryAuth(registry string) docker.AuthConfiguration {
+	if b.auth == nil {
+		return docker.AuthConfiguration{}
+	}
+
+	for server, auth := range b.auth.Configs {
+		if isRegistryServer(server, registry) {
+			return auth
+		}
+	}
+
+	return docker.AuthConfiguration{}
+}
+
+// the extra tags of a step image. The git SHA tag uses the step name with the short SHA
+func (b *Builder) stepTags(step *Step) []string {
+	tags := append([]string{}, step.Tags...)
+	if b.gitSHA != "" {
+		repo, _ := splitImageTag(step.Name)
+		tags = append(tags, repo+":"+b.gitSHA)
+	}
+
+	return tags
+}
+
+// adds the extra tags of a step to its image. These tags don't get the unique ID
+func (b *Builder) tagImage(step *Step) error {
+	for _, t := range b.stepTags(step) {
+		repo, tag := splitImageTag(t)
+		if tag == "" {
+			tag = "latest"
+		}
+
+		b.Conf.Logger.Noticef("Tagging %s as %s:%s", b.uniqueStepName(step), repo, tag)
+		err := b.docker.TagImage(b.uniqueStepName(step), docker.TagImageOptions{Repo: repo, Tag: tag, Force: true})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tags the step image with the push registry and tag (if provided) and pushes it
+func (b *Builder) pushImage(step *Step) error {
+	repo, tag := splitImageTag(b.uniqueStepName(step))
+	if step.Push.Tag != "" {
+		tag = step.Push.Tag
+	}
+	if tag == "" {
+		tag = "latest"
+	}
+	if step.Push.Registry != "" {
+		repo = step.Push.Registry + "/" + repo
+	}
+
+	if repo+":"+tag != b.uniqueStepName(step) {
+		b.Conf.Logger.Debugf("Tagging %s as %s:%s", b.uniqueStepName(step), repo, tag)
+		err := b.docker.TagImage(b.uniqueStepName(step), docker.TagImageOptions{Repo: repo, Tag: tag, Force: true})
+		if err != nil {
+			return err
+		}
+	}
+
+	b.Conf.Logger.Noticef("Pushing %s:%s", repo, tag)
+	pushOpts := docker.PushImageOptions{
+		Context:      b.context(),
+		Name:         repo,
+		Tag:          tag,
+		Registry:     step.Push.Registry,
+		OutputStream: b.stepOutput(step),
+	}
+
+	return b.docker.PushImage(pushOpts, b.registryAuth(registryFromRepo(repo)))
+}
+
+// assembles the build args for a step. See EdgeArgs for the resolution order
+func (b *Builder) buildArgs(step *Step) []docker.BuildArg {
+	values := make(map[string]string)
+	var names []string
+	set := func(name, value string) {
+		if _, ok := values[name]; !ok {
+			names = append(names, name)
+		}
+		values[name] = value
+	}
+
+	for _, s := range b.Conf.BuildArgs {
+		set(s.Key, s.Value)
+	}
+	// read at build time so their values are never on the command line. The BuildKit
+	// build passes them to the docker CLI through its environment
+	for _, name := range b.envBuildArgs() {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			b.Conf.Logger.Warningf("Build arg %s isn't set in the environment", name)
+		}
+		b.AddSecretValue(value)
+		set(name, value)
+	}
+
+	setAll := func(args map[string]string) {
+		// sort the keys so the args are always sent in the same order
+		var keys []string
+		for k := range args {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			set(k, args[k])
+		}
+	}
+
+	for _, edge := range step.EdgeArgs {
+		setAll(edge.Args)
+	}
+	setAll(step.Args)
+
+	buildArgs := []docker.BuildArg{}
+	for _, name := range names {
+		buildArgs = append(buildArgs, docker.BuildArg{Name: name, Value: values[name]})
+	}
+
+	return buildArgs
+}
+
+// the names of the build args read from the environment
+func (b *Builder) envBuildArgs() []string {
+	var names []string
+	for _, name := range strings.Split(b.Conf.BuildEnv, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// returns the context of the running build. Steps built outside StartBuild can't be cancelled
+func (b *Builder) context() context.Context {
+	if b.ctx == nil {
+		return context.Background()
+	}
+
+	return b.ctx
+}
+
 // BuildStep builds a single step
 func (b *Builder) BuildStep(step *Step) error {
 	b.Conf.Logger.Noticef("Building %s", step.Name)
+	if step.PreBuild != "" {
+		if err := b.runHostCommand(step, "pre build", step.PreBuild, nil); err != nil {
+			return err
+		}
+	}
+
 	// fix the Dockerfile
 	err := b.replaceFromField(step)
 	if err != nil {
 		return err
 	}
 
-	buildArgs := []docker.BuildArg{}
-	for _, s := range b.Conf.BuildArgs {
-		buildArgs = append(buildArgs, docker.BuildArg{Name: s.Key, Value: s.Value})
+	// hashed before the fingerprint label is added to the generated Dockerfile
+	noCache, err := b.contentNoCache(step)
+	if err != nil {
+		return err
+	}
+
+	// the step container still runs for the artifacts and commands of an up to date image.
+	// Its cleanup commands ran and were committed in it already
+	upToDate := false
+	if b.Conf.Incremental {
+		fingerprint, err := b.stepFingerprint(step)
+		if err != nil {
+			return err
+		}
+		upToDate = b.upToDate(step, fingerprint)
+		if !upToDate {
+			if err := b.addLabel(step, fingerprintLabel, fingerprint); err != nil {
+				return err
+			}
+		}
 	}
+
+	buildArgs := b.buildArgs(step)
 	// call Docker to build the Dockerfile (from the parsed file)
 
 	b.Conf.Logger.Infof("Building the %s image from %s", b.uniqueStepName(step), filepath.Base(b.uniqueDockerfile(step)))
 	opts := docker.BuildImageOptions{
+		Context:             b.context(),
 		Name:                b.uniqueStepName(step),
-		Dockerfile:          filepath.Base(b.uniqueDockerfile(step)),
-		NoCache:             b.Conf.NoCache,
+		Dockerfile:          b.contextDockerfile(step),
+		NoCache:             b.Conf.NoCache || noCache,
 		SuppressOutput:      b.Conf.SuppressOutput,
 		RmTmpContainer:      b.Conf.RmTmpContainers,
 		ForceRmTmpContainer: b.Conf.ForceRmTmpContainer,
-		OutputStream:        os.Stdout, // TODO: use a multi writer to get a stream out for the API
-		ContextDir:          b.Conf.Workdir,
+		OutputStream:        b.stepOutput(step),
 		BuildArgs:           buildArgs,
 	}
 
+	step.limitBuildResources(&opts)
+
 	if b.auth != nil {
 		opts.AuthConfigs = *b.auth
 	}
 
-	err = b.docker.BuildImage(opts)
-
-	if err != nil {
+	if upToDate {
+		b.Conf.Logger.Noticef("Not building %s as its image is up to date", step.Name)
+	} else if err := b.buildImage(step, opts, buildArgs); err != nil {
 		return err
 	}
 
+	// a container kept running to debug a failed command keeps its network too
+	keptForDebugging := false
+
+	var copiedArtifacts []CopiedArtifact
+	defer func() {
+		b.recordArtifacts(step, copiedArtifacts)
+	}()
+
 	// if there are any artifacts to be picked up, create a container and copy them over
 	// we also need a container if there are cleanup commands
-	if len(step.Artifacts) > 0 || len(step.Cleanup.Commands) > 0 || step.Command != "" {
+	cleanup := !b.Conf.NoSquash && len(step.Cleanup.Commands) > 0 && !upToDate
+	if len(step.Artifacts) > 0 || cleanup || step.Command != "" {
 		b.Conf.Logger.Notice("Building container based on the image")
 
-		// create a container
-		container, err := b.createContainer(step)
-		if err != nil {
-			return err
+		hostConfig := &docker.HostConfig{NetworkMode: step.NetworkMode}
+		step.limitResources(hostConfig)
+		// an explicit network mode wins over the isolated network
+		if b.Conf.IsolateNetworks && step.NetworkMode == "" {
+			network, err := b.createStepNetwork(step)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if !keptForDebugging {
+					b.removeStepNetwork(network)
+				}
+			}()
+			hostConfig.NetworkMode = network.Name
 		}
 
-		if !b.Conf.NoSquash && len(step.Cleanup.Commands) > 0 {
+		if len(step.Secrets) > 0 {
+			secretsDir, err := b.writeStepSecrets(step)
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(secretsDir)
+			// bind mounts are not part of the committed image or its history
+			hostConfig.Binds = append(hostConfig.Binds, secretsDir+":"+secretsMountPath+":ro")
+		}
+
+		hostConfig.Binds = append(hostConfig.Binds, b.volumeBinds(step)...)
+		hostConfig.Binds = append(hostConfig.Binds, b.hostBinds(step)...)
+		hostConfig.Binds = append(hostConfig.Binds, b.cacheBinds(step)...)
+
+		// create a container
+		container, err := b.createContainer(step, hostConfig)
+		if err != nil {
+			return err
+		}
+		// failed steps remove their container too, unless it's kept for debugging
+		removed := false
+		defer func() {
+			if !removed && !keptForDebugging {
+				b.removeFailedContainer(container.ID)
+			}
+		}()
+
+		if cleanup {
 			// start the container
 			b.Conf.Logger.Noticef("Starting container %s to run cleanup commands", container.ID)
 			startOpts := &docker.HostConfig{}
@@ -270,16 +942,17 @@ func (b *Builder) BuildStep(step *Step) error {
 				return err
 			}
 
-			for _, cmd := range step.Cleanup.Commands {
+			for _, cmd := range cleanupCommands(step) {
 				b.Conf.Logger.Debugf("Running cleanup command %s on %s", cmd, container.ID)
 				// create an exec for the commands
 				execOpts := docker.CreateExecOptions{
+					Context:      b.context(),
 					Container:    container.ID,
 					AttachStdin:  false,
 					AttachStdout: true,
 					AttachStderr: true,
 					Tty:          false,
-					Cmd:          strings.Split(cmd, " "),
+					Cmd:          b.withStepEnv(step, []string{step.Shell, "-c", cmd}),
 				}
 				execObj, err := b.docker.CreateExec(execOpts)
 				if err != nil {
@@ -290,8 +963,9 @@ func (b *Builder) BuildStep(step *Step) error {
 
 				go func() {
 					startExecOpts := docker.StartExecOptions{
-						OutputStream: os.Stdout,
-						ErrorStream:  os.Stderr,
+						Context:      b.context(),
+						OutputStream: b.stepOutput(step),
+						ErrorStream:  b.stepErrors(step),
 						RawTerminal:  true,
 					}
 
@@ -301,12 +975,31 @@ func (b *Builder) BuildStep(step *Step) error {
 					success <- struct{}{}
 				}()
 				<-success
+
+				inspect, err := b.inspectExec(execObj.ID)
+				if err != nil {
+					return err
+				}
+
+				b.emit(Event{Type: EventCommandExited, Step: step.Name, Command: cmd, ExitCode: &inspect.ExitCode})
+				if inspect.ExitCode != 0 {
+					if !step.Cleanup.IgnoreErrors {
+						b.Conf.Logger.Errorf("Cleanup command '%s' on container %s exit with exit code %d", cmd, container.ID, inspect.ExitCode)
+						keptForDebugging = b.keepForDebugging(step, container.ID)
+						return &CommandError{Command: cmd, ExitCode: inspect.ExitCode}
+					}
+					b.Conf.Logger.Warningf("Cleanup command '%s' on container %s exit with exit code %d. Ignoring", cmd, container.ID, inspect.ExitCode)
+				}
 			}
 
-			// commit the container
+			// commit the container. Without squashing the commit is the step image
 			cmtOpts := docker.CommitContainerOptions{
+				Context:   b.context(),
 				Container: container.ID,
 			}
+			if !step.Squash {
+				cmtOpts.Repository, cmtOpts.Tag = splitImageTag(b.uniqueStepName(step))
+			}
 
 			b.Conf.Logger.Debugf("Commiting the container %s", container.ID)
 			img, err := b.docker.CommitContainer(cmtOpts)
@@ -320,127 +1013,75 @@ func (b *Builder) BuildStep(step *Step) error {
 				return err
 			}
 
-			tmpFile, err := ioutil.TempFile("", "habitus-export-")
-			if err != nil {
-				return err
-			}
-			defer tmpFile.Close()
-			tarWriter, err := os.Create(tmpFile.Name())
-			if err != nil {
-				return err
-			}
-			defer tarWriter.Close()
-			// save the container
-			expOpts := docker.ExportImageOptions{
-				Name:         img.ID,
-				OutputStream: tarWriter,
-			}
-
-			b.Conf.Logger.Noticef("Exporting cleaned up container %s to %s", img.ID, tmpFile.Name())
-			err = b.docker.ExportImage(expOpts)
-			if err != nil {
-				return err
-			}
-
-			// Squash
-			sqTmpFile, err := ioutil.TempFile("", "habitus-export-")
-			if err != nil {
-				return err
-			}
-			defer sqTmpFile.Close()
-			b.Conf.Logger.Noticef("Squashing image %s into %s", sqTmpFile.Name(), img.ID)
-
-			squasher := squash.Squasher{Conf: b.Conf}
-			err = squasher.Squash(tmpFile.Name(), sqTmpFile.Name(), b.uniqueStepName(step))
-			if err != nil {
-				return err
-			}
-
-			b.Conf.Logger.Debugf("Removing exported temp files")
-			err = os.Remove(tmpFile.Name())
-			if err != nil {
-				return err
-			}
-			// Load
-			sqashedFile, err := os.Open(sqTmpFile.Name())
-			if err != nil {
-				return err
-			}
-			defer sqashedFile.Close()
-
-			loadOps := docker.LoadImageOptions{
-				InputStream: sqashedFile,
-			}
-			b.Conf.Logger.Debugf("Loading squashed image into docker")
-			err = b.docker.LoadImage(loadOps)
-			if err != nil {
-				return err
-			}
-
-			err = os.Remove(sqTmpFile.Name())
-			if err != nil {
-				return err
+			if step.Squash {
+				if err := b.squashImage(step, img.ID); err != nil {
+					return err
+				}
 			}
 		}
 
 		if len(step.Artifacts) > 0 {
-			b.Conf.Logger.Noticef("Starting container %s to fetch artifact permissions", container.ID)
-			startOpts := &docker.HostConfig{}
-			err := b.docker.StartContainer(container.ID, startOpts)
-			if err != nil {
-				return err
-			}
-
-			permMap := make(map[string]int)
+			// files are copied from the stopped container with the mode in their tar header.
+			// The container only runs to match globs and to copy to volumes
+			artifacts := step.Artifacts
+			if needsRunningContainer(step.Artifacts) {
+				b.Conf.Logger.Noticef("Starting container %s to find and copy artifacts", container.ID)
+				startOpts := &docker.HostConfig{}
+				err := b.docker.StartContainer(container.ID, startOpts)
+				if err != nil {
+					return err
+				}
 
-			for _, art := range step.Artifacts {
-				execOpts := docker.CreateExecOptions{
-					Container:    container.ID,
-					AttachStdin:  false,
-					AttachStdout: true,
-					AttachStderr: true,
-					Tty:          false,
-					Cmd:          []string{"stat", "--format='%a'", art.Source},
+				artifacts, err = b.expandArtifacts(step, container.ID)
+				if err != nil {
+					return err
 				}
-				execObj, err := b.docker.CreateExec(execOpts)
+				artifacts, err = b.checkArtifactSources(step, container.ID, artifacts)
 				if err != nil {
 					return err
 				}
 
-				buf := new(bytes.Buffer)
-				startExecOpts := docker.StartExecOptions{
-					OutputStream: buf,
-					ErrorStream:  os.Stderr,
-					RawTerminal:  false,
-					Detach:       false,
+				for _, art := range artifacts {
+					// volume artifacts are copied while the container runs and keep their permissions
+					if art.Volume != "" {
+						if err := b.copyToVolume(step, container.ID, &art); err != nil {
+							return err
+						}
+						copiedArtifacts = append(copiedArtifacts, CopiedArtifact{Source: art.Source, Dest: art.Volume + ":" + volumeArtifactPath(&art)})
+						b.emit(Event{Type: EventArtifactCopied, Step: step.Name, Artifact: art.Source, Dest: art.Volume + ":" + art.Dest})
+					}
 				}
 
-				if err := b.docker.StartExec(execObj.ID, startExecOpts); err != nil {
-					b.Conf.Logger.Errorf("Failed to fetch artifact permissions for %s: %s", art.Source, err.Error())
+				b.Conf.Logger.Debugf("Stopping the container %s", container.ID)
+				err = b.docker.StopContainer(container.ID, 0)
+				if err != nil {
+					return err
 				}
-
-				permsString := strings.Replace(strings.Replace(buf.String(), "'", "", -1), "\n", "", -1)
-				perms, err := strconv.Atoi(permsString)
+			} else {
+				var err error
+				artifacts, err = b.checkArtifactSources(step, container.ID, artifacts)
 				if err != nil {
-					b.Conf.Logger.Errorf("Failed to fetch artifact permissions for %s: %s", art.Source, err.Error())
+					return err
 				}
-				permMap[art.Source] = perms
-				b.Conf.Logger.Debugf("Permissions for %s is %d", art.Source, perms)
-			}
-
-			b.Conf.Logger.Debugf("Stopping the container %s", container.ID)
-			err = b.docker.StopContainer(container.ID, 0)
-			if err != nil {
-				return err
 			}
 
 			b.Conf.Logger.Noticef("Copying artifacts from %s", container.ID)
 
-			for _, art := range step.Artifacts {
-				err = b.copyToHost(&art, container.ID, permMap)
+			for _, art := range artifacts {
+				if art.Volume != "" {
+					continue
+				}
+				var newFiles []string
+				if art.glob != "" {
+					newFiles = b.missingArtifactFiles(&art)
+				}
+				err := b.copyToHost(&art, container.ID)
+				b.trackGlobArtifactFiles(newFiles)
 				if err != nil {
 					return err
 				}
+				copiedArtifacts = append(copiedArtifacts, CopiedArtifact{Source: art.Source, Dest: b.artifactHostPath(&art)})
+				b.emit(Event{Type: EventArtifactCopied, Step: step.Name, Artifact: art.Source, Dest: art.Dest})
 			}
 		}
 
@@ -455,22 +1096,23 @@ func (b *Builder) BuildStep(step *Step) error {
 			}
 
 			execOpts := docker.CreateExecOptions{
+				Context:      b.context(),
 				Container:    container.ID,
 				AttachStdin:  false,
 				AttachStdout: true,
 				AttachStderr: true,
 				Tty:          true,
-				Cmd:          strings.Split(step.Command, " "),
+				Cmd:          b.withStepEnv(step, strings.Split(step.Command, " ")),
 			}
 			execObj, err := b.docker.CreateExec(execOpts)
 			if err != nil {
 				return err
 			}
 
-			buf := new(bytes.Buffer)
 			startExecOpts := docker.StartExecOptions{
-				OutputStream: buf,
-				ErrorStream:  os.Stderr,
+				Context:      b.context(),
+				OutputStream: b.stepOutput(step),
+				ErrorStream:  b.stepErrors(step),
 				RawTerminal:  true,
 				Detach:       false,
 			}
@@ -481,16 +1123,16 @@ func (b *Builder) BuildStep(step *Step) error {
 				b.Conf.Logger.Errorf("Failed to execute command '%s' due to %s", step.Command, err.Error())
 			}
 
-			b.Conf.Logger.Noticef("\n%s", buf)
-
-			inspect, err := b.docker.InspectExec(execObj.ID)
+			inspect, err := b.inspectExec(execObj.ID)
 			if err != nil {
 				return err
 			}
 
+			b.emit(Event{Type: EventCommandExited, Step: step.Name, Command: step.Command, ExitCode: &inspect.ExitCode})
 			if inspect.ExitCode != 0 {
 				b.Conf.Logger.Errorf("Running command %s on container %s exit with exit code %d", execOpts.Cmd, container.ID, inspect.ExitCode)
-				return err
+				keptForDebugging = b.keepForDebugging(step, container.ID)
+				return &CommandError{Command: step.Command, ExitCode: inspect.ExitCode}
 			} else {
 				b.Conf.Logger.Noticef("Running command %s on container %s exit with exit code %d", execOpts.Cmd, container.ID, inspect.ExitCode)
 			}
@@ -510,19 +1152,87 @@ func (b *Builder) BuildStep(step *Step) error {
 		}
 
 		b.Conf.Logger.Debugf("Removing built container %s", container.ID)
+		removed = true
 		err = b.docker.RemoveContainer(removeOpts)
 		if err != nil {
 			return err
 		}
+		b.untrackContainer(container.ID)
+	}
+
+	if err := b.tagImage(step); err != nil {
+		return err
+	}
+
+	if step.Push != nil {
+		err = b.pushImage(step)
+		if err != nil {
+			return err
+		}
+	}
+
+	if output := b.outputPath(step); output != "" {
+		if err := b.saveImage(step, output); err != nil {
+			return err
+		}
+	}
+
+	// only steps declaring artifacts are expected to produce some
+	if len(step.Artifacts) > 0 && len(copiedArtifacts) == 0 {
+		switch b.Conf.ArtifactsNotice {
+		case configuration.ArtifactsNoticeWarn:
+			b.Conf.Logger.Warningf("Step %s finished without producing any artifacts", step.Name)
+		case configuration.ArtifactsNoticeStrict:
+			return fmt.Errorf("step %s finished without producing any artifacts", step.Name)
+		}
+	}
+
+	if step.PostBuild != "" {
+		if err := b.runPostBuild(step, copiedArtifacts); err != nil {
+			return err
+		}
+	}
+
+	if b.Conf.GeneratedDir != "" {
+		if err := b.saveGeneratedDockerfile(step); err != nil {
+			return err
+		}
 	}
 
 	// clean up the parsed docker file. It will remain there if there was a problem
-	err = os.Remove(b.uniqueDockerfile(step))
+	if !b.Conf.KeepGenerated {
+		err = os.Remove(b.uniqueDockerfile(step))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copies the generated Dockerfile of a step to the generated files folder as <step label>.Dockerfile
+func (b *Builder) saveGeneratedDockerfile(step *Step) error {
+	data, err := ioutil.ReadFile(b.uniqueDockerfile(step))
 	if err != nil {
 		return err
 	}
 
-	return nil
+	if err := os.MkdirAll(b.Conf.GeneratedDir, 0755); err != nil {
+		return err
+	}
+
+	dest := filepath.Join(b.Conf.GeneratedDir, step.Label+".Dockerfile")
+	b.Conf.Logger.Debugf("Saving the generated Dockerfile of %s to %s", step.Name, dest)
+	return ioutil.WriteFile(dest, data, 0644)
+}
+
+// a FROM field replaced with the unique name of the step it refers to. StartLine and
+// EndLine are the lines of the FROM instruction in the Dockerfile
+type fromRewrite struct {
+	From      string
+	To        string
+	StartLine int
+	EndLine   int
 }
 
 // this replaces the FROM field in the Dockerfile to one with the previous step's unique name
@@ -530,46 +1240,417 @@ func (b *Builder) BuildStep(step *Step) error {
 func (b *Builder) replaceFromField(step *Step) error {
 	b.Conf.Logger.Noticef("Parsing and converting '%s'", step.Dockerfile)
 
-	rwc, err := os.Open(path.Join(b.Conf.Workdir, step.Dockerfile))
+	parsed, err := b.parseDockerfile(step)
 	if err != nil {
 		return err
 	}
-	defer rwc.Close()
 
-	d := parser.Directive{LookingForDirectives: true}
-	parser.SetEscapeToken(parser.DefaultEscapeToken, &d)
-	node, err := parser.Parse(rwc, &d)
+	generated := rewriteFromLines(parsed.Source, parsed.Rewrites)
+	// the classic builder has no cache mounts. The caches are only in the step container then
+	if len(step.Caches) > 0 && b.useBuildKit(step) {
+		generated = b.addCacheMounts(step, generated, parsed.RunLines)
+	}
+	if labels := b.labelInstructions(step); labels != "" {
+		if len(generated) > 0 && !bytes.HasSuffix(generated, []byte("\n")) {
+			generated = append(generated, '\n')
+		}
+		generated = append(generated, labels...)
+	}
+
+	// did it have any effect?
+	b.Conf.Logger.Debugf("Writing the new Dockerfile into %s", b.uniqueDockerfile(step))
+	err = ioutil.WriteFile(b.uniqueDockerfile(step), generated, 0644)
 	if err != nil {
 		return err
 	}
 
+	return nil
+}
+
+// a step Dockerfile with the FROM fields referring to other steps and the images
+// the other FROM fields use
+type parsedDockerfile struct {
+	Source     []byte
+	Rewrites   []fromRewrite
+	BaseImages []string
+	// first lines of the RUN instructions
+	RunLines []int
+}
+
+// parses the step Dockerfile and finds the FROM fields referring to other steps
+// which are to be replaced with their unique names
+func (b *Builder) parseDockerfile(step *Step) (*parsedDockerfile, error) {
+	rwc, err := step.openDockerfile(b.Conf.Workdir)
+	if err != nil {
+		return nil, err
+	}
+	defer rwc.Close()
+
+	source, err := ioutil.ReadAll(rwc)
+	if err != nil {
+		return nil, err
+	}
+
+	node, _, err := parseDockerfileSource(bytes.NewReader(source))
+	if err != nil {
+		return nil, err
+	}
+
+	// ARGs declared before the first FROM can be used in FROM lines. Their values
+	// come from the step build args or the ARG defaults
+	stepArgs := make(map[string]string)
+	for _, arg := range b.buildArgs(step) {
+		stepArgs[arg.Name] = arg.Value
+	}
+	fromArgs := make(map[string]string)
+	seenFrom := false
+	// stage names of multi stage builds aren't images
+	stages := make(map[string]bool)
+
+	parsed := &parsedDockerfile{Source: source}
 	for _, child := range node.Children {
+		if child.Value == "arg" && !seenFrom {
+			for n := child.Next; n != nil; n = n.Next {
+				name, value := parseArgDeclaration(n.Value)
+				if override, ok := stepArgs[name]; ok {
+					value = override
+				}
+				fromArgs[name] = value
+			}
+		}
+
+		if child.Value == "run" {
+			parsed.RunLines = append(parsed.RunLines, child.StartLine)
+		}
+
 		if child.Value == "from" {
+			seenFrom = true
 			// found it. is it from anyone we know?
 			if child.Next == nil {
-				return errors.New("invalid Dockerfile. No valid FROM found")
+				return nil, errors.New("invalid Dockerfile. No valid FROM found")
 			}
 
-			imageName := child.Next.Value
-			found, err := step.Manifest.FindStepByName(imageName)
+			// the parser keeps the stage name of multi stage builds in the value
+			fields := strings.Fields(child.Next.Value)
+			imageName := fields[0]
+			resolved := os.Expand(imageName, func(name string) string {
+				return fromArgs[name]
+			})
+			// use the whole build as step.Manifest only holds the steps loaded before this one
+			found, err := b.Build.FindStepByImage(resolved, step)
 			if err != nil {
-				return err
+				return nil, err
 			}
 
 			if found != nil {
-				child.Next.Value = b.uniqueStepName(found)
+				parsed.Rewrites = append(parsed.Rewrites, fromRewrite{
+					From:      imageName,
+					To:        b.uniqueStepName(found),
+					StartLine: child.StartLine,
+					EndLine:   child.EndLine,
+				})
+			} else if !stages[strings.ToLower(resolved)] && resolved != "scratch" && !strings.Contains(resolved, "$") {
+				parsed.BaseImages = append(parsed.BaseImages, resolved)
+			}
+
+			if len(fields) == 3 && strings.ToLower(fields[1]) == "as" {
+				stages[strings.ToLower(fields[2])] = true
 			}
 		}
 	}
 
-	// did it have any effect?
-	b.Conf.Logger.Debugf("Writing the new Dockerfile into %s", step.Dockerfile+".generated")
-	err = ioutil.WriteFile(b.uniqueDockerfile(step), []byte(dumpDockerfile(node)), 0644)
+	return parsed, nil
+}
+
+// splits an ARG declaration into its name and default value. Quotes around the value are removed
+func parseArgDeclaration(decl string) (string, string) {
+	parts := strings.SplitN(decl, "=", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+
+	value := parts[1]
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		value = value[1 : len(value)-1]
+	}
+
+	return parts[0], value
+}
+
+// replaces the image of the rewritten FROM instructions in the Dockerfile source. Only the
+// image is changed so comments, directives and the layout of the file stay as they are
+func rewriteFromLines(source []byte, rewrites []fromRewrite) []byte {
+	lines := bytes.SplitAfter(source, []byte("\n"))
+	for _, r := range rewrites {
+		for n := r.StartLine; n <= r.EndLine && n <= len(lines); n++ {
+			line, ok := replaceImageWord(lines[n-1], r.From, r.To, n == r.StartLine)
+			if ok {
+				lines[n-1] = line
+				break
+			}
+		}
+	}
+
+	return bytes.Join(lines, nil)
+}
+
+var dockerfileWord = regexp.MustCompile(`\S+`)
+
+// replaces the first whitespace delimited word of a line matching from. The FROM
+// keyword and its flags are skipped on the first line of the instruction
+func replaceImageWord(line []byte, from string, to string, first bool) ([]byte, bool) {
+	for i, loc := range dockerfileWord.FindAllIndex(line, -1) {
+		word := string(line[loc[0]:loc[1]])
+		if first && (i == 0 || strings.HasPrefix(word, "--")) {
+			continue
+		}
+		if word != from {
+			continue
+		}
+
+		replaced := append([]byte{}, line[:loc[0]]...)
+		replaced = append(replaced, to...)
+		return append(replaced, line[loc[1]:]...), true
+	}
+
+	return line, false
+}
+
+// parses a Dockerfile starting with the default escape token. An escape directive
+// at the top of the file replaces it while parsing
+func parseDockerfileSource(r io.Reader) (*parser.Node, *parser.Directive, error) {
+	d := &parser.Directive{LookingForDirectives: true}
+	if err := parser.SetEscapeToken(parser.DefaultEscapeToken, d); err != nil {
+		return nil, nil, err
+	}
+
+	node, err := parser.Parse(r, d)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	return nil
+	return node, d, nil
+}
+
+// returns LABEL instructions for the global and step labels, step labels overriding
+// global ones. They are added at the end of the Dockerfile so they only change its last layer
+func (b *Builder) labelInstructions(step *Step) string {
+	labels := make(map[string]string)
+	for _, l := range b.Conf.Labels {
+		labels[l.Key] = l.Value
+	}
+	for k, v := range step.Labels {
+		labels[k] = v
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+
+	var keys []string
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		pairs = append(pairs, strconv.Quote(k)+"="+strconv.Quote(labels[k]))
+	}
+
+	return "LABEL " + strings.Join(pairs, " ") + "\n"
+}
+
+// returns the cleanup commands to run each in their own exec. Single shell
+// cleanups run all the commands as one
+func cleanupCommands(step *Step) []string {
+	if step.Cleanup.SingleShell && len(step.Cleanup.Commands) > 0 {
+		return []string{strings.Join(step.Cleanup.Commands, " && ")}
+	}
+
+	return step.Cleanup.Commands
+}
+
+// runs cmd through env with the step environment variables. The vendored docker client
+// can't set the environment of an exec and setting it on the container would commit it
+// into the image
+func (b *Builder) withStepEnv(step *Step, cmd []string) []string {
+	if len(step.Env) == 0 {
+		return cmd
+	}
+
+	var keys []string
+	for k := range step.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	envCmd := []string{"env"}
+	for _, k := range keys {
+		envCmd = append(envCmd, k+"="+step.Env[k])
+	}
+
+	return append(envCmd, cmd...)
+}
+
+// runs a command in a running container with the step shell and returns its output and exit code
+func (b *Builder) execOutput(step *Step, containerID string, cmd string) (string, int, error) {
+	execOpts := docker.CreateExecOptions{
+		Context:      b.context(),
+		Container:    containerID,
+		AttachStdin:  false,
+		AttachStdout: true,
+		AttachStderr: true,
+		Tty:          false,
+		Cmd:          []string{step.Shell, "-c", cmd},
+	}
+	execObj, err := b.docker.CreateExec(execOpts)
+	if err != nil {
+		return "", 0, err
+	}
+
+	buf := new(bytes.Buffer)
+	startExecOpts := docker.StartExecOptions{
+		Context:      b.context(),
+		OutputStream: buf,
+		ErrorStream:  ioutil.Discard,
+		RawTerminal:  false,
+		Detach:       false,
+	}
+	if err := b.docker.StartExec(execObj.ID, startExecOpts); err != nil {
+		return "", 0, err
+	}
+
+	inspect, err := b.inspectExec(execObj.ID)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return buf.String(), inspect.ExitCode, nil
+}
+
+// true when some artifacts have globs to match or are copied to a volume
+func needsRunningContainer(artifacts []Artifact) bool {
+	for _, art := range artifacts {
+		if art.Volume != "" || strings.ContainsAny(art.Source, "*?[") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stops a container download once it has written anything
+var errArtifactFound = errors.New("artifact found")
+
+type probeWriter struct{}
+
+func (probeWriter) Write(p []byte) (int, error) {
+	return 0, errArtifactFound
+}
+
+// checks the artifact sources are in the container before anything is copied. Missing
+// optional artifacts are left out with a warning. Others fail the step
+func (b *Builder) checkArtifactSources(step *Step, containerID string, artifacts []Artifact) ([]Artifact, error) {
+	var found []Artifact
+	for _, art := range artifacts {
+		// only the start of the archive is downloaded
+		err := b.docker.DownloadFromContainer(containerID, docker.DownloadFromContainerOptions{
+			Context:      b.context(),
+			OutputStream: probeWriter{},
+			Path:         art.Source,
+		})
+		if e, ok := err.(*docker.Error); ok && e.Status == http.StatusNotFound {
+			if !art.Optional {
+				return nil, fmt.Errorf("artifact %s of step %s is not in the image", art.Source, step.Name)
+			}
+			b.Conf.Logger.Warningf("Optional artifact %s of step %s is not in the image. Skipping", art.Source, step.Name)
+			continue
+		}
+		if err != nil && err != errArtifactFound {
+			return nil, err
+		}
+
+		found = append(found, art)
+	}
+
+	return found, nil
+}
+
+// replaces the artifacts with a glob pattern in their source with one artifact per
+// matching file in the container. the container should be running
+func (b *Builder) expandArtifacts(step *Step, containerID string) ([]Artifact, error) {
+	var artifacts []Artifact
+	for _, art := range step.Artifacts {
+		if !strings.ContainsAny(art.Source, "*?[") {
+			artifacts = append(artifacts, art)
+			continue
+		}
+
+		out, exitCode, err := b.execOutput(step, containerID, "ls -1d -- "+shellGlob(art.Source))
+		if err != nil {
+			return nil, err
+		}
+		// one match per line so paths can have spaces
+		var matches []string
+		for _, line := range strings.Split(out, "\n") {
+			if line = strings.TrimRight(line, "\r"); line != "" {
+				matches = append(matches, line)
+			}
+		}
+		if exitCode != 0 || len(matches) == 0 {
+			b.Conf.Logger.Warningf("No files match artifact %s in step %s", art.Source, step.Name)
+			continue
+		}
+
+		for _, match := range matches {
+			matched := art
+			matched.Source = match
+			matched.glob = art.Source
+			b.Conf.Logger.Debugf("Artifact %s matched %s", art.Source, match)
+			artifacts = append(artifacts, matched)
+		}
+	}
+
+	return artifacts, nil
+}
+
+// quotes a string for the shell so it's passed as a single word, as it is
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// quotes a glob pattern for the shell. The wildcards and bracket expressions are
+// left out of the quotes so the shell still expands them
+func shellGlob(pattern string) string {
+	var out, literal bytes.Buffer
+	flush := func() {
+		if literal.Len() > 0 {
+			out.WriteString(shellQuote(literal.String()))
+			literal.Reset()
+		}
+	}
+
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*', '?':
+			flush()
+			out.WriteByte(c)
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				literal.WriteByte(c)
+				continue
+			}
+			flush()
+			out.WriteString(pattern[i : i+end+2])
+			i += end + 1
+		default:
+			literal.WriteByte(c)
+		}
+	}
+	flush()
+
+	return out.String()
 }
 
 func overwrite(mpath string) (*os.File, error) {
@@ -583,16 +1664,21 @@ func overwrite(mpath string) (*os.File, error) {
 	return f, nil
 }
 
-func (b *Builder) copyToHost(a *Artifact, container string, perms map[string]int) error {
+func (b *Builder) copyToHost(a *Artifact, container string) error {
 	// create the artifacts distination folder if not there
-	destPath := path.Join(b.Conf.Workdir, a.Dest)
+	destPath := b.artifactDestPath(a)
 	err := os.MkdirAll(destPath, 0777)
 	if err != nil {
 		return err
 	}
 
+	if a.Archive == archiveTarGz {
+		return b.archiveToHost(a, container)
+	}
+
 	var out bytes.Buffer
 	opt := docker.DownloadFromContainerOptions{
+		Context:      b.context(),
 		OutputStream: &out,
 		Path:         a.Source,
 	}
@@ -603,7 +1689,8 @@ func (b *Builder) copyToHost(a *Artifact, container string, perms map[string]int
 	}
 
 	// create artifact file on the host
-	destFile := path.Join(destPath, filepath.Base(a.Source))
+	destFile := b.artifactHostPath(a)
+	var owner *tar.Header
 	tr := tar.NewReader(&out)
 	for {
 		hdr, err := tr.Next()
@@ -628,74 +1715,257 @@ func (b *Builder) copyToHost(a *Artifact, container string, perms map[string]int
 			if _, err := io.Copy(dest, tr); err != nil {
 				return err
 			}
+			owner = hdr
 		default:
 			return errors.New("Invalid header type")
 		}
 	}
 
-	b.Conf.Logger.Debugf("Setting file permissions for %s to %d", destFile, perms[a.Source])
-	err = os.Chmod(destFile, os.FileMode(perms[a.Source])|0700)
+	if owner == nil {
+		return fmt.Errorf("artifact %s is not a file", a.Source)
+	}
+
+	if err := b.checkArtifactSum(a, destFile); err != nil {
+		return err
+	}
+
+	b.Conf.Logger.Debugf("Setting file permissions for %s to %o", destFile, owner.FileInfo().Mode().Perm())
+	err = os.Chmod(destFile, owner.FileInfo().Mode().Perm()|0700)
 	if err != nil {
 		return err
 	}
 
+	// only root can give files away to other users. The ids in the container are
+	// mapped to the host ones of a daemon with a user namespace
+	if !a.Step.IgnoreOwnership && !b.Conf.IgnoreOwnership && os.Geteuid() == 0 {
+		uid, gid := mapID(b.idMap, owner.Uid), mapID(b.idMap, owner.Gid)
+		b.Conf.Logger.Debugf("Setting file owner for %s to %d:%d", destFile, uid, gid)
+		err = os.Chown(destFile, uid, gid)
+		if err != nil {
+			return err
+		}
+	}
+
+	if a.PostCopy != "" {
+		err = b.runPostCopy(a, destFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writes the tar stream of an artifact to the host as a gzipped archive. The files
+// keep their permissions and owners inside the archive
+func (b *Builder) archiveToHost(a *Artifact, container string) error {
+	destFile := b.artifactHostPath(a)
+	b.Conf.Logger.Infof("Archiving %s to %s", a.Source, destFile)
+
+	f, err := os.Create(destFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	err = b.docker.DownloadFromContainer(container, docker.DownloadFromContainerOptions{
+		Context:      b.context(),
+		OutputStream: gz,
+		Path:         a.Source,
+	})
+	if err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	if err := b.checkArtifactSum(a, destFile); err != nil {
+		return err
+	}
+
+	if a.PostCopy != "" {
+		return b.runPostCopy(a, destFile)
+	}
+
+	return nil
+}
+
+// checks the sha256 of an artifact copied to the host against the expected one and
+// writes it to a <file>.sha256 file in sha256sum format when checksum files are on
+func (b *Builder) checkArtifactSum(a *Artifact, destFile string) error {
+	if a.SHA256 == "" && !b.Conf.ArtifactChecksums {
+		return nil
+	}
+
+	f, err := os.Open(destFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	if a.SHA256 != "" && sum != a.SHA256 {
+		return fmt.Errorf("artifact %s of step %s has sha256 %s instead of %s", a.Source, a.Step.Name, sum, a.SHA256)
+	}
+
+	if b.Conf.ArtifactChecksums {
+		b.Conf.Logger.Debugf("Writing the sha256 of %s to %s.sha256", destFile, destFile)
+		return ioutil.WriteFile(destFile+".sha256", []byte(sum+"  "+filepath.Base(destFile)+"\n"), 0644)
+	}
+
+	return nil
+}
+
+// runs the post copy command of an artifact on the host
+func (b *Builder) runPostCopy(a *Artifact, destFile string) error {
+	tmpl, err := template.New("post_copy").Parse(a.PostCopy)
+	if err != nil {
+		return fmt.Errorf("invalid post_copy command for %s: %s", a.Source, err.Error())
+	}
+
+	var cmdLine bytes.Buffer
+	err = tmpl.Execute(&cmdLine, struct {
+		Path string
+		Step string
+	}{Path: destFile, Step: a.Step.Name})
+	if err != nil {
+		return err
+	}
+
+	b.Conf.Logger.Noticef("Running post copy command '%s'", cmdLine.String())
+	cmd := exec.CommandContext(b.context(), "/bin/sh", "-c", cmdLine.String())
+	cmd.Dir = b.Conf.Workdir
+	cmd.Stdout = b.stepOutput(&a.Step)
+	cmd.Stderr = b.stepErrors(&a.Step)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("post copy command '%s' for %s failed: %s", cmdLine.String(), a.Source, err.Error())
+	}
+
 	return nil
 }
 
-func (b *Builder) createContainer(step *Step) (*docker.Container, error) {
+// leaves the running container of a failed command for debugging in debug on failure mode.
+// returns true when the container is kept
+func (b *Builder) keepForDebugging(step *Step, containerID string) bool {
+	if !b.Conf.DebugOnFailure {
+		return false
+	}
+
+	// a cancelled build shouldn't remove it either
+	b.untrackContainer(containerID)
+	b.Conf.Logger.Errorf("Container %s of step %s is left running for debugging. Attach to it with:\n  docker exec -it %s %s\nand remove it with:\n  docker rm -f %s",
+		containerID, step.Name, containerID, step.Shell, containerID)
+
+	return true
+}
+
+// removes the container of a failed step. The step error is the one reported
+// so a failed removal is only warned about
+func (b *Builder) removeFailedContainer(containerID string) {
+	b.Conf.Logger.Debugf("Removing container %s of the failed step", containerID)
+	err := b.docker.RemoveContainer(docker.RemoveContainerOptions{ID: containerID, RemoveVolumes: true, Force: true})
+	if err != nil {
+		b.Conf.Logger.Warningf("Failed to remove container %s: %s", containerID, err.Error())
+		return
+	}
+	b.untrackContainer(containerID)
+}
+
+// builds the step image from the generated Dockerfile
+func (b *Builder) buildImage(step *Step, opts docker.BuildImageOptions, buildArgs []docker.BuildArg) error {
+	b.pullCacheImages(step)
+
+	err := b.withRetry("Building "+b.uniqueStepName(step), func() error {
+		if b.useBuildKit(step) {
+			return b.buildWithBuildKit(step, buildArgs, opts.NoCache)
+		}
+
+		// the context is read by the build so each attempt needs a new one
+		context, err := b.buildContext(step)
+		if err != nil {
+			return err
+		}
+		defer context.Close()
+		opts.InputStream = context
+
+		return b.docker.BuildImage(opts)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// squash steps without cleanup commands straight away. Steps with
+	// cleanup commands are squashed after the commands run
+	if step.Squash && !b.Conf.NoSquash && len(step.Cleanup.Commands) == 0 {
+		return b.squashImage(step, b.uniqueStepName(step))
+	}
+
+	return nil
+}
+
+// creates the container for a step
+func (b *Builder) createContainer(step *Step, hostConfig *docker.HostConfig) (*docker.Container, error) {
 	config := docker.Config{
 		AttachStdout: true,
 		AttachStdin:  false,
 		AttachStderr: true,
 		Image:        b.uniqueStepName(step),
-		Cmd:          []string{"/bin/bash"},
+		Cmd:          []string{step.Shell},
 		Tty:          true,
 	}
 
+	// there is no platform option on create in the vendored docker client, so the
+	// container would run on the daemon platform
+	if step.Platform != "" {
+		daemon, err := b.daemonPlatform()
+		if err != nil {
+			return nil, err
+		}
+		if !samePlatform(step.Platform, daemon) {
+			return nil, fmt.Errorf("step %s is built for %s but its container can't run on the %s daemon. Remove its command, cleanup commands and artifacts or build it on a %s daemon", step.Name, step.Platform, daemon, step.Platform)
+		}
+	}
+
 	r, _ := regexp.Compile("/?[^a-zA-Z0-9_-]+")
 	containerName := r.ReplaceAllString(b.uniqueStepName(step), "-") + "." + uniuri.New()
 	opts := docker.CreateContainerOptions{
-		Name:   containerName,
-		Config: &config,
+		Context:    b.context(),
+		Name:       containerName,
+		Config:     &config,
+		HostConfig: hostConfig,
 	}
 	container, err := b.docker.CreateContainer(opts)
 	if err != nil {
 		return nil, err
 	}
+	b.trackContainer(container.ID)
 
 	return container, nil
 }
 
-func dumpDockerfile(node *parser.Node) string {
-	str := ""
-	str += node.Value
-
-	if len(node.Flags) > 0 {
-		str += fmt.Sprintf(" %q", node.Flags)
+func (b *Builder) uniqueDockerfile(step *Step) string {
+	if step.DockerfileInline != "" {
+		// inline Dockerfiles are written to the step context as the daemon reads them from it
+		return filepath.Join(step.contextDir(b.Conf.Workdir), "Dockerfile."+step.Label) + ".generated"
 	}
 
-	for _, n := range node.Children {
-		if (n.Value == "cmd") {
-			//keep the old cmd
-			str += n.Original + "\n"
-		} else {
-			str += dumpDockerfile(n) + "\n"
-		}
-	}
+	return filepath.Join(step.contextDir(b.Conf.Workdir), step.Dockerfile) + ".generated"
+}
 
-	if node.Next != nil {
-		for n := node.Next; n != nil; n = n.Next {
-			if len(n.Children) > 0 {
-				str += " " + dumpDockerfile(n)
-			} else {
-				str += " " + n.Value
-			}
-		}
+// the generated Dockerfile of a step relative to its build context
+func (b *Builder) contextDockerfile(step *Step) string {
+	rel, err := filepath.Rel(step.contextDir(b.Conf.Workdir), b.uniqueDockerfile(step))
+	if err != nil {
+		return filepath.Base(b.uniqueDockerfile(step))
 	}
 
-	return strings.TrimSpace(str)
-}
-
-func (b *Builder) uniqueDockerfile(step *Step) string {
-	return filepath.Join(b.Conf.Workdir, step.Dockerfile) + ".generated"
+	return filepath.ToSlash(rel)
 }
@@ -0,0 +1,3179 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cloud66/habitus/configuration"
+	"github.com/cloud66/habitus/squash"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/op/go-logging"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const diamondManifest = `
+build:
+  version: 2016-03-14
+  steps:
+    base:
+      name: base
+      dockerfile: Dockerfile.base
+    left:
+      name: left
+      dockerfile: Dockerfile.left
+      depends_on:
+        - base
+    right:
+      name: right
+      dockerfile: Dockerfile.right
+      depends_on:
+        - base
+    final:
+      name: final
+      dockerfile: Dockerfile.final
+      depends_on:
+        - left
+        - right
+      depends_on_args:
+        left:
+          VARIANT: left
+          LEFT_ONLY: "1"
+        right:
+          VARIANT: right
+`
+
+// an event sink keeping the events it receives
+type recordingSink struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (s *recordingSink) Emit(event Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+}
+
+// a docker client which only implements what a test sets. Other calls panic
+type fakeDocker struct {
+	DockerClient
+	images  map[string]*docker.Image
+	removed []string
+	// tar stream returned for container downloads
+	download []byte
+	// container paths downloads don't find
+	missing map[string]bool
+	// inspects of an exec which report it as running
+	execRunning int
+	// exit code of the exec commands
+	execExitCode int
+	// output written by the exec commands
+	execOutput string
+	// commands of the execs created
+	execs [][]string
+	// image histories returned by name
+	history map[string][]docker.ImageHistory
+	// names of the images built and the containers created
+	built   []string
+	created []string
+	// called with the options of the containers created
+	onCreate func(opts docker.CreateContainerOptions)
+	// options of the containers committed
+	committed []docker.CommitContainerOptions
+	// options of the images removed, by name, and the error returned for them
+	rmi    map[string]docker.RemoveImageOptions
+	rmiErr error
+	// images tagged as repo:tag, by source image
+	tagged map[string][]string
+	// networks created by ID. The containers created on one are attached to it
+	networks        map[string]*docker.Network
+	disconnected    []string
+	removedNetworks []string
+	// what the loads read from their input and the error the read ended with
+	loaded  []byte
+	loadErr error
+	// images pulled as repo:tag and the error returned for them
+	pulled  []string
+	pullErr error
+	// images pushed and the credentials they were pushed with
+	pushed     []docker.PushImageOptions
+	pushedAuth []docker.AuthConfiguration
+	// version of the daemon
+	daemon  docker.Env
+	pingErr error
+}
+
+func (f *fakeDocker) Version() (*docker.Env, error) {
+	return &f.daemon, nil
+}
+
+func (f *fakeDocker) ImageHistory(name string) ([]docker.ImageHistory, error) {
+	return f.history[name], nil
+}
+
+func (f *fakeDocker) BuildImage(opts docker.BuildImageOptions) error {
+	f.built = append(f.built, opts.Name)
+	return nil
+}
+
+func (f *fakeDocker) CreateContainer(opts docker.CreateContainerOptions) (*docker.Container, error) {
+	f.created = append(f.created, opts.Name)
+	for _, network := range f.networks {
+		if opts.HostConfig != nil && opts.HostConfig.NetworkMode == network.Name {
+			network.Containers["container-"+opts.Name] = docker.Endpoint{}
+		}
+	}
+	if f.onCreate != nil {
+		f.onCreate(opts)
+	}
+	return &docker.Container{ID: "container-" + opts.Name}, nil
+}
+
+func (f *fakeDocker) CommitContainer(opts docker.CommitContainerOptions) (*docker.Image, error) {
+	f.committed = append(f.committed, opts)
+	return &docker.Image{ID: "sha256:" + opts.Container}, nil
+}
+
+func (f *fakeDocker) StartContainer(id string, hostConfig *docker.HostConfig) error {
+	return nil
+}
+
+func (f *fakeDocker) CreateExec(opts docker.CreateExecOptions) (*docker.Exec, error) {
+	f.execs = append(f.execs, opts.Cmd)
+	return &docker.Exec{ID: "exec"}, nil
+}
+
+func (f *fakeDocker) StartExec(id string, opts docker.StartExecOptions) error {
+	if f.execOutput != "" {
+		_, err := opts.OutputStream.Write([]byte(f.execOutput))
+		return err
+	}
+	return nil
+}
+
+func (f *fakeDocker) DownloadFromContainer(id string, opts docker.DownloadFromContainerOptions) error {
+	if f.missing[opts.Path] {
+		return &docker.Error{Status: http.StatusNotFound, Message: "Could not find the file " + opts.Path}
+	}
+	_, err := opts.OutputStream.Write(f.download)
+	return err
+}
+
+func (f *fakeDocker) InspectExec(id string) (*docker.ExecInspect, error) {
+	if f.execRunning > 0 {
+		f.execRunning--
+		return &docker.ExecInspect{ID: id, Running: true}, nil
+	}
+	return &docker.ExecInspect{ID: id, ExitCode: f.execExitCode}, nil
+}
+
+func (f *fakeDocker) ExportImage(opts docker.ExportImageOptions) error {
+	_, err := opts.OutputStream.Write([]byte("image " + opts.Name))
+	return err
+}
+
+func (f *fakeDocker) LoadImage(opts docker.LoadImageOptions) error {
+	f.loaded, f.loadErr = ioutil.ReadAll(opts.InputStream)
+	return f.loadErr
+}
+
+// the version of a fake daemon
+type fakeVersion docker.Env
+
+func (f fakeVersion) Version() (*docker.Env, error) {
+	env := docker.Env(f)
+	return &env, nil
+}
+
+func (f *fakeDocker) StopContainer(id string, timeout uint) error {
+	return nil
+}
+
+func (f *fakeDocker) RemoveContainer(opts docker.RemoveContainerOptions) error {
+	f.removed = append(f.removed, opts.ID)
+	return nil
+}
+
+func (f *fakeDocker) RemoveImageExtended(name string, opts docker.RemoveImageOptions) error {
+	if f.rmi == nil {
+		f.rmi = make(map[string]docker.RemoveImageOptions)
+	}
+	f.rmi[name] = opts
+	return f.rmiErr
+}
+
+func (f *fakeDocker) TagImage(name string, opts docker.TagImageOptions) error {
+	if f.tagged == nil {
+		f.tagged = make(map[string][]string)
+	}
+	f.tagged[name] = append(f.tagged[name], opts.Repo+":"+opts.Tag)
+	return nil
+}
+
+func (f *fakeDocker) PushImage(opts docker.PushImageOptions, auth docker.AuthConfiguration) error {
+	f.pushed = append(f.pushed, opts)
+	f.pushedAuth = append(f.pushedAuth, auth)
+	return nil
+}
+
+func (f *fakeDocker) CreateNetwork(opts docker.CreateNetworkOptions) (*docker.Network, error) {
+	if f.networks == nil {
+		f.networks = make(map[string]*docker.Network)
+	}
+	network := &docker.Network{ID: "network-" + opts.Name, Name: opts.Name, Labels: opts.Labels, Containers: map[string]docker.Endpoint{}}
+	f.networks[network.ID] = network
+	return network, nil
+}
+
+func (f *fakeDocker) NetworkInfo(id string) (*docker.Network, error) {
+	return f.networks[id], nil
+}
+
+func (f *fakeDocker) DisconnectNetwork(id string, opts docker.NetworkConnectionOptions) error {
+	f.disconnected = append(f.disconnected, opts.Container)
+	return nil
+}
+
+func (f *fakeDocker) RemoveNetwork(id string) error {
+	f.removedNetworks = append(f.removedNetworks, id)
+	return nil
+}
+
+func (f *fakeDocker) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	f.pulled = append(f.pulled, opts.Repository+":"+opts.Tag)
+	return f.pullErr
+}
+
+func (f *fakeDocker) Ping() error {
+	return f.pingErr
+}
+
+func (f *fakeDocker) InspectImage(name string) (*docker.Image, error) {
+	if image, ok := f.images[name]; ok {
+		return image, nil
+	}
+	return nil, docker.ErrNoSuchImage
+}
+
+var _ = Describe("Builder", func() {
+	Describe("build args in a diamond graph", func() {
+		var (
+			conf     *configuration.Config
+			manifest *Manifest
+		)
+
+		BeforeEach(func() {
+			var err error
+			conf = testConfig()
+			Expect(conf.BuildArgs.Set("VARIANT=global")).To(Succeed())
+			Expect(conf.BuildArgs.Set("GLOBAL=1")).To(Succeed())
+
+			manifest, err = loadManifest(conf, diamondManifest)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("orders the steps in levels", func() {
+			Expect(manifest.buildLevels).To(HaveLen(3))
+			Expect(manifest.buildLevels[0]).To(HaveLen(1))
+			Expect(manifest.buildLevels[1]).To(HaveLen(2))
+			Expect(manifest.buildLevels[2][0].Name).To(Equal("final"))
+		})
+
+		It("uses the global args for steps without edge args", func() {
+			b := &Builder{Conf: conf}
+			step, _ := manifest.FindStepByLabel("left")
+
+			Expect(b.buildArgs(step)).To(Equal([]docker.BuildArg{
+				{Name: "VARIANT", Value: "global"},
+				{Name: "GLOBAL", Value: "1"},
+			}))
+		})
+
+		It("applies edge args in depends_on order over the global args", func() {
+			b := &Builder{Conf: conf}
+			step, _ := manifest.FindStepByLabel("final")
+
+			Expect(b.buildArgs(step)).To(Equal([]docker.BuildArg{
+				{Name: "VARIANT", Value: "right"},
+				{Name: "GLOBAL", Value: "1"},
+				{Name: "LEFT_ONLY", Value: "1"},
+			}))
+		})
+
+		It("applies edge args keyed by the name of the dependency", func() {
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    base:
+      name: base-image
+      dockerfile: Dockerfile.base
+    app:
+      name: app
+      dockerfile: Dockerfile.app
+      depends_on:
+        - base-image
+      depends_on_args:
+        base-image:
+          VARIANT: base
+`)
+			Expect(err).NotTo(HaveOccurred())
+			b := &Builder{Conf: conf}
+			step, _ := manifest.FindStepByLabel("app")
+
+			Expect(step.EdgeArgs).To(Equal([]EdgeArgs{{Dependency: "base-image", Args: map[string]string{"VARIANT": "base"}}}))
+			Expect(b.buildArgs(step)).To(Equal([]docker.BuildArg{
+				{Name: "VARIANT", Value: "base"},
+				{Name: "GLOBAL", Value: "1"},
+			}))
+		})
+
+		It("removes the images of the steps other steps depend on only", func() {
+			b := &Builder{Conf: conf, Build: manifest}
+
+			var removed []string
+			for _, s := range b.removableSteps() {
+				removed = append(removed, s.Label)
+			}
+			Expect(removed).To(ConsistOf("base", "left", "right"))
+		})
+
+		It("keeps the parents of the final images", func() {
+			b := &Builder{Conf: conf, Build: manifest}
+			final, _ := manifest.FindStepByLabel("final")
+			b.docker = &fakeDocker{history: map[string][]docker.ImageHistory{
+				b.uniqueStepName(final): {{ID: "sha256:final"}, {ID: "sha256:left"}, {ID: "sha256:base"}},
+			}}
+			parents, err := b.keptImageParents()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parents).To(Equal(map[string]bool{"sha256:left": true, "sha256:base": true}))
+
+			b.docker = &fakeDocker{history: map[string][]docker.ImageHistory{b.uniqueStepName(final): {}}}
+			parents, err = b.keptImageParents()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parents).To(BeEmpty())
+		})
+
+		It("rejects edge args for a step which is not a dependency", func() {
+			_, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    base:
+      name: base
+      dockerfile: Dockerfile
+    other:
+      name: other
+      dockerfile: Dockerfile
+      depends_on_args:
+        base:
+          VARIANT: base
+`)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("step image removal", func() {
+		It("uses the removal options of the step over the global flags", func() {
+			conf := testConfig()
+			conf.FroceRmImages = true
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    base:
+      name: base
+      dockerfile: Dockerfile
+      force_rmi: false
+      noprune_rmi: true
+    middle:
+      name: middle
+      dockerfile: Dockerfile
+      depends_on:
+        - base
+    final:
+      name: final
+      dockerfile: Dockerfile
+      depends_on:
+        - middle
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			b := &Builder{Conf: conf, Build: manifest}
+			base, _ := manifest.FindStepByLabel("base")
+			middle, _ := manifest.FindStepByLabel("middle")
+			fake := &fakeDocker{images: map[string]*docker.Image{
+				b.uniqueStepName(base):   {ID: "sha256:base"},
+				b.uniqueStepName(middle): {ID: "sha256:middle"},
+			}}
+			b.docker = fake
+
+			Expect(b.removeStepImages()).To(BeEmpty())
+			Expect(fake.rmi).To(Equal(map[string]docker.RemoveImageOptions{
+				b.uniqueStepName(base):   {Force: false, NoPrune: true},
+				b.uniqueStepName(middle): {Force: true, NoPrune: false},
+			}))
+		})
+	})
+
+	Describe("step image tags", func() {
+		It("tags the step image with its tags without the unique ID", func() {
+			manifest, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app:build
+      dockerfile: Dockerfile
+      tags:
+        - example/app
+        - registry.example.com:5000/app:1.2
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			fake := &fakeDocker{}
+			b := &Builder{Conf: testConfig(), Build: manifest, UniqueID: "ci", docker: fake, gitSHA: "abc1234"}
+			step, _ := manifest.FindStepByLabel("app")
+
+			Expect(b.tagImage(step)).To(Succeed())
+			Expect(fake.tagged).To(Equal(map[string][]string{
+				"app-ci:build": {"example/app:latest", "registry.example.com:5000/app:1.2", "app:abc1234"},
+			}))
+		})
+	})
+
+	Describe("image pushes", func() {
+		It("tags the image for the push registry and pushes it with its credentials", func() {
+			manifest, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile: Dockerfile
+      push: true
+      push_registry: registry.example.com:5000
+      push_tag: v1
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			fake := &fakeDocker{}
+			auth := docker.AuthConfiguration{Username: "builder", Password: "s3cret", ServerAddress: "registry.example.com:5000"}
+			b := &Builder{Conf: testConfig(), Build: manifest, docker: fake, OutputStream: ioutil.Discard,
+				auth: &docker.AuthConfigurations{Configs: map[string]docker.AuthConfiguration{"registry.example.com:5000": auth}}}
+			step, _ := manifest.FindStepByLabel("app")
+
+			Expect(b.pushImage(step)).To(Succeed())
+			Expect(fake.tagged).To(Equal(map[string][]string{"app": {"registry.example.com:5000/app:v1"}}))
+			Expect(fake.pushed).To(HaveLen(1))
+			Expect(fake.pushed[0].Name).To(Equal("registry.example.com:5000/app"))
+			Expect(fake.pushed[0].Tag).To(Equal("v1"))
+			Expect(fake.pushed[0].Registry).To(Equal("registry.example.com:5000"))
+			Expect(fake.pushedAuth).To(Equal([]docker.AuthConfiguration{auth}))
+		})
+
+		It("pushes the step image as it is without a registry or tag", func() {
+			manifest, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: example/app:1.2
+      dockerfile: Dockerfile
+      push: true
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			fake := &fakeDocker{}
+			b := &Builder{Conf: testConfig(), Build: manifest, docker: fake, OutputStream: ioutil.Discard}
+			step, _ := manifest.FindStepByLabel("app")
+
+			Expect(b.pushImage(step)).To(Succeed())
+			Expect(fake.tagged).To(BeEmpty())
+			Expect(fake.pushed).To(HaveLen(1))
+			Expect(fake.pushed[0].Name).To(Equal("example/app"))
+			Expect(fake.pushed[0].Tag).To(Equal("1.2"))
+		})
+	})
+
+	Describe("image removal failures", func() {
+		var (
+			workdir string
+			conf    *configuration.Config
+			fake    *fakeDocker
+			b       *Builder
+		)
+
+		BeforeEach(func() {
+			var err error
+			workdir, err = ioutil.TempDir("", "habitus-rmi")
+			Expect(err).NotTo(HaveOccurred())
+
+			conf = testConfig()
+			conf.Workdir = workdir
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    base:
+      name: base
+      dockerfile_inline: FROM scratch
+    middle:
+      name: middle
+      dockerfile_inline: FROM base
+      depends_on:
+        - base
+    final:
+      name: final
+      dockerfile_inline: FROM middle
+      depends_on:
+        - middle
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			fake = &fakeDocker{rmiErr: errors.New("image is busy"), images: map[string]*docker.Image{
+				"base":   {ID: "sha256:base"},
+				"middle": {ID: "sha256:middle"},
+			}}
+			b = &Builder{Conf: conf, Build: manifest, docker: fake, Events: noopEventSink{}, OutputStream: ioutil.Discard, ErrorStream: ioutil.Discard}
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(workdir)
+		})
+
+		It("removes the other images after a failure", func() {
+			Expect(b.removeStepImages()).To(ConsistOf(
+				MatchError("failed to remove image base: image is busy"),
+				MatchError("failed to remove image middle: image is busy"),
+			))
+			Expect(fake.rmi).To(HaveKey("base"))
+			Expect(fake.rmi).To(HaveKey("middle"))
+		})
+
+		It("only fails the build on removal failures in strict cleanup mode", func() {
+			_, err := b.StartBuild(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+
+			conf.StrictCleanup = true
+			_, err = b.StartBuild(context.Background())
+			Expect(err).To(MatchError(HavePrefix("failed to remove 2 unwanted images: ")))
+		})
+	})
+
+	Describe("build summary", func() {
+		It("reports the built, failed and skipped steps", func() {
+			workdir, err := ioutil.TempDir("", "habitus-summary")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(workdir)
+
+			conf := testConfig()
+			conf.Workdir = workdir
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    base:
+      name: base
+      dockerfile_inline: FROM scratch
+    app:
+      name: app
+      dockerfile_inline: FROM base
+      depends_on:
+        - base
+      command: "false"
+    final:
+      name: final
+      dockerfile_inline: FROM app
+      depends_on:
+        - app
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			fake := &fakeDocker{execExitCode: 1, images: map[string]*docker.Image{
+				"base": {ID: "sha256:0123456789abcdef0123", Size: 2048},
+			}}
+			var out bytes.Buffer
+			b := &Builder{Conf: conf, Build: manifest, docker: fake, Events: noopEventSink{}, OutputStream: &out, ErrorStream: ioutil.Discard}
+			result, err := b.StartBuild(context.Background())
+			Expect(err).To(HaveOccurred())
+
+			Expect(result.Status).To(Equal(BuildFailed))
+			var statuses []string
+			for _, step := range result.Steps {
+				statuses = append(statuses, step.Step+" "+step.Status)
+			}
+			Expect(statuses).To(Equal([]string{"base built", "app failed", "final skipped"}))
+			Expect(result.Steps[0].ImageID).To(Equal("sha256:0123456789abcdef0123"))
+			Expect(result.Steps[0].Tags).To(Equal([]string{"base"}))
+			Expect(result.Steps[1].ImageID).To(BeEmpty())
+			Expect(result.Steps[2].Duration).To(BeZero())
+
+			table := out.String()[strings.Index(out.String(), "STEP "):]
+			lines := strings.Split(strings.TrimSpace(table), "\n")
+			Expect(lines).To(HaveLen(4))
+			Expect(strings.Fields(lines[0])).To(Equal([]string{"STEP", "STATUS", "DURATION", "ARTIFACTS", "IMAGE", "SIZE"}))
+			Expect(strings.Fields(lines[1])).To(ConsistOf("base", "built", HaveSuffix("s"), "0", "0123456789ab", "2.048", "kB"))
+			Expect(strings.Fields(lines[2])).To(ConsistOf("app", "failed", HaveSuffix("s"), "0", "-", "-"))
+			Expect(strings.Fields(lines[3])).To(Equal([]string{"final", "skipped", "0s", "0", "-", "-"}))
+		})
+	})
+
+	Describe("streamed squashes", func() {
+		It("stops the load and keeps no files when the export can't be squashed", func() {
+			tmp, err := ioutil.TempDir("", "habitus-squash")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(tmp)
+
+			conf := testConfig()
+			conf.TempDir = tmp
+			fake := &fakeDocker{}
+			b := &Builder{Conf: conf, docker: fake}
+
+			err = b.squashImage(&Step{Name: "app"}, "sha256:app")
+			Expect(err).To(HaveOccurred())
+			// the load fails with the squash error instead of loading a partial image
+			Expect(fake.loadErr).To(Equal(err))
+			Expect(fake.loaded).To(BeEmpty())
+
+			files, err := ioutil.ReadDir(tmp)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(BeEmpty())
+		})
+	})
+
+	Describe("squash boundaries", func() {
+		It("starts the squash from the root, a layer or above the layers of a step", func() {
+			manifest, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    base:
+      name: example/base
+      dockerfile: Dockerfile
+    root:
+      name: root
+      dockerfile: Dockerfile
+      squash: true
+      squash_from: root
+    layer:
+      name: layer
+      dockerfile: Dockerfile
+      squash: true
+      squash_from: 0123abcd
+    label:
+      name: label
+      dockerfile: Dockerfile
+      squash: true
+      squash_from: base
+    name:
+      name: name
+      dockerfile: Dockerfile
+      squash: true
+      squash_from: example/base
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			b := &Builder{Conf: testConfig(), Build: manifest, docker: &fakeDocker{history: map[string][]docker.ImageHistory{
+				"example/base": {{ID: "sha256:3"}, {ID: "sha256:2"}, {ID: "sha256:1"}},
+			}}}
+			for label, boundary := range map[string]squash.Squasher{
+				"root":  {From: "root"},
+				"layer": {From: "0123abcd"},
+				"label": {KeepLayers: 3},
+				"name":  {KeepLayers: 3},
+			} {
+				step, _ := manifest.FindStepByLabel(label)
+				var squasher squash.Squasher
+				Expect(b.setSquashBoundary(step, &squasher)).To(Succeed())
+				Expect(squasher.From).To(Equal(boundary.From), label)
+				Expect(squasher.KeepLayers).To(Equal(boundary.KeepLayers), label)
+			}
+		})
+	})
+
+	Describe("dry runs", func() {
+		var workdir string
+
+		BeforeEach(func() {
+			var err error
+			workdir, err = ioutil.TempDir("", "habitus-dry-run")
+			Expect(err).NotTo(HaveOccurred())
+			for name, content := range map[string]string{
+				"Dockerfile.base":  "FROM ubuntu\n",
+				"Dockerfile.left":  "FROM base\n",
+				"Dockerfile.right": "FROM base\n",
+				"Dockerfile.final": "FROM left\n",
+			} {
+				Expect(ioutil.WriteFile(filepath.Join(workdir, name), []byte(content), 0644)).To(Succeed())
+			}
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(workdir)
+		})
+
+		It("prints the levels in order without calling docker", func() {
+			conf := testConfig()
+			conf.DryRun = true
+			conf.Workdir = workdir
+			manifest, err := loadManifest(conf, diamondManifest)
+			Expect(err).NotTo(HaveOccurred())
+
+			// a build reaching the daemon fails on the ping
+			fake := &fakeDocker{pingErr: errors.New("dry runs don't ping")}
+			var out bytes.Buffer
+			b := &Builder{Conf: conf, Build: manifest, docker: fake, Events: noopEventSink{}, OutputStream: &out, ErrorStream: ioutil.Discard}
+
+			_, err = b.StartBuild(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fake.built).To(BeEmpty())
+			Expect(fake.created).To(BeEmpty())
+
+			plan := out.String()
+			base := strings.Index(plan, "Level 0\n  "+b.uniqueStepName(&manifest.buildLevels[0][0])+" (base)")
+			middle := strings.Index(plan, "Level 1\n")
+			final := strings.Index(plan, "Level 2\n  "+b.uniqueStepName(&manifest.buildLevels[2][0])+" (final)")
+			Expect(base).To(BeNumerically(">=", 0))
+			Expect(middle).To(BeNumerically(">", base))
+			Expect(final).To(BeNumerically(">", middle))
+			Expect(plan[middle:final]).To(ContainSubstring("(left)"))
+			Expect(plan[middle:final]).To(ContainSubstring("(right)"))
+		})
+	})
+
+	Describe("step build args", func() {
+		It("gives each step its own args over the global ones", func() {
+			conf := testConfig()
+			Expect(conf.BuildArgs.Set("VERSION=1")).To(Succeed())
+			Expect(conf.BuildArgs.Set("GLOBAL=1")).To(Succeed())
+
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    old:
+      name: old
+      dockerfile: Dockerfile
+    new:
+      name: new
+      dockerfile: Dockerfile
+      args:
+        VERSION: "2"
+        FLAGS: -fast
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			b := &Builder{Conf: conf}
+			oldStep, _ := manifest.FindStepByLabel("old")
+			newStep, _ := manifest.FindStepByLabel("new")
+
+			Expect(b.buildArgs(oldStep)).To(Equal([]docker.BuildArg{
+				{Name: "VERSION", Value: "1"},
+				{Name: "GLOBAL", Value: "1"},
+			}))
+			Expect(b.buildArgs(newStep)).To(Equal([]docker.BuildArg{
+				{Name: "VERSION", Value: "2"},
+				{Name: "GLOBAL", Value: "1"},
+				{Name: "FLAGS", Value: "-fast"},
+			}))
+		})
+	})
+
+	Describe("artifact volumes", func() {
+		const volumesManifest = `
+build:
+  version: 2016-03-14
+  steps:
+    builder:
+      name: builder
+      dockerfile: Dockerfile
+      artifacts:
+        - source: /app/bin/server
+          dest: bin
+          volume: binaries
+        - /app/README.md
+    packager:
+      name: packager
+      dockerfile: Dockerfile
+      depends_on:
+        - builder
+`
+
+		It("mounts the volumes in the producing and the depending steps", func() {
+			manifest, err := loadManifest(testConfig(), volumesManifest)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(manifest.Validate()).To(Succeed())
+
+			b := &Builder{Conf: testConfig(), Build: manifest, builderId: "abc"}
+			builder, _ := manifest.FindStepByLabel("builder")
+			packager, _ := manifest.FindStepByLabel("packager")
+
+			Expect(b.volumeBinds(builder)).To(Equal([]string{"habitus-binaries-abc:/habitus/volumes/binaries"}))
+			Expect(b.volumeBinds(packager)).To(Equal([]string{"habitus-binaries-abc:/habitus/volumes/binaries"}))
+			Expect(volumeArtifactPath(&builder.Artifacts[0])).To(Equal("/habitus/volumes/binaries/bin/server"))
+		})
+
+		It("quotes the paths of the copy to the volume", func() {
+			fake := &fakeDocker{}
+			b := &Builder{Conf: testConfig(), docker: fake, builderId: "abc"}
+			step := &Step{Name: "builder", Shell: "/bin/sh"}
+			art := &Artifact{Source: "/app/it's; here", Dest: "bin", Volume: "binaries", Step: *step}
+
+			Expect(b.copyToVolume(step, "container-1", art)).To(Succeed())
+			Expect(fake.execs).To(Equal([][]string{{"/bin/sh", "-c",
+				`mkdir -p '/habitus/volumes/binaries/bin' && cp -a '/app/it'\''s; here' '/habitus/volumes/binaries/bin/it'\''s; here'`}}))
+
+			out, err := exec.Command("sh", "-c", "printf '%s\\n' "+shellQuote(art.Source)).Output()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(out)).To(Equal(art.Source + "\n"))
+		})
+
+		It("doesn't remove anything on the host for volume artifacts", func() {
+			conf := testConfig()
+			conf.Workdir = "/nonexistent-workdir"
+			manifest, err := loadManifest(conf, volumesManifest)
+			Expect(err).NotTo(HaveOccurred())
+
+			b := &Builder{Conf: conf, Build: manifest}
+			Expect(b.collectHostArtifactRoots()).To(Equal([]string{"/nonexistent-workdir/README.md"}))
+		})
+
+		It("rejects invalid volume artifacts", func() {
+			manifest, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    builder:
+      name: builder
+      dockerfile: Dockerfile
+      artifacts:
+        - source: /app/bin/server
+          dest: ../bin
+          volume: "bad name"
+          post_copy: ls
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = manifest.Validate()
+			Expect(err).To(MatchError(ContainSubstring("volume 'bad name' is not a valid volume name")))
+			Expect(err).To(MatchError(ContainSubstring("destination ../bin is outside its volume")))
+			Expect(err).To(MatchError(ContainSubstring("can't have a post copy command")))
+		})
+	})
+
+	Describe("archived artifacts", func() {
+		It("writes the container tar stream as a tar.gz keeping the permissions", func() {
+			workdir, err := ioutil.TempDir("", "habitus-archive")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(workdir)
+
+			var stream bytes.Buffer
+			tw := tar.NewWriter(&stream)
+			Expect(tw.WriteHeader(&tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755})).To(Succeed())
+			Expect(tw.WriteHeader(&tar.Header{Name: "bin/server", Typeflag: tar.TypeReg, Mode: 0750, Size: 2})).To(Succeed())
+			_, err = tw.Write([]byte("hi"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tw.Close()).To(Succeed())
+
+			conf := testConfig()
+			conf.Workdir = workdir
+			b := &Builder{Conf: conf, docker: &fakeDocker{download: stream.Bytes()}}
+			art := &Artifact{Source: "/app/bin", Dest: ".", Archive: archiveTarGz}
+			Expect(b.copyToHost(art, "container")).To(Succeed())
+			Expect(b.artifactHostPath(art)).To(Equal(filepath.Join(workdir, "bin.tar.gz")))
+
+			f, err := os.Open(b.artifactHostPath(art))
+			Expect(err).NotTo(HaveOccurred())
+			defer f.Close()
+			gz, err := gzip.NewReader(f)
+			Expect(err).NotTo(HaveOccurred())
+			tr := tar.NewReader(gz)
+			_, err = tr.Next()
+			Expect(err).NotTo(HaveOccurred())
+			hdr, err := tr.Next()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(hdr.Name).To(Equal("bin/server"))
+			Expect(hdr.Mode).To(Equal(int64(0750)))
+		})
+	})
+
+	Describe("artifact globs", func() {
+		It("quotes the patterns so paths can have spaces", func() {
+			Expect(shellGlob("/app/bin/*.so")).To(Equal("'/app/bin/'*'.so'"))
+			Expect(shellGlob("/app/my dir/lib[0-9]?.a")).To(Equal("'/app/my dir/lib'[0-9]?'.a'"))
+			Expect(shellGlob("/app/it's/*")).To(Equal(`'/app/it'\''s/'*`))
+
+			dir, err := ioutil.TempDir("", "habitus-glob")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+			for _, name := range []string{"my app.bin", "my tool.bin", "other"} {
+				Expect(ioutil.WriteFile(filepath.Join(dir, name), nil, 0644)).To(Succeed())
+			}
+
+			out, err := exec.Command("sh", "-c", "ls -1d -- "+shellGlob(dir+"/my *.bin")).Output()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(out)).To(Equal(filepath.Join(dir, "my app.bin") + "\n" + filepath.Join(dir, "my tool.bin") + "\n"))
+		})
+	})
+
+	Describe("artifact permissions", func() {
+		It("uses the mode in the container archive", func() {
+			workdir, err := ioutil.TempDir("", "habitus-perms")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(workdir)
+
+			var stream bytes.Buffer
+			tw := tar.NewWriter(&stream)
+			Expect(tw.WriteHeader(&tar.Header{Name: "server", Typeflag: tar.TypeReg, Mode: 0751, Size: 2})).To(Succeed())
+			_, err = tw.Write([]byte("hi"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tw.Close()).To(Succeed())
+
+			conf := testConfig()
+			conf.Workdir = workdir
+			b := &Builder{Conf: conf, docker: &fakeDocker{download: stream.Bytes()}}
+			Expect(b.copyToHost(&Artifact{Source: "/app/server", Dest: "."}, "container")).To(Succeed())
+
+			info, err := os.Stat(filepath.Join(workdir, "server"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0751)))
+		})
+
+		It("uses the mapped owner in the container archive when running as root", func() {
+			if os.Geteuid() != 0 {
+				Skip("only root can change the owner of the artifacts")
+			}
+			workdir, err := ioutil.TempDir("", "habitus-owner")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(workdir)
+
+			var stream bytes.Buffer
+			tw := tar.NewWriter(&stream)
+			Expect(tw.WriteHeader(&tar.Header{Name: "server", Typeflag: tar.TypeReg, Mode: 0755, Uid: 33, Gid: 1000, Size: 2})).To(Succeed())
+			_, err = tw.Write([]byte("hi"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tw.Close()).To(Succeed())
+
+			owner := func(name string) (uint32, uint32) {
+				info, err := os.Stat(filepath.Join(workdir, name))
+				Expect(err).NotTo(HaveOccurred())
+				stat := info.Sys().(*syscall.Stat_t)
+				return stat.Uid, stat.Gid
+			}
+
+			conf := testConfig()
+			conf.Workdir = workdir
+			ranges, err := parseIDMap("1000:2000:10")
+			Expect(err).NotTo(HaveOccurred())
+			b := &Builder{Conf: conf, docker: &fakeDocker{download: stream.Bytes()}, idMap: ranges}
+			Expect(b.copyToHost(&Artifact{Source: "/app/server", Dest: "."}, "container")).To(Succeed())
+			uid, gid := owner("server")
+			Expect(uid).To(Equal(uint32(33)))
+			Expect(gid).To(Equal(uint32(2000)))
+
+			Expect(os.Remove(filepath.Join(workdir, "server"))).To(Succeed())
+			Expect(b.copyToHost(&Artifact{Step: Step{IgnoreOwnership: true}, Source: "/app/server", Dest: "."}, "container")).To(Succeed())
+			uid, gid = owner("server")
+			Expect(uid).To(Equal(uint32(0)))
+			Expect(gid).To(Equal(uint32(os.Getegid())))
+		})
+	})
+
+	Describe("artifact post copy commands", func() {
+		var (
+			workdir string
+			b       *Builder
+			out     bytes.Buffer
+		)
+
+		BeforeEach(func() {
+			var err error
+			workdir, err = ioutil.TempDir("", "habitus-post-copy")
+			Expect(err).NotTo(HaveOccurred())
+
+			var stream bytes.Buffer
+			tw := tar.NewWriter(&stream)
+			Expect(tw.WriteHeader(&tar.Header{Name: "server", Typeflag: tar.TypeReg, Mode: 0755, Size: 2})).To(Succeed())
+			_, err = tw.Write([]byte("hi"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tw.Close()).To(Succeed())
+
+			out.Reset()
+			conf := testConfig()
+			conf.Workdir = workdir
+			b = &Builder{Conf: conf, docker: &fakeDocker{download: stream.Bytes()}, OutputStream: &out, ErrorStream: ioutil.Discard}
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(workdir)
+		})
+
+		It("runs the command on the host with the artifact dest and the step", func() {
+			art := &Artifact{Step: Step{Name: "app"}, Source: "/app/server", Dest: ".", PostCopy: "cat {{.Path}} && echo ' {{.Step}}' && pwd"}
+			Expect(b.copyToHost(art, "container")).To(Succeed())
+
+			Expect(out.String()).To(Equal("hi app\n" + workdir + "\n"))
+		})
+
+		It("fails the copy when the command fails", func() {
+			art := &Artifact{Step: Step{Name: "app"}, Source: "/app/server", Dest: ".", PostCopy: "test ! -f {{.Path}}"}
+			err := b.copyToHost(art, "container")
+			Expect(err).To(MatchError(HavePrefix("post copy command 'test ! -f " + filepath.Join(workdir, "server") + "' for /app/server failed")))
+		})
+	})
+
+	Describe("artifact checksums", func() {
+		var workdir string
+		var stream bytes.Buffer
+
+		BeforeEach(func() {
+			var err error
+			workdir, err = ioutil.TempDir("", "habitus-checksum")
+			Expect(err).NotTo(HaveOccurred())
+
+			stream.Reset()
+			tw := tar.NewWriter(&stream)
+			Expect(tw.WriteHeader(&tar.Header{Name: "server", Typeflag: tar.TypeReg, Mode: 0755, Size: 2})).To(Succeed())
+			_, err = tw.Write([]byte("hi"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tw.Close()).To(Succeed())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(workdir)
+		})
+
+		// sha256 of "hi"
+		const sum = "8f434346648f6b96df89dda901c5176b10a6d83961dd3c1ac88b59b2dc327aa4"
+
+		It("verifies the artifact and writes a checksum file", func() {
+			conf := testConfig()
+			conf.Workdir = workdir
+			conf.ArtifactChecksums = true
+			b := &Builder{Conf: conf, docker: &fakeDocker{download: stream.Bytes()}}
+			art := &Artifact{Source: "/app/server", Dest: ".", SHA256: sum}
+			Expect(b.copyToHost(art, "container")).To(Succeed())
+
+			content, err := ioutil.ReadFile(filepath.Join(workdir, "server.sha256"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal(sum + "  server\n"))
+		})
+
+		It("renames the artifact with as", func() {
+			conf := testConfig()
+			conf.Workdir = workdir
+			conf.ArtifactChecksums = true
+			b := &Builder{Conf: conf, docker: &fakeDocker{download: stream.Bytes()}}
+			art := &Artifact{Source: "/app/server-linux-amd64", Dest: "bin", As: "server"}
+			Expect(b.copyToHost(art, "container")).To(Succeed())
+
+			content, err := ioutil.ReadFile(filepath.Join(workdir, "bin", "server"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("hi"))
+			content, err = ioutil.ReadFile(filepath.Join(workdir, "bin", "server.sha256"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal(sum + "  server\n"))
+		})
+
+		It("fails on missing artifacts unless they are optional", func() {
+			manifest, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile_inline: FROM scratch
+      artifacts:
+        - /app/server
+        - source: /app/docs
+          optional: true
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			fake := &fakeDocker{missing: map[string]bool{"/app/docs": true}}
+			b := &Builder{Conf: testConfig(), Build: manifest, docker: fake}
+			step, _ := manifest.FindStepByLabel("app")
+			found, err := b.checkArtifactSources(step, "container", step.Artifacts)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found).To(HaveLen(1))
+			Expect(found[0].Source).To(Equal("/app/server"))
+
+			fake.missing["/app/server"] = true
+			_, err = b.checkArtifactSources(step, "container", step.Artifacts)
+			Expect(err).To(MatchError("artifact /app/server of step app is not in the image"))
+		})
+
+		It("fails when the artifact doesn't match", func() {
+			conf := testConfig()
+			conf.Workdir = workdir
+			b := &Builder{Conf: conf, docker: &fakeDocker{download: stream.Bytes()}}
+			art := &Artifact{Source: "/app/server", Dest: ".", SHA256: strings.Repeat("0", 64), Step: Step{Name: "app"}}
+			err := b.copyToHost(art, "container")
+			Expect(err).To(MatchError("artifact /app/server of step app has sha256 " + sum + " instead of " + strings.Repeat("0", 64)))
+			Expect(filepath.Join(workdir, "server.sha256")).NotTo(BeAnExistingFile())
+		})
+	})
+
+	Describe("cleanup commands", func() {
+		It("runs the commands in separate execs or in a single shell", func() {
+			manifest, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    separate:
+      name: separate
+      dockerfile: Dockerfile
+      cleanup:
+        commands:
+          - cd /app
+          - rm -rf tmp
+    single:
+      name: single
+      dockerfile: Dockerfile
+      cleanup:
+        single_shell: true
+        commands:
+          - cd /app
+          - rm -rf tmp
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			separate, _ := manifest.FindStepByLabel("separate")
+			single, _ := manifest.FindStepByLabel("single")
+			Expect(cleanupCommands(separate)).To(Equal([]string{"cd /app", "rm -rf tmp"}))
+			Expect(cleanupCommands(single)).To(Equal([]string{"cd /app && rm -rf tmp"}))
+		})
+
+		It("fails the step when a cleanup command fails", func() {
+			workdir, err := ioutil.TempDir("", "habitus-cleanup")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(workdir)
+
+			conf := testConfig()
+			conf.Workdir = workdir
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile_inline: FROM scratch
+      cleanup:
+        commands:
+          - rm /app/secret.key
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			fake := &fakeDocker{execExitCode: 1}
+			b := &Builder{Conf: conf, Build: manifest, docker: fake, Events: noopEventSink{}, OutputStream: ioutil.Discard, ErrorStream: ioutil.Discard}
+			step, _ := manifest.FindStepByLabel("app")
+			Expect(b.BuildStep(step)).To(Equal(&CommandError{Command: "rm /app/secret.key", ExitCode: 1}))
+			Expect(fake.execs).To(HaveLen(1))
+		})
+	})
+
+	Describe("step shells", func() {
+		It("runs the container and its commands with the step shell", func() {
+			workdir, err := ioutil.TempDir("", "habitus-shell")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(workdir)
+
+			conf := testConfig()
+			conf.Workdir = workdir
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    alpine:
+      name: alpine
+      dockerfile_inline: FROM alpine
+      shell: /bin/sh
+      squash: false
+      cleanup:
+        commands:
+          - rm -rf /tmp/cache
+    default:
+      name: default
+      dockerfile_inline: FROM ubuntu
+      squash: false
+      cleanup:
+        commands:
+          - rm -rf /tmp/cache
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			for label, shell := range map[string]string{"alpine": "/bin/sh", "default": "/bin/bash"} {
+				var containerCmd []string
+				fake := &fakeDocker{onCreate: func(opts docker.CreateContainerOptions) {
+					containerCmd = opts.Config.Cmd
+				}}
+				b := &Builder{Conf: conf, Build: manifest, docker: fake, Events: noopEventSink{}, OutputStream: ioutil.Discard, ErrorStream: ioutil.Discard}
+				step, _ := manifest.FindStepByLabel(label)
+
+				Expect(b.BuildStep(step)).To(Succeed())
+				Expect(containerCmd).To(Equal([]string{shell}))
+				Expect(fake.execs).To(Equal([][]string{{shell, "-c", "rm -rf /tmp/cache"}}))
+			}
+		})
+	})
+
+	Describe("isolated networks", func() {
+		It("runs the step container in its own network and removes it after the step", func() {
+			workdir, err := ioutil.TempDir("", "habitus-networks")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(workdir)
+
+			conf := testConfig()
+			conf.Workdir = workdir
+			conf.IsolateNetworks = true
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile_inline: FROM scratch
+      command: "false"
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			var networkMode string
+			fake := &fakeDocker{execExitCode: 1, onCreate: func(opts docker.CreateContainerOptions) {
+				networkMode = opts.HostConfig.NetworkMode
+			}}
+			b := &Builder{Conf: conf, Build: manifest, docker: fake, builderId: "0123456789abcdef", Events: noopEventSink{}, OutputStream: ioutil.Discard, ErrorStream: ioutil.Discard}
+
+			app, _ := manifest.FindStepByLabel("app")
+			Expect(b.BuildStep(app)).NotTo(Succeed())
+			Expect(networkMode).To(Equal("habitus-01234567-app"))
+			network := fake.networks["network-habitus-01234567-app"]
+			Expect(network.Labels).To(Equal(map[string]string{"habitus.builder": "0123456789abcdef"}))
+			// containers still attached are disconnected before the network is removed
+			Expect(fake.disconnected).To(Equal([]string{"container-" + fake.created[0]}))
+			Expect(fake.removedNetworks).To(Equal([]string{network.ID}))
+		})
+	})
+
+	Describe("step secrets", func() {
+		It("mounts env secrets into the step container only", func() {
+			workdir, err := ioutil.TempDir("", "habitus-secrets")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(workdir)
+			os.Setenv("HABITUS_TEST_TOKEN", "t0ken-value")
+			defer os.Unsetenv("HABITUS_TEST_TOKEN")
+
+			memory := logging.NewMemoryBackend(100)
+			conf := testConfig()
+			conf.Workdir = workdir
+			conf.SecretProviders = "file,env"
+			conf.Logger = *logging.MustGetLogger("habitus-step-secrets-test")
+			conf.Logger.SetBackend(logging.AddModuleLevel(memory))
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile_inline: FROM scratch
+      secrets:
+        token:
+          type: env
+          value: HABITUS_TEST_TOKEN
+      squash: false
+      cleanup:
+        commands:
+          - rm -rf /tmp/cache
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			var mounted string
+			fake := &fakeDocker{onCreate: func(opts docker.CreateContainerOptions) {
+				for _, bind := range opts.HostConfig.Binds {
+					parts := strings.Split(bind, ":")
+					if parts[1] == secretsMountPath {
+						Expect(parts[2]).To(Equal("ro"))
+						content, err := ioutil.ReadFile(filepath.Join(parts[0], "token"))
+						Expect(err).NotTo(HaveOccurred())
+						mounted = string(content)
+					}
+				}
+				Expect(opts.Config.Env).NotTo(ContainElement(ContainSubstring("t0ken-value")))
+			}}
+			b, err := NewBuilderWithClient(manifest, conf, fake)
+			Expect(err).NotTo(HaveOccurred())
+			b.OutputStream = ioutil.Discard
+			b.ErrorStream = ioutil.Discard
+
+			step, _ := manifest.FindStepByLabel("app")
+			Expect(b.BuildStep(step)).To(Succeed())
+			Expect(mounted).To(Equal("t0ken-value"))
+
+			// the commit has no config of its own, so the secret can't be in the image env
+			Expect(fake.committed).To(HaveLen(1))
+			Expect(fake.committed[0].Run).To(BeNil())
+
+			b.Conf.Logger.Infof("token is %s", mounted)
+			var logged []string
+			for node := memory.Head(); node != nil; node = node.Next() {
+				logged = append(logged, node.Record.Message())
+			}
+			Expect(logged).To(ContainElement("token is ****"))
+			Expect(logged).NotTo(ContainElement(ContainSubstring("t0ken-value")))
+		})
+	})
+
+	Describe("step environment", func() {
+		It("runs commands through env with the interpolated step env", func() {
+			conf := testConfig()
+			Expect(conf.EnvVars.Set("FLAGS=-race")).To(Succeed())
+
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile: Dockerfile
+      command: make test
+      env:
+        GOFLAGS: ${FLAGS}
+        CGO_ENABLED: "0"
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			b := &Builder{Conf: conf}
+			step, _ := manifest.FindStepByLabel("app")
+
+			Expect(b.withStepEnv(step, []string{"make", "test"})).To(Equal([]string{
+				"env", "CGO_ENABLED=0", "GOFLAGS=-race", "make", "test",
+			}))
+		})
+	})
+
+	Describe("artifact roots", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "habitus-test-")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.MkdirAll(filepath.Join(dir, "work", "existing"), 0755)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		rootsFor := func(artifacts ...Artifact) []string {
+			conf := testConfig()
+			conf.Workdir = filepath.Join(dir, "work")
+			step := Step{Name: "app", Artifacts: artifacts}
+			b := &Builder{Conf: conf, Build: &Manifest{Steps: []Step{step}}}
+
+			return b.collectHostArtifactRoots()
+		}
+
+		It("removes the first missing folder of relative destinations", func() {
+			Expect(rootsFor(
+				Artifact{Source: "/app/bin", Dest: "existing/out/bin"},
+				Artifact{Source: "/app/lib", Dest: "existing/../lib"},
+				Artifact{Source: "/app/README", Dest: "."},
+			)).To(Equal([]string{
+				filepath.Join(dir, "work", "existing", "out"),
+				filepath.Join(dir, "work", "lib"),
+				filepath.Join(dir, "work", "README"),
+			}))
+		})
+
+		It("never removes anything outside the workdir", func() {
+			Expect(rootsFor(
+				Artifact{Source: "/app/foo", Dest: "../../foo"},
+				Artifact{Source: "/app/bar", Dest: "existing/../../bar"},
+				Artifact{Source: "/app/*.so", Dest: ".."},
+			)).To(BeEmpty())
+		})
+
+		It("removes only the missing part of absolute destinations", func() {
+			Expect(rootsFor(
+				Artifact{Source: "/app/bin", Dest: filepath.Join(dir, "out", "bin")},
+				Artifact{Source: "/app/lib", Dest: dir},
+			)).To(Equal([]string{
+				filepath.Join(dir, "out"),
+				filepath.Join(dir, "lib"),
+			}))
+		})
+
+		It("removes the files of glob artifacts copied into an existing folder", func() {
+			existing := filepath.Join(dir, "work", "existing")
+			Expect(ioutil.WriteFile(filepath.Join(existing, "kept.so"), []byte("kept"), 0644)).To(Succeed())
+
+			var stream bytes.Buffer
+			tw := tar.NewWriter(&stream)
+			Expect(tw.WriteHeader(&tar.Header{Name: "lib.so", Typeflag: tar.TypeReg, Mode: 0644, Size: 2})).To(Succeed())
+			_, err := tw.Write([]byte("hi"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tw.Close()).To(Succeed())
+
+			conf := testConfig()
+			conf.Workdir = filepath.Join(dir, "work")
+			conf.ArtifactChecksums = true
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile_inline: FROM scratch
+      artifacts:
+        - source: /app/*.so
+          dest: existing
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			fake := &fakeDocker{execOutput: "/app/lib.so\n", download: stream.Bytes()}
+			b := &Builder{Conf: conf, Build: manifest, docker: fake, Events: noopEventSink{}, OutputStream: ioutil.Discard, ErrorStream: ioutil.Discard}
+			_, err = b.StartBuild(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(b.globArtifactFiles).To(Equal([]string{filepath.Join(existing, "lib.so"), filepath.Join(existing, "lib.so.sha256")}))
+			Expect(filepath.Join(existing, "lib.so")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(existing, "lib.so.sha256")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(existing, "kept.so")).To(BeAnExistingFile())
+		})
+	})
+
+	Describe("inline Dockerfiles", func() {
+		It("rewrites FROM in inline Dockerfiles", func() {
+			conf := testConfig()
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    base:
+      name: base
+      dockerfile: Dockerfile
+    app:
+      name: app
+      dockerfile_inline: |
+        FROM base
+        RUN make
+      depends_on:
+        - base
+`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(manifest.Validate()).To(Succeed())
+
+			conf.Workdir = "/work"
+			b := &Builder{Conf: conf, Build: manifest, UniqueID: "ci"}
+			step, _ := manifest.FindStepByLabel("app")
+
+			parsed, err := b.parseDockerfile(step)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parsed.Rewrites).To(Equal([]fromRewrite{{From: "base", To: "base-ci", StartLine: 1, EndLine: 1}}))
+			Expect(b.uniqueDockerfile(step)).To(Equal("/work/Dockerfile.app.generated"))
+		})
+	})
+
+	Describe("escape directive", func() {
+		It("keeps a backtick escape token in the generated Dockerfile", func() {
+			workdir, err := ioutil.TempDir("", "habitus-escape")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(workdir)
+
+			dockerfile := "# escape=`\n" +
+				"FROM base\n" +
+				"COPY app C:\\app\n" +
+				"RUN dir C:\\ && `\n" +
+				"    echo done\n"
+			Expect(ioutil.WriteFile(filepath.Join(workdir, "Dockerfile"), []byte(dockerfile), 0644)).To(Succeed())
+
+			conf := testConfig()
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    base:
+      name: base
+      dockerfile: Dockerfile.base
+    app:
+      name: app
+      dockerfile: Dockerfile
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			conf.Workdir = workdir
+			b := &Builder{Conf: conf, Build: manifest, UniqueID: "ci"}
+			step, _ := manifest.FindStepByLabel("app")
+			Expect(b.replaceFromField(step)).To(Succeed())
+
+			generated, err := ioutil.ReadFile(b.uniqueDockerfile(step))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(generated)).To(Equal(strings.Replace(dockerfile, "FROM base\n", "FROM base-ci\n", 1)))
+		})
+	})
+
+	Describe("generated Dockerfiles", func() {
+		It("keeps the instructions which are not rewritten as they are", func() {
+			conf := testConfig()
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    base:
+      name: base
+      dockerfile: Dockerfile
+    app:
+      name: app
+      dockerfile_inline: |
+        FROM --platform=linux/amd64 base
+        ONBUILD COPY . /app
+        ONBUILD RUN ["make", "install"]
+        HEALTHCHECK --interval=5s --timeout=3s CMD curl -f http://localhost/ || exit 1
+        RUN apt-get update && \
+            apt-get install -y curl
+        CMD ["app", "--port", "80"]
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			b := &Builder{Conf: conf, Build: manifest, UniqueID: "ci"}
+			step, _ := manifest.FindStepByLabel("app")
+			parsed, err := b.parseDockerfile(step)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(string(rewriteFromLines(parsed.Source, parsed.Rewrites))).To(Equal("FROM --platform=linux/amd64 base-ci\n" +
+				"ONBUILD COPY . /app\n" +
+				`ONBUILD RUN ["make", "install"]` + "\n" +
+				"HEALTHCHECK --interval=5s --timeout=3s CMD curl -f http://localhost/ || exit 1\n" +
+				"RUN apt-get update && \\\n" +
+				"    apt-get install -y curl\n" +
+				`CMD ["app", "--port", "80"]` + "\n"))
+		})
+
+		It("only changes the images of rewritten FROM lines", func() {
+			source := []byte("# syntax comment\n" +
+				"ARG VERSION=1\n" +
+				"# the builder\n" +
+				"FROM base AS build\n" +
+				"RUN echo base\n" +
+				"FROM \\\n" +
+				"  base\n" +
+				"FROM ubuntu\n")
+			rewrites := []fromRewrite{
+				{From: "base", To: "base-ci", StartLine: 4, EndLine: 4},
+				{From: "base", To: "base-ci", StartLine: 6, EndLine: 7},
+			}
+
+			Expect(string(rewriteFromLines(source, rewrites))).To(Equal("# syntax comment\n" +
+				"ARG VERSION=1\n" +
+				"# the builder\n" +
+				"FROM base-ci AS build\n" +
+				"RUN echo base\n" +
+				"FROM \\\n" +
+				"  base-ci\n" +
+				"FROM ubuntu\n"))
+		})
+
+		It("saves a copy of the generated Dockerfile and keeps it on request", func() {
+			workdir, err := ioutil.TempDir("", "habitus-generated")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(workdir)
+
+			conf := testConfig()
+			conf.Workdir = workdir
+			conf.GeneratedDir = filepath.Join(workdir, "generated")
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    base:
+      name: base
+      dockerfile_inline: FROM scratch
+    app:
+      name: app
+      dockerfile_inline: FROM base
+      depends_on:
+        - base
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			b := &Builder{Conf: conf, Build: manifest, UniqueID: "ci", docker: &fakeDocker{}, Events: noopEventSink{}, OutputStream: ioutil.Discard, ErrorStream: ioutil.Discard}
+			step, _ := manifest.FindStepByLabel("app")
+			Expect(b.BuildStep(step)).To(Succeed())
+
+			saved, err := ioutil.ReadFile(filepath.Join(conf.GeneratedDir, "app.Dockerfile"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(saved)).To(Equal("FROM base-ci"))
+			_, err = os.Stat(b.uniqueDockerfile(step))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			conf.KeepGenerated = true
+			Expect(b.BuildStep(step)).To(Succeed())
+			kept, err := ioutil.ReadFile(b.uniqueDockerfile(step))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(kept).To(Equal(saved))
+		})
+	})
+
+	Describe("ARGs in FROM lines", func() {
+		It("resolves ARG defaults and build args before matching steps", func() {
+			workdir, err := ioutil.TempDir("", "habitus-args")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(workdir)
+
+			dockerfile := "ARG BASE=base\n" +
+				"ARG TOOLS=ubuntu\n" +
+				"FROM ${BASE}\n" +
+				"ARG LATE=base\n" +
+				"FROM $TOOLS AS tools\n" +
+				"FROM ${LATE}\n"
+			Expect(ioutil.WriteFile(filepath.Join(workdir, "Dockerfile.app"), []byte(dockerfile), 0644)).To(Succeed())
+
+			conf := testConfig()
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    base:
+      name: base
+      dockerfile: Dockerfile
+    tools:
+      name: tools
+      dockerfile: Dockerfile
+    app:
+      name: app
+      dockerfile: Dockerfile.app
+      args:
+        TOOLS: tools
+      depends_on:
+        - base
+        - tools
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			conf.Workdir = workdir
+			b := &Builder{Conf: conf, Build: manifest, UniqueID: "ci"}
+			step, _ := manifest.FindStepByLabel("app")
+			parsed, err := b.parseDockerfile(step)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(string(rewriteFromLines(parsed.Source, parsed.Rewrites))).To(Equal("ARG BASE=base\n" +
+				"ARG TOOLS=ubuntu\n" +
+				"FROM base-ci\n" +
+				"ARG LATE=base\n" +
+				"FROM tools-ci AS tools\n" +
+				"FROM ${LATE}\n"))
+		})
+	})
+
+	Describe("injected docker client", func() {
+		It("uses the given client for the build", func() {
+			home, err := ioutil.TempDir("", "habitus-home")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(home)
+			oldHome := os.Getenv("HOME")
+			os.Setenv("HOME", home)
+			defer os.Setenv("HOME", oldHome)
+
+			var pinged bool
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				pinged = pinged || r.URL.Path == "/_ping"
+				w.WriteHeader(http.StatusInternalServerError)
+			}))
+			defer server.Close()
+
+			client, err := docker.NewClient(server.URL)
+			Expect(err).NotTo(HaveOccurred())
+
+			manifest, err := loadManifest(testConfig(), diamondManifest)
+			Expect(err).NotTo(HaveOccurred())
+			b, err := NewBuilderWithClient(manifest, testConfig(), client)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = b.StartBuild(context.Background())
+			Expect(err).To(BeAssignableToTypeOf(&DockerError{}))
+			Expect(pinged).To(BeTrue())
+		})
+	})
+
+	Describe("credential helpers", func() {
+		It("loads the credentials and identity tokens of the helpers", func() {
+			home, err := ioutil.TempDir("", "habitus-home")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(home)
+
+			helper := `#!/bin/sh
+case "$1" in
+list) echo '{"store.example.com": "ci"}' ;;
+get)
+  read server
+  case "$server" in
+  token.example.com) echo '{"ServerURL": "token.example.com", "Username": "<token>", "Secret": "refresh-abc"}' ;;
+  broken.example.com) echo "credentials not found in native keychain"; exit 1 ;;
+  *) echo "{\"ServerURL\": \"$server\", \"Username\": \"ci\", \"Secret\": \"s3cret\"}" ;;
+  esac ;;
+esac
+`
+			Expect(os.MkdirAll(filepath.Join(home, "bin"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(home, "bin", "docker-credential-fake"), []byte(helper), 0755)).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(home, ".docker"), 0755)).To(Succeed())
+			config := `{"credsStore": "fake", "credHelpers": {"token.example.com": "fake", "broken.example.com": "fake"}}`
+			Expect(ioutil.WriteFile(filepath.Join(home, ".docker", "config.json"), []byte(config), 0600)).To(Succeed())
+
+			oldHome, oldPath, oldConfig := os.Getenv("HOME"), os.Getenv("PATH"), os.Getenv("DOCKER_CONFIG")
+			os.Setenv("HOME", home)
+			os.Setenv("PATH", filepath.Join(home, "bin")+string(os.PathListSeparator)+oldPath)
+			os.Unsetenv("DOCKER_CONFIG")
+			defer os.Setenv("HOME", oldHome)
+			defer os.Setenv("PATH", oldPath)
+			defer os.Setenv("DOCKER_CONFIG", oldConfig)
+
+			manifest, err := loadManifest(testConfig(), diamondManifest)
+			Expect(err).NotTo(HaveOccurred())
+			b, err := NewBuilderWithClient(manifest, testConfig(), &fakeDocker{})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(b.registryAuth("store.example.com")).To(Equal(docker.AuthConfiguration{Username: "ci", Password: "s3cret", ServerAddress: "store.example.com"}))
+			// identity tokens are kept out of the auth configs passed to the daemon
+			Expect(b.registryAuth("token.example.com")).To(Equal(docker.AuthConfiguration{}))
+			Expect(b.registryCredentials("token.example.com")).To(Equal(registryCredentials{IdentityToken: "refresh-abc"}))
+			Expect(b.registryCredentials("store.example.com").IdentityToken).To(BeEmpty())
+			Expect(b.registryAuth("broken.example.com")).To(Equal(docker.AuthConfiguration{}))
+			Expect(b.secrets.mask("refresh-abc")).To(Equal(secretMask))
+		})
+	})
+
+	Describe("quiet mode", func() {
+		It("discards the build output", func() {
+			manifest, err := loadManifest(testConfig(), diamondManifest)
+			Expect(err).NotTo(HaveOccurred())
+
+			conf := testConfig()
+			conf.Quiet = true
+			b, err := NewBuilderWithClient(manifest, conf, &fakeDocker{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(b.OutputStream).To(Equal(ioutil.Discard))
+			Expect(b.ErrorStream).To(Equal(os.Stderr))
+		})
+	})
+
+	Describe("git SHA tags", func() {
+		It("adds the short SHA tag to the step tags", func() {
+			step := &Step{Name: "registry.example.com:5000/app:1.0", Tags: []string{"app:latest"}}
+			b := &Builder{Conf: testConfig()}
+			Expect(b.stepTags(step)).To(Equal([]string{"app:latest"}))
+
+			b.gitSHA = "1a2b3c4"
+			Expect(b.stepTags(step)).To(Equal([]string{"app:latest", "registry.example.com:5000/app:1a2b3c4"}))
+			Expect(step.Tags).To(Equal([]string{"app:latest"}))
+		})
+	})
+
+	Describe("step contexts", func() {
+		It("resolves the Dockerfile in the step context", func() {
+			workdir, err := ioutil.TempDir("", "habitus-context")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(workdir)
+			Expect(os.MkdirAll(filepath.Join(workdir, "frontend", "docker"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(workdir, "frontend", "docker", "app.Dockerfile"), []byte("FROM node\n"), 0644)).To(Succeed())
+
+			conf := testConfig()
+			conf.Workdir = workdir
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    frontend:
+      name: frontend
+      context: frontend
+      dockerfile: docker/app.Dockerfile
+    inline:
+      name: inline
+      context: frontend
+      dockerfile_inline: FROM node
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			b := &Builder{Conf: conf, Build: manifest}
+			frontend, _ := manifest.FindStepByLabel("frontend")
+			Expect(b.uniqueDockerfile(frontend)).To(Equal(filepath.Join(workdir, "frontend", "docker", "app.Dockerfile.generated")))
+			Expect(b.contextDockerfile(frontend)).To(Equal("docker/app.Dockerfile.generated"))
+			parsed, err := b.parseDockerfile(frontend)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parsed.BaseImages).To(Equal([]string{"node"}))
+
+			inline, _ := manifest.FindStepByLabel("inline")
+			Expect(b.contextDockerfile(inline)).To(Equal("Dockerfile.inline.generated"))
+		})
+	})
+
+	Describe("step logs", func() {
+		It("writes the output of each step to its own file", func() {
+			dir, err := ioutil.TempDir("", "habitus-logs")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+
+			manifest, err := loadManifest(testConfig(), diamondManifest)
+			Expect(err).NotTo(HaveOccurred())
+
+			conf := testConfig()
+			conf.StepLogsDir = filepath.Join(dir, "logs")
+			var out bytes.Buffer
+			b := &Builder{Conf: conf, Build: manifest, OutputStream: &out}
+			Expect(b.openStepStreams()).To(Succeed())
+
+			left, _ := manifest.FindStepByLabel("left")
+			right, _ := manifest.FindStepByLabel("right")
+			b.stepOutput(left).Write([]byte("left output\n"))
+			b.stepOutput(right).Write([]byte("right output\n"))
+			b.closeStepStreams()
+
+			Expect(out.String()).To(Equal("[left] left output\n[right] right output\n"))
+			content, err := ioutil.ReadFile(filepath.Join(dir, "logs", "left.log"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("left output\n"))
+			content, err = ioutil.ReadFile(filepath.Join(dir, "logs", "right.log"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("right output\n"))
+		})
+
+		It("writes the output of the step command to the step streams", func() {
+			dir, err := ioutil.TempDir("", "habitus-logs")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+
+			conf := testConfig()
+			conf.Workdir = dir
+			conf.StepLogsDir = filepath.Join(dir, "logs")
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile_inline: FROM scratch
+      command: make test
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			var out bytes.Buffer
+			fake := &fakeDocker{execOutput: "ok  app/build\n"}
+			b := &Builder{Conf: conf, Build: manifest, docker: fake, Events: noopEventSink{}, OutputStream: &out, ErrorStream: ioutil.Discard}
+			Expect(b.openStepStreams()).To(Succeed())
+			step, _ := manifest.FindStepByLabel("app")
+			Expect(b.BuildStep(step)).To(Succeed())
+			b.closeStepStreams()
+
+			Expect(out.String()).To(Equal("ok  app/build\n"))
+			content, err := ioutil.ReadFile(filepath.Join(dir, "logs", "app.log"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("ok  app/build\n"))
+		})
+	})
+
+	Describe("output prefix", func() {
+		It("writes whole lines with the prefix", func() {
+			var out bytes.Buffer
+			p := newPrefixWriter(&out, "[app] ")
+			p.Write([]byte("Step 1/2 : FROM "))
+			Expect(out.String()).To(BeEmpty())
+			p.Write([]byte("ubuntu\nStep 2/2 : RUN make\n ---> Running"))
+			Expect(out.String()).To(Equal("[app] Step 1/2 : FROM ubuntu\n[app] Step 2/2 : RUN make\n"))
+			Expect(p.Flush()).To(Succeed())
+			Expect(out.String()).To(HaveSuffix("[app]  ---> Running\n"))
+		})
+
+		It("only prefixes steps building at the same time", func() {
+			manifest, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    builder:
+      name: builder
+      dockerfile: Dockerfile
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			var out bytes.Buffer
+			b := &Builder{Conf: testConfig(), Build: manifest, OutputStream: &out}
+			Expect(b.openStepStreams()).To(Succeed())
+			step, _ := manifest.FindStepByLabel("builder")
+			b.stepOutput(step).Write([]byte("output\n"))
+			b.closeStepStreams()
+			Expect(out.String()).To(Equal("output\n"))
+		})
+	})
+
+	Describe("host commands", func() {
+		It("gives the step image and artifacts to the post build command", func() {
+			manifest, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile_inline: FROM scratch
+      post_build: echo "$$HABITUS_STEP $$HABITUS_IMAGE $$HABITUS_ARTIFACTS"; exit 3
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			var out bytes.Buffer
+			b := &Builder{Conf: testConfig(), Build: manifest, OutputStream: &out, ErrorStream: &out}
+			step, _ := manifest.FindStepByLabel("app")
+			err = b.runPostBuild(step, []CopiedArtifact{{Source: "/app/a", Dest: "a"}, {Source: "/app/b", Dest: "b"}})
+			Expect(err).To(Equal(&CommandError{Command: step.PostBuild, ExitCode: 3}))
+			Expect(out.String()).To(Equal("app " + b.uniqueStepName(step) + " a:b\n"))
+		})
+
+		It("stops the step when the pre build command fails", func() {
+			workdir, err := ioutil.TempDir("", "habitus-prebuild")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(workdir)
+
+			conf := testConfig()
+			conf.Workdir = workdir
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile_inline: FROM scratch
+      pre_build: touch generated && exit 1
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			b := &Builder{Conf: conf, Build: manifest, docker: &fakeDocker{}, OutputStream: ioutil.Discard, ErrorStream: ioutil.Discard}
+			step, _ := manifest.FindStepByLabel("app")
+			Expect(b.BuildStep(step)).To(Equal(&CommandError{Command: step.PreBuild, ExitCode: 1}))
+			Expect(filepath.Join(workdir, "generated")).To(BeAnExistingFile())
+			Expect(b.uniqueDockerfile(step)).NotTo(BeAnExistingFile())
+		})
+	})
+
+	Describe("artifacts notice", func() {
+		var (
+			conf    *configuration.Config
+			workdir string
+		)
+
+		BeforeEach(func() {
+			var err error
+			workdir, err = ioutil.TempDir("", "habitus-notice")
+			Expect(err).NotTo(HaveOccurred())
+			conf = testConfig()
+			conf.Workdir = workdir
+			conf.ArtifactsNotice = configuration.ArtifactsNoticeStrict
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(workdir)
+		})
+
+		It("doesn't expect artifacts from steps without any", func() {
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    base:
+      name: base
+      dockerfile_inline: FROM scratch
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			b := &Builder{Conf: conf, Build: manifest, docker: &fakeDocker{}, Events: noopEventSink{}, OutputStream: ioutil.Discard, ErrorStream: ioutil.Discard}
+			step, _ := manifest.FindStepByLabel("base")
+			Expect(b.BuildStep(step)).To(Succeed())
+		})
+
+		It("fails a step whose artifact sources match nothing", func() {
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile_inline: FROM scratch
+      artifacts:
+        - source: /app/missing
+          optional: true
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			fake := &fakeDocker{missing: map[string]bool{"/app/missing": true}}
+			b := &Builder{Conf: conf, Build: manifest, docker: fake, Events: noopEventSink{}, OutputStream: ioutil.Discard, ErrorStream: ioutil.Discard}
+			step, _ := manifest.FindStepByLabel("app")
+			Expect(b.BuildStep(step)).To(MatchError("step app finished without producing any artifacts"))
+		})
+	})
+
+	Describe("failed step containers", func() {
+		var (
+			conf     *configuration.Config
+			manifest *Manifest
+			workdir  string
+		)
+
+		BeforeEach(func() {
+			var err error
+			// failed steps leave their generated Dockerfile in the workdir
+			workdir, err = ioutil.TempDir("", "habitus-failed")
+			Expect(err).NotTo(HaveOccurred())
+			conf = testConfig()
+			conf.Workdir = workdir
+
+			manifest, err = loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile_inline: FROM scratch
+      command: "false"
+`)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(workdir)
+		})
+
+		It("removes the container of a failed step", func() {
+			fake := &fakeDocker{execExitCode: 1}
+			b := &Builder{Conf: conf, Build: manifest, docker: fake, Events: noopEventSink{}, OutputStream: ioutil.Discard, ErrorStream: ioutil.Discard}
+			step, _ := manifest.FindStepByLabel("app")
+			Expect(b.BuildStep(step)).To(Equal(&CommandError{Command: "false", ExitCode: 1}))
+			Expect(fake.removed).To(HaveLen(1))
+			Expect(fake.removed[0]).To(HavePrefix("container-"))
+			Expect(b.containers).To(BeEmpty())
+		})
+
+		It("keeps the container of a failed step for debugging", func() {
+			conf.DebugOnFailure = true
+			fake := &fakeDocker{execExitCode: 1}
+			b := &Builder{Conf: conf, Build: manifest, docker: fake, Events: noopEventSink{}, OutputStream: ioutil.Discard, ErrorStream: ioutil.Discard}
+			step, _ := manifest.FindStepByLabel("app")
+			Expect(b.BuildStep(step)).To(Equal(&CommandError{Command: "false", ExitCode: 1}))
+			Expect(fake.removed).To(BeEmpty())
+		})
+	})
+
+	Describe("platforms", func() {
+		It("compares the step platform with the daemon", func() {
+			Expect(samePlatform("linux/arm64/v8", "linux/arm64")).To(BeTrue())
+			Expect(samePlatform("linux", "linux/amd64")).To(BeTrue())
+			Expect(samePlatform("linux/arm64", "linux/amd64")).To(BeFalse())
+			Expect(samePlatform("windows/amd64", "linux/amd64")).To(BeFalse())
+		})
+
+		It("fails the container of a step for another platform", func() {
+			manifest, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile_inline: FROM scratch
+      platform: linux/arm64
+      command: uname -m
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			fake := &fakeDocker{daemon: docker.Env{"Os=linux", "Arch=amd64"}}
+			b := &Builder{Conf: testConfig(), Build: manifest, docker: fake, Events: noopEventSink{}}
+			step, _ := manifest.FindStepByLabel("app")
+			_, err = b.createContainer(step, &docker.HostConfig{})
+			Expect(err).To(MatchError(ContainSubstring("step app is built for linux/arm64 but its container can't run on the linux/amd64 daemon")))
+
+			fake.daemon = docker.Env{"Os=linux", "Arch=arm64"}
+			b = &Builder{Conf: testConfig(), Build: manifest, docker: fake, Events: noopEventSink{}}
+			_, err = b.createContainer(step, &docker.HostConfig{})
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("resource limits", func() {
+		It("limits the memory and CPUs of the build and the step container", func() {
+			manifest, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile_inline: FROM scratch
+      memory: 512m
+      cpus: 1.5
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			step, _ := manifest.FindStepByLabel("app")
+			Expect(step.Memory).To(Equal(int64(512 * 1024 * 1024)))
+
+			hostConfig := &docker.HostConfig{}
+			step.limitResources(hostConfig)
+			Expect(hostConfig.Memory).To(Equal(step.Memory))
+			Expect(hostConfig.CPUPeriod).To(Equal(int64(100000)))
+			Expect(hostConfig.CPUQuota).To(Equal(int64(150000)))
+
+			opts := &docker.BuildImageOptions{}
+			step.limitBuildResources(opts)
+			Expect(opts.Memory).To(Equal(step.Memory))
+			Expect(opts.CPUQuota).To(Equal(int64(150000)))
+		})
+
+		It("rejects an invalid memory limit", func() {
+			_, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile_inline: FROM scratch
+      memory: lots
+`)
+			Expect(err).To(MatchError(ContainSubstring("Step 'app' has an invalid memory limit")))
+		})
+	})
+
+	Describe("host volumes", func() {
+		It("mounts the host folders with relative paths in the workdir", func() {
+			conf := testConfig()
+			conf.Workdir = "/src"
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile_inline: FROM scratch
+      volumes:
+        - cache:/root/.cache
+        - /etc/ssl/certs:/etc/ssl/certs:ro
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			b := &Builder{Conf: conf, Build: manifest}
+			step, _ := manifest.FindStepByLabel("app")
+			Expect(b.hostBinds(step)).To(Equal([]string{"/src/cache:/root/.cache", "/etc/ssl/certs:/etc/ssl/certs:ro"}))
+		})
+
+		It("rejects invalid volumes and the folders habitus mounts", func() {
+			manifest, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile_inline: FROM scratch
+      volumes:
+        - cache
+        - cache:root
+        - cache:/root:rx
+        - cache:/run
+        - cache:/habitus/volumes/shared
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = manifest.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("volume 1 'cache' is not host:container"))
+			Expect(err.Error()).To(ContainSubstring("volume 2 container path root is not absolute"))
+			Expect(err.Error()).To(ContainSubstring("volume 3 'cache:/root:rx' has an invalid mode"))
+			Expect(err.Error()).To(ContainSubstring("volume 4 container path /run is used by habitus"))
+			Expect(err.Error()).To(ContainSubstring("volume 5 container path /habitus/volumes/shared is used by habitus"))
+		})
+	})
+
+	Describe("caches", func() {
+		It("mounts the caches in the step container and on the BuildKit RUN instructions", func() {
+			workdir, err := ioutil.TempDir("", "habitus-caches")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(workdir)
+
+			conf := testConfig()
+			conf.Workdir = workdir
+			conf.UseBuildKit = true
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile_inline: |
+        FROM golang:1.8
+        # fetch the modules
+        RUN go mod download && \
+          go build ./...
+        COPY . /src
+      caches:
+        npm: /root/.npm
+        gomod: /go/pkg/mod
+`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(manifest.Validate()).To(Succeed())
+
+			b := &Builder{Conf: conf, Build: manifest, UniqueID: "ci"}
+			step, _ := manifest.FindStepByLabel("app")
+			Expect(b.cacheBinds(step)).To(Equal([]string{"habitus_cache_gomod:/go/pkg/mod", "habitus_cache_npm:/root/.npm"}))
+
+			Expect(b.replaceFromField(step)).To(Succeed())
+			generated, err := ioutil.ReadFile(b.uniqueDockerfile(step))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(generated)).To(Equal(`FROM golang:1.8
+# fetch the modules
+RUN --mount=type=cache,id=habitus_cache_gomod,target=/go/pkg/mod --mount=type=cache,id=habitus_cache_npm,target=/root/.npm go mod download && \
+  go build ./...
+COPY . /src
+`))
+		})
+	})
+
+	Describe("TLS", func() {
+		var certs string
+
+		BeforeEach(func() {
+			var err error
+			certs, err = ioutil.TempDir("", "habitus-certs")
+			Expect(err).NotTo(HaveOccurred())
+			writeTestCerts(certs)
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(certs)
+		})
+
+		It("connects without verifying the daemon and without a CA", func() {
+			conf := testConfig()
+			conf.DockerCert = certs
+			conf.InsecureSkipVerify = true
+			config, err := daemonTLSConfig(conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.InsecureSkipVerify).To(BeTrue())
+			Expect(config.Certificates).To(HaveLen(1))
+			Expect(config.MinVersion).To(Equal(uint16(tls.VersionTLS12)))
+
+			_, err = daemonTLSConfig(&configuration.Config{DockerCert: certs})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("verifies the daemon with the CA from the minimum TLS version", func() {
+			cert, err := ioutil.ReadFile(filepath.Join(certs, "cert.pem"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(filepath.Join(certs, "ca.pem"), cert, 0644)).To(Succeed())
+
+			conf := testConfig()
+			conf.DockerCert = certs
+			conf.TLSMinVersion = "1.3"
+			config, err := daemonTLSConfig(conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.InsecureSkipVerify).To(BeFalse())
+			Expect(config.RootCAs).NotTo(BeNil())
+			Expect(config.MinVersion).To(Equal(uint16(tls.VersionTLS13)))
+
+			conf.TLSMinVersion = "2"
+			_, err = daemonTLSConfig(conf)
+			Expect(err).To(MatchError(ContainSubstring("invalid TLS version 2")))
+		})
+
+		It("uses the TLS config for the daemon connection", func() {
+			conf := testConfig()
+			conf.DockerCert = certs
+			conf.InsecureSkipVerify = true
+			config, err := daemonTLSConfig(conf)
+			Expect(err).NotTo(HaveOccurred())
+
+			endpoint, _ := url.Parse("tcp://127.0.0.1:2376")
+			client, err := newTLSClient(endpoint, config, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(client.TLSConfig).To(BeIdenticalTo(config))
+			Expect(client.HTTPClient.Transport.(*http.Transport).TLSClientConfig).To(BeIdenticalTo(config))
+		})
+	})
+
+	Describe("ssh daemons", func() {
+		It("runs docker system dial-stdio on the host", func() {
+			endpoint, _ := url.Parse("ssh://ci@build-host:2222")
+			cmd := (&sshDialer{endpoint: endpoint}).command()
+			Expect(cmd.Args).To(Equal([]string{"ssh", "-l", "ci", "-p", "2222", "--", "build-host", "docker", "system", "dial-stdio"}))
+
+			endpoint, _ = url.Parse("ssh://build-host")
+			cmd = (&sshDialer{endpoint: endpoint}).command()
+			Expect(cmd.Args).To(Equal([]string{"ssh", "--", "build-host", "docker", "system", "dial-stdio"}))
+		})
+
+		It("connects to the stdin and stdout of the command", func() {
+			cmd := exec.Command("cat")
+			stdin, err := cmd.StdinPipe()
+			Expect(err).NotTo(HaveOccurred())
+			stdout, err := cmd.StdoutPipe()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cmd.Start()).To(Succeed())
+
+			conn := &commandConn{cmd: cmd, stdin: stdin, stdout: stdout}
+			_, err = conn.Write([]byte("ping"))
+			Expect(err).NotTo(HaveOccurred())
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(conn, buf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buf)).To(Equal("ping"))
+			Expect(conn.Close()).To(Succeed())
+			Expect(conn.Close()).To(Succeed())
+		})
+
+		It("sends the API calls through ssh", func() {
+			endpoint, _ := url.Parse("ssh://ci@build-host")
+			client, err := newSSHClient(endpoint, "1.25")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(client.Dialer).To(BeAssignableToTypeOf(&sshDialer{}))
+
+			_, err = newSSHClient(&url.URL{Scheme: "ssh"}, "")
+			Expect(err).To(MatchError("no host in the ssh docker host"))
+		})
+	})
+
+	Describe("API version", func() {
+		It("uses the daemon version up to the newest one habitus knows", func() {
+			version, err := negotiateAPIVersion(fakeVersion{"ApiVersion=1.24"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(version).To(Equal("1.24"))
+
+			version, err = negotiateAPIVersion(fakeVersion{"ApiVersion=1.41", "MinAPIVersion=1.12"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(version).To(Equal(maxAPIVersion))
+
+			version, err = negotiateAPIVersion(fakeVersion{"ApiVersion=1.47", "MinAPIVersion=1.44"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(version).To(Equal("1.44"))
+		})
+
+		It("rejects daemons too old for habitus", func() {
+			_, err := negotiateAPIVersion(fakeVersion{"ApiVersion=1.19"})
+			Expect(err).To(MatchError(ContainSubstring("the Docker API version 1.19 of the daemon is too old. Habitus needs 1.21 or newer")))
+		})
+	})
+
+	Describe("podman", func() {
+		It("detects podman from the socket or the daemon version", func() {
+			socket, _ := url.Parse("unix:///run/user/1000/podman/podman.sock")
+			Expect(detectPodman(fakeVersion{}, socket)).To(BeTrue())
+
+			host, _ := url.Parse("tcp://build.example.com:2375")
+			Expect(detectPodman(fakeVersion{`Components=[{"Name":"Podman Engine","Version":"4.9.3"}]`}, host)).To(BeTrue())
+			Expect(detectPodman(fakeVersion{`Components=[{"Name":"Engine","Version":"24.0.7"}]`}, host)).To(BeFalse())
+		})
+
+		It("reads podman's auth.json", func() {
+			home, err := ioutil.TempDir("", "habitus-home")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(home)
+			oldHome, oldRuntime := os.Getenv("HOME"), os.Getenv("XDG_RUNTIME_DIR")
+			os.Setenv("HOME", home)
+			os.Setenv("XDG_RUNTIME_DIR", filepath.Join(home, "run"))
+			defer os.Setenv("HOME", oldHome)
+			defer os.Setenv("XDG_RUNTIME_DIR", oldRuntime)
+
+			Expect(ioutil.WriteFile(filepath.Join(home, ".dockercfg"), []byte(`{"quay.io": {"auth": "ZG9ja2VyOmRvY2tlcg==", "email": ""}}`), 0600)).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(home, "run", "containers"), 0700)).To(Succeed())
+			// ci:secret and podman:podman
+			auths := `{"auths": {"registry.example.com": {"auth": "Y2k6c2VjcmV0"}, "quay.io": {"auth": "cG9kbWFuOnBvZG1hbg=="}}}`
+			Expect(ioutil.WriteFile(filepath.Join(home, "run", "containers", "auth.json"), []byte(auths), 0600)).To(Succeed())
+
+			manifest, err := loadManifest(testConfig(), diamondManifest)
+			Expect(err).NotTo(HaveOccurred())
+			b, err := NewBuilderWithClient(manifest, testConfig(), &fakeDocker{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(b.auth.Configs["registry.example.com"].Username).To(Equal("ci"))
+			Expect(b.auth.Configs["registry.example.com"].Password).To(Equal("secret"))
+			Expect(b.auth.Configs["quay.io"].Username).To(Equal("docker"))
+
+			conf := testConfig()
+			conf.Podman = true
+			b, err = NewBuilderWithClient(manifest, conf, &fakeDocker{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(b.auth.Configs["quay.io"].Username).To(Equal("podman"))
+		})
+
+		It("waits for podman execs to exit", func() {
+			conf := testConfig()
+			fake := &fakeDocker{execRunning: 2, execExitCode: 3}
+			b := &Builder{Conf: conf, docker: fake}
+			inspect, err := b.inspectExec("exec")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(inspect.Running).To(BeTrue())
+
+			conf.Podman = true
+			fake.execRunning = 2
+			inspect, err = b.inspectExec("exec")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(inspect.Running).To(BeFalse())
+			Expect(inspect.ExitCode).To(Equal(3))
+		})
+	})
+
+	Describe("id maps", func() {
+		It("maps container ids to host ids", func() {
+			ranges, err := parseIDMap("0:1000:1, 1:100000:65536")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mapID(ranges, 0)).To(Equal(1000))
+			Expect(mapID(ranges, 33)).To(Equal(100032))
+			Expect(mapID(ranges, 70000)).To(Equal(70000))
+
+			ranges, err = parseIDMap("")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mapID(ranges, 33)).To(Equal(33))
+		})
+
+		It("rejects invalid id maps", func() {
+			_, err := parseIDMap("0:1000")
+			Expect(err).To(MatchError("invalid id map '0:1000'. Use container:host:size"))
+
+			_, err = parseIDMap("0:-1:10")
+			Expect(err).To(MatchError(ContainSubstring("should be positive numbers")))
+
+			_, err = parseIDMap("0:1000:0")
+			Expect(err).To(MatchError(ContainSubstring("should be above 0")))
+		})
+	})
+
+	Describe("retries", func() {
+		It("retries dropped connections and registry errors", func() {
+			Expect(isRetryableError(io.ErrUnexpectedEOF)).To(BeTrue())
+			Expect(isRetryableError(&url.Error{Op: "Post", URL: "http://docker/build", Err: io.EOF})).To(BeTrue())
+			Expect(isRetryableError(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")})).To(BeTrue())
+			Expect(isRetryableError(errors.New("Get https://registry-1.docker.io/v2/: net/http: TLS handshake timeout"))).To(BeTrue())
+			Expect(isRetryableError(errors.New("received unexpected HTTP status: 503 Service Unavailable"))).To(BeTrue())
+		})
+
+		It("doesn't retry build failures mentioning EOF", func() {
+			Expect(isRetryableError(errors.New("The command '/bin/sh -c cat <<EOF' returned a non-zero code: 1"))).To(BeFalse())
+			Expect(isRetryableError(errors.New("Dockerfile parse error line 3: unterminated heredoc, missing EOF"))).To(BeFalse())
+		})
+	})
+
+	Describe("docker client interface", func() {
+		It("builds with a fake client", func() {
+			manifest, err := loadManifest(testConfig(), diamondManifest)
+			Expect(err).NotTo(HaveOccurred())
+
+			fake := &fakeDocker{images: map[string]*docker.Image{"golang:1.8": {ID: "sha256:abc"}}}
+			b := &Builder{Conf: testConfig(), Build: manifest, docker: fake}
+			Expect(b.baseImageExists("golang:1.8")).To(BeTrue())
+		})
+	})
+
+	Describe("cancellation", func() {
+		It("stops a cancelled build before the next level", func() {
+			conf := testConfig()
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile_inline: FROM scratch
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			b := &Builder{Conf: conf, Build: manifest, docker: &fakeDocker{}, OutputStream: ioutil.Discard, Events: noopEventSink{}}
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			result, err := b.StartBuild(ctx)
+			Expect(err).To(Equal(context.Canceled))
+			Expect(result.Steps).To(HaveLen(1))
+			Expect(result.Steps[0].Status).To(Equal(StepSkipped))
+		})
+
+		It("stops a build running past the build timeout", func() {
+			conf := testConfig()
+			conf.BuildTimeout = time.Nanosecond
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile_inline: FROM scratch
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			b := &Builder{Conf: conf, Build: manifest, docker: &fakeDocker{}, OutputStream: ioutil.Discard, Events: noopEventSink{}}
+			result, err := b.StartBuild(context.Background())
+			Expect(err).To(Equal(&TimeoutError{Timeout: time.Nanosecond}))
+			Expect(result.Status).To(Equal(BuildFailed))
+
+			err = &TimeoutError{Timeout: time.Minute, Steps: []string{"left", "right"}}
+			Expect(err).To(MatchError("the build timed out after 1m0s while building left, right"))
+		})
+	})
+
+	Describe("cancelled build cleanup", func() {
+		It("removes the containers and generated Dockerfiles of the run", func() {
+			workdir, err := ioutil.TempDir("", "habitus-cancel")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(workdir)
+
+			conf := testConfig()
+			conf.Workdir = workdir
+			manifest, err := loadManifest(conf, diamondManifest)
+			Expect(err).NotTo(HaveOccurred())
+
+			fake := &fakeDocker{}
+			b := &Builder{Conf: conf, Build: manifest, docker: fake}
+			base, _ := manifest.FindStepByLabel("base")
+			Expect(ioutil.WriteFile(b.uniqueDockerfile(base), []byte("FROM scratch\n"), 0644)).To(Succeed())
+
+			b.trackContainer("built")
+			b.untrackContainer("built")
+			b.trackContainer("running")
+			b.cleanupCancelledBuild()
+
+			Expect(fake.removed).To(Equal([]string{"running"}))
+			_, err = os.Stat(b.uniqueDockerfile(base))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+	})
+
+	Describe("debug on failure", func() {
+		It("keeps the container of a failed command out of the cleanup", func() {
+			conf := testConfig()
+			conf.KeepGenerated = true
+			manifest, err := loadManifest(conf, diamondManifest)
+			Expect(err).NotTo(HaveOccurred())
+
+			fake := &fakeDocker{}
+			b := &Builder{Conf: conf, Build: manifest, docker: fake}
+			step, _ := manifest.FindStepByLabel("base")
+			b.trackContainer("failed")
+			Expect(b.keepForDebugging(step, "failed")).To(BeFalse())
+
+			conf.DebugOnFailure = true
+			Expect(b.keepForDebugging(step, "failed")).To(BeTrue())
+			b.cleanupCancelledBuild()
+			Expect(fake.removed).To(BeEmpty())
+		})
+	})
+
+	Describe("build result", func() {
+		It("reports each step in build order with its artifacts", func() {
+			manifest, err := loadManifest(testConfig(), diamondManifest)
+			Expect(err).NotTo(HaveOccurred())
+
+			b := &Builder{Conf: testConfig(), Build: manifest}
+			b.initSummaries()
+
+			base, _ := manifest.FindStepByLabel("base")
+			left, _ := manifest.FindStepByLabel("left")
+			b.recordArtifacts(base, []CopiedArtifact{{Source: "/app/bin", Dest: "/work/bin"}})
+			b.recordStep(base, time.Second, nil)
+			b.recordStep(left, time.Second, errors.New("failed"))
+
+			start := time.Now().Add(-time.Minute)
+			result := b.buildResult(start, errors.New("failed"))
+			Expect(result.Status).To(Equal(BuildFailed))
+			Expect(result.Started).To(Equal(start))
+			Expect(result.Duration).To(Equal(result.Finished.Sub(start)))
+			Expect(result.Duration).To(BeNumerically(">=", time.Minute))
+			Expect(result.Steps).To(HaveLen(4))
+			Expect(result.Steps[0].Label).To(Equal("base"))
+			Expect(result.Steps[0].Status).To(Equal(StepBuilt))
+			Expect(result.Steps[0].Artifacts).To(Equal([]CopiedArtifact{{Source: "/app/bin", Dest: "/work/bin"}}))
+			Expect(result.Steps[3].Label).To(Equal("final"))
+			Expect(result.Steps[3].Status).To(Equal(StepSkipped))
+
+			statuses := map[string]string{}
+			for _, s := range result.Steps {
+				statuses[s.Label] = s.Status
+			}
+			Expect(statuses["left"]).To(Equal(StepFailed))
+		})
+	})
+
+	Describe("build events", func() {
+		It("emits the events of the build in order", func() {
+			workdir, err := ioutil.TempDir("", "habitus-events")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(workdir)
+
+			conf := testConfig()
+			conf.Workdir = workdir
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile_inline: FROM scratch
+      command: make test
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			sink := &recordingSink{}
+			fake := &fakeDocker{execExitCode: 2}
+			b := &Builder{Conf: conf, Build: manifest, docker: fake, Events: sink, OutputStream: ioutil.Discard, ErrorStream: ioutil.Discard}
+			_, err = b.StartBuild(context.Background())
+			Expect(err).To(HaveOccurred())
+
+			var types []string
+			for _, event := range sink.events {
+				types = append(types, event.Type)
+				Expect(event.Time.IsZero()).To(BeFalse())
+			}
+			Expect(types).To(Equal([]string{EventBuildStarted, EventStepStarted, EventCommandExited, EventStepFinished, EventBuildFinished}))
+
+			exited := sink.events[2]
+			Expect(exited.Step).To(Equal("app"))
+			Expect(exited.Command).To(Equal("make test"))
+			Expect(exited.ExitCode).NotTo(BeNil())
+			Expect(*exited.ExitCode).To(Equal(2))
+			Expect(sink.events[3].Error).To(Equal("command 'make test' exit with exit code 2"))
+			Expect(sink.events[4].Error).To(Equal(err.Error()))
+		})
+
+		It("writes the events as JSON lines", func() {
+			var out bytes.Buffer
+			sink := NewJSONEventSink(&out)
+			exitCode := 0
+			sink.Emit(Event{Type: EventCommandExited, Time: time.Unix(0, 0).UTC(), Step: "app", Command: "make", ExitCode: &exitCode})
+			sink.Emit(Event{Type: EventBuildFinished, Time: time.Unix(60, 0).UTC()})
+
+			Expect(out.String()).To(Equal(`{"type":"command_exited","time":"1970-01-01T00:00:00Z","step":"app","command":"make","exit_code":0}` + "\n" +
+				`{"type":"build_finished","time":"1970-01-01T00:01:00Z"}` + "\n"))
+		})
+	})
+
+	Describe("build args from the environment", func() {
+		It("reads the values at build time", func() {
+			os.Setenv("HABITUS_TEST_TOKEN", "s3cret")
+			defer os.Unsetenv("HABITUS_TEST_TOKEN")
+
+			manifest, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    builder:
+      name: builder
+      dockerfile: Dockerfile
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			conf := testConfig()
+			Expect(conf.BuildArgs.Set("VERSION=1.2")).To(Succeed())
+			conf.BuildEnv = "HABITUS_TEST_TOKEN, HABITUS_TEST_MISSING"
+			b := &Builder{Conf: conf, Build: manifest}
+			step, _ := manifest.FindStepByLabel("builder")
+			Expect(b.buildArgs(step)).To(Equal([]docker.BuildArg{
+				{Name: "VERSION", Value: "1.2"},
+				{Name: "HABITUS_TEST_TOKEN", Value: "s3cret"},
+				{Name: "HABITUS_TEST_MISSING", Value: ""},
+			}))
+		})
+
+		It("keeps the values of env build args off the BuildKit command line", func() {
+			manifest, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    builder:
+      name: builder
+      dockerfile: Dockerfile
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			conf := testConfig()
+			conf.BuildEnv = "HABITUS_TEST_TOKEN"
+			b := &Builder{Conf: conf, Build: manifest}
+			step, _ := manifest.FindStepByLabel("builder")
+			cmd := b.buildKitCommand(step, []docker.BuildArg{
+				{Name: "VERSION", Value: "1.2"},
+				{Name: "HABITUS_TEST_TOKEN", Value: "s3cret"},
+			}, false, "")
+
+			Expect(cmd.Args).To(ContainElement("VERSION=1.2"))
+			Expect(cmd.Args).To(ContainElement("HABITUS_TEST_TOKEN"))
+			Expect(strings.Join(cmd.Args, " ")).NotTo(ContainSubstring("s3cret"))
+			Expect(cmd.Env).To(ContainElement("HABITUS_TEST_TOKEN=s3cret"))
+		})
+
+		It("only verifies the daemon certificate of BuildKit builds without skip verify", func() {
+			manifest, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    builder:
+      name: builder
+      dockerfile: Dockerfile
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			conf := testConfig()
+			conf.UseTLS = true
+			conf.DockerCert = "/certs"
+			b := &Builder{Conf: conf, Build: manifest}
+			step, _ := manifest.FindStepByLabel("builder")
+			cmd := b.buildKitCommand(step, nil, false, "")
+			Expect(cmd.Env).To(ContainElement("DOCKER_TLS_VERIFY=1"))
+
+			conf.InsecureSkipVerify = true
+			cmd = b.buildKitCommand(step, nil, false, "")
+			Expect(cmd.Env).NotTo(ContainElement("DOCKER_TLS_VERIFY=1"))
+			Expect(cmd.Env).To(ContainElement("DOCKER_TLS=1"))
+			Expect(cmd.Env).To(ContainElement("DOCKER_CERT_PATH=/certs"))
+		})
+	})
+
+	Describe("build network modes", func() {
+		It("builds the steps with BuildKit in their network mode or the global one", func() {
+			conf := testConfig()
+			conf.NetworkMode = "host"
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    global:
+      name: global
+      dockerfile: Dockerfile
+    isolated:
+      name: isolated
+      dockerfile: Dockerfile
+      network_mode: none
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			b := &Builder{Conf: conf, Build: manifest}
+			for label, mode := range map[string]string{"global": "host", "isolated": "none"} {
+				step, _ := manifest.FindStepByLabel(label)
+				Expect(step.NetworkMode).To(Equal(mode))
+				Expect(b.useBuildKit(step)).To(BeTrue())
+				Expect(strings.Join(b.buildKitCommand(step, nil, false, "").Args, " ")).To(ContainSubstring(" --network " + mode + " "))
+			}
+		})
+
+		It("builds without BuildKit or a network flag when no network mode is set", func() {
+			manifest, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile: Dockerfile
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			b := &Builder{Conf: testConfig(), Build: manifest}
+			step, _ := manifest.FindStepByLabel("app")
+			Expect(b.useBuildKit(step)).To(BeFalse())
+			Expect(b.buildKitCommand(step, nil, false, "").Args).NotTo(ContainElement("--network"))
+		})
+	})
+
+	Describe("cache images", func() {
+		var manifest *Manifest
+
+		BeforeEach(func() {
+			var err error
+			conf := testConfig()
+			conf.CacheFrom = "registry.example.com/app:cache"
+			manifest, err = loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    global:
+      name: global
+      dockerfile: Dockerfile
+    own:
+      name: own
+      dockerfile: Dockerfile
+      cache_from:
+        - example/builder
+        - example/app:1.2
+`)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("passes the cache images of the steps or the global ones to BuildKit", func() {
+			b := &Builder{Conf: testConfig(), Build: manifest}
+			global, _ := manifest.FindStepByLabel("global")
+			own, _ := manifest.FindStepByLabel("own")
+			Expect(b.useBuildKit(global)).To(BeTrue())
+
+			Expect(strings.Join(b.buildKitCommand(global, nil, false, "").Args, " ")).To(ContainSubstring(" --cache-from registry.example.com/app:cache "))
+			args := strings.Join(b.buildKitCommand(own, nil, false, "").Args, " ")
+			Expect(args).To(ContainSubstring(" --cache-from example/builder --cache-from example/app:1.2 "))
+			Expect(args).NotTo(ContainSubstring("registry.example.com"))
+		})
+
+		It("pulls the cache images with the latest tag by default and carries on when a pull fails", func() {
+			fake := &fakeDocker{pullErr: errors.New("not found")}
+			b := &Builder{Conf: testConfig(), Build: manifest, docker: fake, OutputStream: ioutil.Discard}
+			own, _ := manifest.FindStepByLabel("own")
+
+			b.pullCacheImages(own)
+			Expect(fake.pulled).To(Equal([]string{"example/builder:latest", "example/app:1.2"}))
+		})
+	})
+
+	Describe("secret masking", func() {
+		It("masks the secret values in the logs", func() {
+			memory := logging.NewMemoryBackend(10)
+			logger := logging.MustGetLogger("habitus-mask-test")
+			logger.SetBackend(logging.AddModuleLevel(memory))
+
+			secrets := &secretValues{}
+			secrets.add("s3cret")
+			secrets.add("s3cret-token")
+			secrets.add("abc")
+			masked := *logger
+			masked.SetBackend(newMaskingBackend(*logger, secrets))
+
+			masked.Infof("Running %s with s3cret-token and %d steps", []string{"--build-arg", "TOKEN=s3cret"}, 3)
+			Expect(memory.Head().Record.Message()).To(Equal("Running [--build-arg TOKEN=****] with **** and 3 steps"))
+
+			masked.Debug("abc isn't masked")
+			Expect(memory.Head().Next().Record.Message()).To(Equal("abc isn't masked"))
+		})
+
+		It("doesn't change the logger of the config", func() {
+			memory := logging.NewMemoryBackend(10)
+			conf := testConfig()
+			conf.Logger = *logging.MustGetLogger("habitus-mask-config-test")
+			conf.Logger.SetBackend(logging.AddModuleLevel(memory))
+
+			manifest, err := loadManifest(testConfig(), diamondManifest)
+			Expect(err).NotTo(HaveOccurred())
+			first, err := NewBuilderWithClient(manifest, conf, &fakeDocker{})
+			Expect(err).NotTo(HaveOccurred())
+			first.AddSecretValue("first-secret")
+			second, err := NewBuilderWithClient(manifest, conf, &fakeDocker{})
+			Expect(err).NotTo(HaveOccurred())
+			second.AddSecretValue("second-secret")
+
+			second.Conf.Logger.Info("first-secret and second-secret")
+			conf.Logger.Info("second-secret")
+			Expect(memory.Head().Record.Message()).To(Equal("first-secret and ****"))
+			Expect(memory.Head().Next().Record.Message()).To(Equal("second-secret"))
+		})
+
+		It("has the levels of the wrapped logger", func() {
+			logger := logging.MustGetLogger("habitus-mask-level-test")
+			logging.SetLevel(logging.WARNING, "habitus-mask-level-test")
+			defer logging.SetLevel(logging.DEBUG, "habitus-mask-level-test")
+
+			backend := newMaskingBackend(*logger, &secretValues{})
+			Expect(backend.IsEnabledFor(logging.INFO, "habitus")).To(BeFalse())
+			Expect(backend.IsEnabledFor(logging.WARNING, "habitus")).To(BeTrue())
+			Expect(backend.GetLevel("habitus")).To(Equal(logging.WARNING))
+		})
+
+		It("masks the sensitive values of the config", func() {
+			os.Setenv("HABITUS_MASK_TOKEN", "env-t0ken")
+			defer os.Unsetenv("HABITUS_MASK_TOKEN")
+
+			memory := logging.NewMemoryBackend(10)
+			conf := testConfig()
+			conf.Logger = *logging.MustGetLogger("habitus-mask-config-values-test")
+			conf.Logger.SetBackend(logging.AddModuleLevel(memory))
+			conf.BuildfileAuth = "Bearer header-t0ken"
+			conf.BuildEnv = "HABITUS_MASK_TOKEN"
+
+			MaskedLogger(conf).Errorf("Failed to fetch with Bearer header-t0ken, header-t0ken and env-t0ken")
+			Expect(memory.Head().Record.Message()).To(Equal("Failed to fetch with ****, **** and ****"))
+		})
+	})
+
+	Describe("build notification", func() {
+		It("posts the build result as JSON", func() {
+			var received map[string]interface{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				Expect(r.Method).To(Equal("POST"))
+				Expect(r.Header.Get("Content-Type")).To(Equal("application/json"))
+				Expect(json.NewDecoder(r.Body).Decode(&received)).To(Succeed())
+			}))
+			defer server.Close()
+
+			conf := testConfig()
+			conf.NotifyURL = server.URL
+			b := &Builder{Conf: conf}
+			b.notify(&BuildResult{Status: BuildSucceeded, Duration: time.Second, Steps: []StepSummary{{Step: "app", Label: "app", Status: StepBuilt}}})
+
+			Expect(received["status"]).To(Equal(BuildSucceeded))
+			Expect(received["duration"]).To(BeNumerically("==", time.Second))
+			Expect(received["steps"]).To(HaveLen(1))
+		})
+
+		It("posts a Slack message colored by the build status", func() {
+			var received slackMessage
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				Expect(json.NewDecoder(r.Body).Decode(&received)).To(Succeed())
+			}))
+			defer server.Close()
+
+			conf := testConfig()
+			conf.SlackWebhook = server.URL
+			b := &Builder{Conf: conf, UniqueID: "ci"}
+			b.notify(&BuildResult{Status: BuildFailed, Error: "step app failed", Duration: 90 * time.Second, Steps: []StepSummary{{Step: "app", Label: "app", Status: StepFailed}}})
+
+			Expect(received.Attachments).To(HaveLen(1))
+			Expect(received.Attachments[0].Color).To(Equal("danger"))
+			Expect(received.Attachments[0].Title).To(Equal("Habitus build ci failed"))
+			Expect(received.Attachments[0].Text).To(ContainSubstring("app   failed"))
+			Expect(received.Attachments[0].Fields).To(ContainElement(slackField{Title: "Duration", Value: "1m30s", Short: true}))
+		})
+
+		It("reports builds failing before the steps start", func() {
+			var received map[string]interface{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				Expect(json.NewDecoder(r.Body).Decode(&received)).To(Succeed())
+			}))
+			defer server.Close()
+
+			manifest, err := loadManifest(testConfig(), diamondManifest)
+			Expect(err).NotTo(HaveOccurred())
+
+			conf := testConfig()
+			conf.NotifyURL = server.URL
+			b := &Builder{Conf: conf, Build: manifest, docker: &fakeDocker{pingErr: errors.New("connection refused")}}
+			_, err = b.StartBuild(context.Background())
+			Expect(err).To(BeAssignableToTypeOf(&DockerError{}))
+
+			Expect(received["status"]).To(Equal(BuildFailed))
+			Expect(received["error"]).To(ContainSubstring("connection refused"))
+		})
+
+		It("doesn't fail when the notification can't be sent", func() {
+			conf := testConfig()
+			conf.SlackWebhook = "http://127.0.0.1:1"
+			b := &Builder{Conf: conf}
+			b.notify(&BuildResult{Status: BuildSucceeded})
+		})
+	})
+
+	Describe("incremental builds", func() {
+		It("fingerprints the context and finds up to date images", func() {
+			workdir, err := ioutil.TempDir("", "habitus-incremental")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(workdir)
+			Expect(ioutil.WriteFile(filepath.Join(workdir, "Dockerfile"), []byte("FROM scratch\nCOPY app /app\n"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(workdir, "app"), []byte("v1"), 0644)).To(Succeed())
+
+			conf := testConfig()
+			conf.Workdir = workdir
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile: Dockerfile
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			fake := &fakeDocker{images: map[string]*docker.Image{}}
+			b := &Builder{Conf: conf, Build: manifest, docker: fake}
+			step, _ := manifest.FindStepByLabel("app")
+			Expect(b.replaceFromField(step)).To(Succeed())
+			fingerprint, err := b.stepFingerprint(step)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(b.upToDate(step, fingerprint)).To(BeFalse())
+
+			// generated Dockerfiles of other steps and file times don't change it
+			Expect(ioutil.WriteFile(filepath.Join(workdir, "Dockerfile.other.generated"), []byte("FROM scratch\n"), 0644)).To(Succeed())
+			Expect(os.Chtimes(filepath.Join(workdir, "app"), time.Now(), time.Now().Add(time.Hour))).To(Succeed())
+			Expect(b.stepFingerprint(step)).To(Equal(fingerprint))
+
+			fake.images["app"] = &docker.Image{Config: &docker.Config{Labels: map[string]string{fingerprintLabel: fingerprint}}}
+			Expect(b.upToDate(step, fingerprint)).To(BeTrue())
+
+			Expect(ioutil.WriteFile(filepath.Join(workdir, "app"), []byte("v2"), 0644)).To(Succeed())
+			Expect(b.stepFingerprint(step)).NotTo(Equal(fingerprint))
+
+			Expect(b.addLabel(step, fingerprintLabel, fingerprint)).To(Succeed())
+			generated, err := ioutil.ReadFile(b.uniqueDockerfile(step))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(generated)).To(HaveSuffix("COPY app /app\nLABEL habitus.fingerprint=" + fingerprint + "\n"))
+		})
+
+		It("doesn't run the cleanup commands of an up to date image again", func() {
+			workdir, err := ioutil.TempDir("", "habitus-incremental")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(workdir)
+
+			conf := testConfig()
+			conf.Workdir = workdir
+			conf.Incremental = true
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile_inline: FROM scratch
+      cleanup:
+        commands:
+          - rm /app/secret.key
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			fake := &fakeDocker{images: map[string]*docker.Image{}}
+			b := &Builder{Conf: conf, Build: manifest, docker: fake, Events: noopEventSink{}, OutputStream: ioutil.Discard, ErrorStream: ioutil.Discard}
+			step, _ := manifest.FindStepByLabel("app")
+			Expect(b.replaceFromField(step)).To(Succeed())
+			fingerprint, err := b.stepFingerprint(step)
+			Expect(err).NotTo(HaveOccurred())
+			fake.images["app"] = &docker.Image{Config: &docker.Config{Labels: map[string]string{fingerprintLabel: fingerprint}}}
+
+			Expect(b.BuildStep(step)).To(Succeed())
+			Expect(fake.built).To(BeEmpty())
+			Expect(fake.created).To(BeEmpty())
+			Expect(fake.execs).To(BeEmpty())
+			Expect(fake.committed).To(BeEmpty())
+		})
+	})
+
+	Describe("content cache mode", func() {
+		It("builds without the cache when the context changed", func() {
+			workdir, err := ioutil.TempDir("", "habitus-content")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(workdir)
+			Expect(ioutil.WriteFile(filepath.Join(workdir, "app"), []byte("v1"), 0644)).To(Succeed())
+
+			conf := testConfig()
+			conf.Workdir = workdir
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile_inline: FROM scratch
+      cache_mode: content
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			fake := &fakeDocker{images: map[string]*docker.Image{}}
+			b := &Builder{Conf: conf, Build: manifest, docker: fake}
+			step, _ := manifest.FindStepByLabel("app")
+			Expect(b.replaceFromField(step)).To(Succeed())
+			hash, err := b.contextHash(step)
+			Expect(err).NotTo(HaveOccurred())
+
+			// without a previous image the cache is used
+			Expect(b.contentNoCache(step)).To(BeFalse())
+			generated, err := ioutil.ReadFile(b.uniqueDockerfile(step))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(generated)).To(Equal("FROM scratch\nLABEL habitus.context-hash=" + hash + "\n"))
+
+			Expect(b.replaceFromField(step)).To(Succeed())
+			fake.images["app"] = &docker.Image{Config: &docker.Config{Labels: map[string]string{contextHashLabel: hash}}}
+			Expect(b.contentNoCache(step)).To(BeFalse())
+
+			Expect(b.replaceFromField(step)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(workdir, "app"), []byte("v2"), 0644)).To(Succeed())
+			Expect(b.contentNoCache(step)).To(BeTrue())
+		})
+	})
+
+	Describe("image output", func() {
+		It("saves the step image to its output or the output folder", func() {
+			workdir, err := ioutil.TempDir("", "habitus-output")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(workdir)
+
+			conf := testConfig()
+			conf.Workdir = workdir
+			conf.OutputDir = "images"
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile_inline: FROM scratch
+      output: dist/app.tar
+    worker:
+      name: worker
+      dockerfile_inline: FROM scratch
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			b := &Builder{Conf: conf, Build: manifest, docker: &fakeDocker{}, UniqueID: "ci"}
+			app, _ := manifest.FindStepByLabel("app")
+			worker, _ := manifest.FindStepByLabel("worker")
+			Expect(b.outputPath(app)).To(Equal(filepath.Join(workdir, "dist", "app.tar")))
+			Expect(b.outputPath(worker)).To(Equal(filepath.Join(workdir, "images", "worker.tar")))
+
+			Expect(b.saveImage(app, b.outputPath(app))).To(Succeed())
+			content, err := ioutil.ReadFile(filepath.Join(workdir, "dist", "app.tar"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(content)).To(Equal("image app-ci"))
+		})
+	})
+
+	Describe("build info", func() {
+		It("writes the build result in the workdir", func() {
+			workdir, err := ioutil.TempDir("", "habitus-info")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(workdir)
+
+			conf := testConfig()
+			conf.Workdir = workdir
+			conf.WriteBuildInfo = "build-info.json"
+			b := &Builder{Conf: conf}
+			started := time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC)
+			err = b.writeBuildInfo(&BuildResult{
+				Status:   BuildSucceeded,
+				Started:  started,
+				Finished: started.Add(time.Minute),
+				Duration: time.Minute,
+				Steps:    []StepSummary{{Step: "app", Label: "app", Status: StepBuilt, ImageID: "sha256:abc"}},
+				GitSHA:   "1a2b3c4",
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			data, err := ioutil.ReadFile(filepath.Join(workdir, "build-info.json"))
+			Expect(err).NotTo(HaveOccurred())
+			var info map[string]interface{}
+			Expect(json.Unmarshal(data, &info)).To(Succeed())
+			Expect(info["git_sha"]).To(Equal("1a2b3c4"))
+			Expect(info["started"]).To(Equal("2017-03-01T10:00:00Z"))
+			Expect(info["finished"]).To(Equal("2017-03-01T10:01:00Z"))
+			Expect(info["steps"]).To(HaveLen(1))
+			Expect(info["steps"].([]interface{})[0].(map[string]interface{})["image_id"]).To(Equal("sha256:abc"))
+		})
+	})
+
+	Describe("labels", func() {
+		It("adds global and step labels as one LABEL instruction", func() {
+			conf := testConfig()
+			Expect(conf.Labels.Set("org.opencontainers.image.revision=abc123")).To(Succeed())
+			Expect(conf.Labels.Set("team=build")).To(Succeed())
+
+			b := &Builder{Conf: conf}
+			step := &Step{Name: "app", Labels: map[string]string{"team": "web", "description": `say "hi"`}}
+
+			Expect(b.labelInstructions(step)).To(Equal(
+				`LABEL "description"="say \"hi\"" "org.opencontainers.image.revision"="abc123" "team"="web"` + "\n"))
+			Expect(b.labelInstructions(&Step{Name: "plain"})).To(ContainSubstring(`"team"="build"`))
+		})
+	})
+})
@@ -0,0 +1,103 @@
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cloud66/habitus/configuration"
+)
+
+const buildfileFetchTimeout = 30 * time.Second
+
+func isBuildfileURL(buildfile string) bool {
+	return strings.HasPrefix(buildfile, "http://") || strings.HasPrefix(buildfile, "https://")
+}
+
+// reads a build file from disk or fetches it when it is an http(s) URL.
+// BuildfileAuth is sent as the Authorization header of the request when the
+// URL is on the host of the main build file, so includes can't leak it
+func readBuildfile(config *configuration.Config, buildfile string) ([]byte, error) {
+	if !isBuildfileURL(buildfile) {
+		return ioutil.ReadFile(buildfile)
+	}
+
+	req, err := http.NewRequest("GET", buildfile, nil)
+	if err != nil {
+		return nil, err
+	}
+	if config.BuildfileAuth != "" && sameOrigin(config.Buildfile, buildfile) {
+		req.Header.Set("Authorization", config.BuildfileAuth)
+	}
+
+	client := &http.Client{Timeout: buildfileFetchTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch build file: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch build file %s: %s", buildfile, resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// true when both URLs have the same scheme and host
+func sameOrigin(a string, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(ua.Scheme, ub.Scheme) && strings.EqualFold(ua.Host, ub.Host)
+}
+
+// resolves an included build file relative to the build file including it
+func resolveInclude(buildfile string, include string) (string, error) {
+	if isBuildfileURL(include) {
+		return include, nil
+	}
+
+	if isBuildfileURL(buildfile) {
+		base, err := url.Parse(buildfile)
+		if err != nil {
+			return "", err
+		}
+		ref, err := url.Parse(include)
+		if err != nil {
+			return "", err
+		}
+		return base.ResolveReference(ref).String(), nil
+	}
+
+	if filepath.IsAbs(include) {
+		return include, nil
+	}
+
+	return filepath.Join(filepath.Dir(buildfile), include), nil
+}
+
+// returns the name of the build file used to find its format. For URLs this is the path
+// without the query string
+func buildfileName(buildfile string) string {
+	if !isBuildfileURL(buildfile) {
+		return buildfile
+	}
+
+	u, err := url.Parse(buildfile)
+	if err != nil {
+		return buildfile
+	}
+
+	return u.Path
+}
@@ -0,0 +1,44 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// the build info file. Relative paths are in the workdir
+func (b *Builder) buildInfoPath() string {
+	if filepath.IsAbs(b.Conf.WriteBuildInfo) {
+		return b.Conf.WriteBuildInfo
+	}
+
+	return filepath.Join(b.Conf.Workdir, b.Conf.WriteBuildInfo)
+}
+
+// writes the build result as JSON for the tools using the build. The git SHA of
+// the workdir is added when the images aren't tagged with it
+func (b *Builder) writeBuildInfo(result *BuildResult) error {
+	if result == nil {
+		return nil
+	}
+
+	info := *result
+	if info.GitSHA == "" {
+		if sha, err := gitShortSHA(b.Conf.Workdir); err == nil {
+			info.GitSHA = sha
+		}
+	}
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	b.Conf.Logger.Debugf("Writing the build info to %s", b.buildInfoPath())
+	if err := ioutil.WriteFile(b.buildInfoPath(), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write the build info: %s", err.Error())
+	}
+
+	return nil
+}
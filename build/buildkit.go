@@ -0,0 +1,131 @@
+package build
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// the vendored docker client can't set the build platform, network mode or cache images
+// so steps which use them are built with BuildKit
+func (b *Builder) useBuildKit(step *Step) bool {
+	return b.Conf.UseBuildKit || step.Platform != "" || step.NetworkMode != "" || len(step.CacheFrom) > 0
+}
+
+// pulls the cache images of a step. A missing cache image only makes the build slower
+// so failures are logged and the build carries on
+func (b *Builder) pullCacheImages(step *Step) {
+	for _, image := range step.CacheFrom {
+		repo, tag := splitImageTag(image)
+		if tag == "" {
+			tag = "latest"
+		}
+
+		b.Conf.Logger.Noticef("Pulling cache image %s:%s", repo, tag)
+		err := b.docker.PullImage(docker.PullImageOptions{
+			Context:      b.context(),
+			Repository:   repo,
+			Tag:          tag,
+			OutputStream: b.stepOutput(step),
+		}, b.registryAuth(registryFromRepo(repo)))
+		if err != nil {
+			b.Conf.Logger.Warningf("Failed to pull cache image %s:%s: %s", repo, tag, err.Error())
+		}
+	}
+}
+
+// builds the step image with BuildKit through the docker CLI, as go-dockerclient
+// doesn't support the session based BuildKit API. this needs the docker CLI on the path.
+// the CLI uses its own registry credentials from the docker config
+func (b *Builder) buildWithBuildKit(step *Step, buildArgs []docker.BuildArg, noCache bool) error {
+	// BuildKit doesn't limit the resources of RUN instructions. The step container still is
+	if step.Memory > 0 || step.CPUs > 0 {
+		b.Conf.Logger.Warningf("The memory and cpus limits of step %s are not applied to its BuildKit build", step.Name)
+	}
+
+	// secrets are available to RUN --mount=type=secret and never stored in the image
+	secretsDir := ""
+	if len(step.Secrets) > 0 {
+		var err error
+		secretsDir, err = b.writeStepSecrets(step)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(secretsDir)
+	}
+
+	cmd := b.buildKitCommand(step, buildArgs, noCache, secretsDir)
+	cmd.Stdout = b.stepOutput(step)
+	cmd.Stderr = b.stepErrors(step)
+
+	return cmd.Run()
+}
+
+// the docker CLI command building a step with BuildKit. The build args from the
+// environment only have their name on the command line. The CLI reads their value
+// from its environment so it can't be seen in the process list
+func (b *Builder) buildKitCommand(step *Step, buildArgs []docker.BuildArg, noCache bool, secretsDir string) *exec.Cmd {
+	args := []string{"build", "-t", b.uniqueStepName(step), "-f", b.uniqueDockerfile(step)}
+	if step.Platform != "" {
+		args = append(args, "--platform", step.Platform)
+	}
+	if step.NetworkMode != "" {
+		args = append(args, "--network", step.NetworkMode)
+	}
+	if noCache {
+		args = append(args, "--no-cache")
+	}
+	if b.Conf.SuppressOutput {
+		args = append(args, "--quiet")
+	}
+	if !b.Conf.RmTmpContainers {
+		args = append(args, "--rm=false")
+	}
+	if b.Conf.ForceRmTmpContainer {
+		args = append(args, "--force-rm")
+	}
+	for _, image := range step.CacheFrom {
+		args = append(args, "--cache-from", image)
+	}
+	// keep the cache metadata in pushed images so they can be used with cache_from
+	if step.Push != nil {
+		args = append(args, "--build-arg", "BUILDKIT_INLINE_CACHE=1")
+	}
+
+	env := append(os.Environ(), "DOCKER_BUILDKIT=1")
+	for _, arg := range buildArgs {
+		if stringInSlice(arg.Name, b.envBuildArgs()) {
+			args = append(args, "--build-arg", arg.Name)
+			env = append(env, arg.Name+"="+arg.Value)
+			continue
+		}
+		args = append(args, "--build-arg", arg.Name+"="+arg.Value)
+	}
+
+	for _, secret := range step.Secrets {
+		args = append(args, "--secret", "id="+secret.Name+",src="+filepath.Join(secretsDir, secret.Name))
+	}
+
+	args = append(args, step.contextDir(b.Conf.Workdir))
+
+	b.Conf.Logger.Debugf("Running docker %s", args)
+	cmd := exec.CommandContext(b.context(), "docker", args...)
+	if b.Conf.DockerHost != "" {
+		env = append(env, "DOCKER_HOST="+b.Conf.DockerHost)
+	}
+	// like the client, the daemon certificate is only verified without tls-skip-verify.
+	// The later values win over the ones from the habitus environment
+	if b.Conf.UseTLS && b.Conf.DockerCert != "" {
+		env = append(env, "DOCKER_CERT_PATH="+b.Conf.DockerCert)
+		if b.Conf.InsecureSkipVerify {
+			env = append(env, "DOCKER_TLS=1", "DOCKER_TLS_VERIFY=")
+		} else {
+			env = append(env, "DOCKER_TLS_VERIFY=1")
+		}
+	}
+	cmd.Env = env
+
+	return cmd
+}
@@ -0,0 +1,59 @@
+package build
+
+import (
+	"bytes"
+	"sort"
+)
+
+// the docker volume of a cache. It isn't unique to the builder session so the cache is
+// kept from one build to the next. Docker creates it the first time it's mounted
+func cacheVolume(name string) string {
+	return "habitus_cache_" + name
+}
+
+// the names of the caches of a step, sorted
+func (s *Step) cacheNames() []string {
+	var names []string
+	for name := range s.Caches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// bind mounts of the caches of a step container
+func (b *Builder) cacheBinds(step *Step) []string {
+	var binds []string
+	for _, name := range step.cacheNames() {
+		binds = append(binds, cacheVolume(name)+":"+step.Caches[name])
+	}
+
+	return binds
+}
+
+// adds a BuildKit cache mount of each step cache to the RUN instructions starting on
+// the given lines. Only the RUN keyword is followed by the mounts so the layout stays as it is
+func (b *Builder) addCacheMounts(step *Step, source []byte, runLines []int) []byte {
+	var mounts []byte
+	for _, name := range step.cacheNames() {
+		mounts = append(mounts, " --mount=type=cache,id="+cacheVolume(name)+",target="+step.Caches[name]...)
+	}
+
+	lines := bytes.SplitAfter(source, []byte("\n"))
+	for _, n := range runLines {
+		if n < 1 || n > len(lines) {
+			continue
+		}
+		loc := dockerfileWord.FindIndex(lines[n-1])
+		if loc == nil {
+			continue
+		}
+
+		line := append([]byte{}, lines[n-1][:loc[1]]...)
+		line = append(line, mounts...)
+		lines[n-1] = append(line, lines[n-1][loc[1]:]...)
+	}
+
+	return bytes.Join(lines, nil)
+}
@@ -0,0 +1,43 @@
+package build
+
+import (
+	"github.com/fsouza/go-dockerclient"
+)
+
+// DockerClient is the part of the docker API the builder uses. *docker.Client
+// implements it and a fake can be given to NewBuilderWithClient in tests
+type DockerClient interface {
+	Ping() error
+	Version() (*docker.Env, error)
+
+	BuildImage(opts docker.BuildImageOptions) error
+	InspectImage(name string) (*docker.Image, error)
+	ImageHistory(name string) ([]docker.ImageHistory, error)
+	TagImage(name string, opts docker.TagImageOptions) error
+	PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error
+	PushImage(opts docker.PushImageOptions, auth docker.AuthConfiguration) error
+	ExportImage(opts docker.ExportImageOptions) error
+	LoadImage(opts docker.LoadImageOptions) error
+	RemoveImageExtended(name string, opts docker.RemoveImageOptions) error
+
+	CreateContainer(opts docker.CreateContainerOptions) (*docker.Container, error)
+	StartContainer(id string, hostConfig *docker.HostConfig) error
+	StopContainer(id string, timeout uint) error
+	RemoveContainer(opts docker.RemoveContainerOptions) error
+	CommitContainer(opts docker.CommitContainerOptions) (*docker.Image, error)
+	DownloadFromContainer(id string, opts docker.DownloadFromContainerOptions) error
+
+	CreateExec(opts docker.CreateExecOptions) (*docker.Exec, error)
+	StartExec(id string, opts docker.StartExecOptions) error
+	InspectExec(id string) (*docker.ExecInspect, error)
+
+	CreateNetwork(opts docker.CreateNetworkOptions) (*docker.Network, error)
+	NetworkInfo(id string) (*docker.Network, error)
+	DisconnectNetwork(id string, opts docker.NetworkConnectionOptions) error
+	RemoveNetwork(id string) error
+
+	RemoveVolume(name string) error
+}
+
+// the go-dockerclient client is used as it is
+var _ DockerClient = (*docker.Client)(nil)
@@ -0,0 +1,91 @@
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloud66/habitus/configuration"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// a docker daemon running everything it's asked to and whose execs exit with exitCode
+func fakeDaemon(exitCode int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/version"):
+			fmt.Fprint(w, `{"ApiVersion":"1.24","Os":"linux","Arch":"amd64"}`)
+		case strings.HasSuffix(r.URL.Path, "/build"):
+			fmt.Fprint(w, `{"stream":"Successfully built 0123456789ab\n"}`)
+		case strings.HasSuffix(r.URL.Path, "/containers/create"):
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"Id":"container-1"}`)
+		case strings.HasSuffix(r.URL.Path, "/exec"):
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"Id":"exec-1"}`)
+		case strings.HasSuffix(r.URL.Path, "/exec/exec-1/start"):
+			// attached execs hijack the connection and stream the output on it
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			buf.WriteString("HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\n")
+			buf.Flush()
+			conn.Close()
+		case strings.HasSuffix(r.URL.Path, "/exec/exec-1/json"):
+			fmt.Fprintf(w, `{"ID":"exec-1","Running":false,"ExitCode":%d}`, exitCode)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+}
+
+var _ = Describe("Builder", func() {
+	Describe("step commands", func() {
+		var (
+			conf    *configuration.Config
+			workdir string
+			daemon  *httptest.Server
+		)
+
+		BeforeEach(func() {
+			var err error
+			workdir, err = ioutil.TempDir("", "habitus-workdir-")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(filepath.Join(workdir, "Dockerfile"), []byte("FROM scratch\n"), 0644)).To(Succeed())
+
+			daemon = fakeDaemon(1)
+			conf = testConfig()
+			conf.Workdir = workdir
+			conf.DockerHost = strings.Replace(daemon.URL, "http://", "tcp://", 1)
+		})
+
+		AfterEach(func() {
+			daemon.Close()
+			os.RemoveAll(workdir)
+		})
+
+		It("fails the build when the step command fails", func() {
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile: Dockerfile
+      command: "false"
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			b := NewBuilder(manifest, conf)
+			step, _ := manifest.FindStepByLabel("app")
+			Expect(b.BuildStep(step)).To(MatchError(ContainSubstring("command 'false'")))
+		})
+	})
+})
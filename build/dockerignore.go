@@ -0,0 +1,104 @@
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/fileutils"
+)
+
+// reads the exclude patterns from an ignore file the same way the docker CLI does:
+// blank lines and # comments are skipped, patterns are trimmed and cleaned and a leading /
+// is dropped. Negation patterns (!pattern) are kept as they are handled by the matcher
+func readDockerignore(file string) ([]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %s", filepath.Base(file), err.Error())
+	}
+
+	return parseDockerignore(bytes.NewReader(data))
+}
+
+// the ignore file of a step. A <Dockerfile>.dockerignore next to the step Dockerfile wins
+// over the .dockerignore of the step context, like with BuildKit
+func (b *Builder) dockerignoreFile(step *Step) string {
+	dir := step.contextDir(b.Conf.Workdir)
+	if step.Dockerfile != "" {
+		specific := filepath.Join(dir, step.Dockerfile) + ".dockerignore"
+		if _, err := os.Stat(specific); err == nil {
+			return specific
+		}
+	}
+
+	return filepath.Join(dir, ".dockerignore")
+}
+
+func parseDockerignore(r io.Reader) ([]string, error) {
+	var excludes []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		pattern := strings.TrimSpace(scanner.Text())
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+
+		negate := strings.HasPrefix(pattern, "!")
+		if negate {
+			pattern = strings.TrimSpace(pattern[1:])
+		}
+		if pattern != "" {
+			pattern = filepath.Clean(pattern)
+			pattern = strings.TrimPrefix(pattern, "/")
+		}
+		if negate {
+			pattern = "!" + pattern
+		}
+
+		excludes = append(excludes, pattern)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading .dockerignore: %s", err.Error())
+	}
+
+	return excludes, nil
+}
+
+// creates the context of a step build from its context folder excluding the files matched by its ignore
+// file. the Dockerfile and .dockerignore are always sent as the daemon needs them and removes them itself
+func (b *Builder) buildContext(step *Step) (io.ReadCloser, error) {
+	dir := step.contextDir(b.Conf.Workdir)
+	dockerfile := b.contextDockerfile(step)
+	excludes, err := readDockerignore(b.dockerignoreFile(step))
+	if err != nil {
+		return nil, err
+	}
+
+	includes := []string{"."}
+	for _, file := range []string{".dockerignore", dockerfile} {
+		excluded, err := fileutils.Matches(file, excludes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid .dockerignore: %s", err.Error())
+		}
+		if excluded {
+			includes = append(includes, file)
+		}
+	}
+
+	return archive.TarWithOptions(dir, &archive.TarOptions{
+		ExcludePatterns: excludes,
+		IncludeFiles:    includes,
+		Compression:     archive.Uncompressed,
+		NoLchown:        true,
+	})
+}
@@ -0,0 +1,111 @@
+package build
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Dockerignore", func() {
+	It("parses patterns like the docker CLI", func() {
+		excludes, err := parseDockerignore(strings.NewReader("# comment\n\n  /dist/  \r\n*.log\n! dist/keep\nsecrets/../secrets\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(excludes).To(Equal([]string{"dist", "*.log", "!dist/keep", "secrets"}))
+	})
+
+	It("excludes ignored files from the build context", func() {
+		dir, err := ioutil.TempDir("", "habitus-test-")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		for name, content := range map[string]string{
+			".dockerignore":        "*.log\ndist\n!dist/keep\nDockerfile*\n",
+			"Dockerfile.generated": "FROM scratch\n",
+			"app.go":               "package main\n",
+			"build.log":            "log\n",
+			"dist/binary":          "bin\n",
+			"dist/keep":            "keep\n",
+		} {
+			path := filepath.Join(dir, name)
+			Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(path, []byte(content), 0644)).To(Succeed())
+		}
+
+		conf := testConfig()
+		conf.Workdir = dir
+		b := &Builder{Conf: conf}
+
+		context, err := b.buildContext(&Step{Label: "app", Dockerfile: "Dockerfile"})
+		Expect(err).NotTo(HaveOccurred())
+		defer context.Close()
+
+		var files []string
+		tr := tar.NewReader(context)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			Expect(err).NotTo(HaveOccurred())
+			if h.Typeflag != tar.TypeDir {
+				files = append(files, strings.TrimPrefix(h.Name, "./"))
+			}
+		}
+
+		Expect(files).To(ConsistOf(".dockerignore", "Dockerfile.generated", "app.go", "dist/keep"))
+	})
+
+	It("uses the ignore file of the step context or Dockerfile", func() {
+		dir, err := ioutil.TempDir("", "habitus-test-")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		for name, content := range map[string]string{
+			".dockerignore":                         "frontend\n",
+			"frontend/.dockerignore":                "node_modules\n",
+			"frontend/app.js":                       "app\n",
+			"frontend/node_modules/dep.js":          "dep\n",
+			"frontend/Dockerfile.generated":         "FROM node\n",
+			"frontend/test.Dockerfile.dockerignore": "*.js\n",
+		} {
+			path := filepath.Join(dir, name)
+			Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(path, []byte(content), 0644)).To(Succeed())
+		}
+
+		conf := testConfig()
+		conf.Workdir = dir
+		b := &Builder{Conf: conf}
+
+		contextFiles := func(step *Step) []string {
+			context, err := b.buildContext(step)
+			Expect(err).NotTo(HaveOccurred())
+			defer context.Close()
+
+			var files []string
+			tr := tar.NewReader(context)
+			for {
+				h, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).NotTo(HaveOccurred())
+				if h.Typeflag != tar.TypeDir {
+					files = append(files, strings.TrimPrefix(h.Name, "./"))
+				}
+			}
+			return files
+		}
+
+		Expect(contextFiles(&Step{Label: "app", Context: "frontend", Dockerfile: "Dockerfile"})).To(ConsistOf(
+			".dockerignore", "Dockerfile.generated", "app.js", "test.Dockerfile.dockerignore"))
+		Expect(b.dockerignoreFile(&Step{Label: "test", Context: "frontend", Dockerfile: "test.Dockerfile"})).To(Equal(
+			filepath.Join(dir, "frontend", "test.Dockerfile.dockerignore")))
+	})
+})
@@ -0,0 +1,91 @@
+package build
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// StepError is returned by StartBuild when a step fails
+type StepError struct {
+	Step string
+	// exit code of the failed command in the step container or of the docker CLI.
+	// 0 when the failure wasn't a command
+	ExitCode int
+	Err      error
+}
+
+func (e *StepError) Error() string {
+	return fmt.Sprintf("build for step %s failed due to %s", e.Step, e.Err.Error())
+}
+
+// DockerError is returned by StartBuild when the docker daemon can't be reached
+type DockerError struct {
+	Err error
+}
+
+func (e *DockerError) Error() string {
+	return fmt.Sprintf("failed to connect to the docker daemon: %s", e.Err.Error())
+}
+
+// TimeoutError is returned by StartBuild when the build runs past the build timeout
+type TimeoutError struct {
+	Timeout time.Duration
+	// steps which were still building when the timeout fired
+	Steps []string
+}
+
+func (e *TimeoutError) Error() string {
+	if len(e.Steps) == 0 {
+		return fmt.Sprintf("the build timed out after %s", e.Timeout)
+	}
+
+	return fmt.Sprintf("the build timed out after %s while building %s", e.Timeout, strings.Join(e.Steps, ", "))
+}
+
+// CommandError is the failure of a command run in a step container
+type CommandError struct {
+	Command  string
+	ExitCode int
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("command '%s' exit with exit code %d", e.Command, e.ExitCode)
+}
+
+// wraps the failure of a step in a StepError or a DockerError for connection failures
+func stepError(step *Step, err error) error {
+	if isConnectionError(err) {
+		return &DockerError{Err: err}
+	}
+
+	stepErr := &StepError{Step: step.Name, Err: err}
+	switch e := err.(type) {
+	case *CommandError:
+		stepErr.ExitCode = e.ExitCode
+	case *exec.ExitError:
+		if status, ok := e.Sys().(syscall.WaitStatus); ok {
+			stepErr.ExitCode = status.ExitStatus()
+		}
+	}
+
+	return stepErr
+}
+
+func isConnectionError(err error) bool {
+	if err == docker.ErrConnectionRefused {
+		return true
+	}
+
+	if e, ok := err.(*url.Error); ok {
+		err = e.Err
+	}
+	_, ok := err.(*net.OpError)
+	return ok
+}
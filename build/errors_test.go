@@ -0,0 +1,36 @@
+package build
+
+import (
+	"errors"
+
+	"github.com/fsouza/go-dockerclient"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Errors", func() {
+	step := &Step{Name: "app"}
+
+	It("carries the step and the exit code of a failed command", func() {
+		err := stepError(step, &CommandError{Command: "make test", ExitCode: 4})
+
+		stepErr, ok := err.(*StepError)
+		Expect(ok).To(BeTrue())
+		Expect(stepErr.Step).To(Equal("app"))
+		Expect(stepErr.ExitCode).To(Equal(4))
+	})
+
+	It("has no exit code for other failures", func() {
+		err := stepError(step, errors.New("no such file"))
+
+		Expect(err.(*StepError).ExitCode).To(Equal(0))
+	})
+
+	It("reports connection failures as docker errors", func() {
+		err := stepError(step, docker.ErrConnectionRefused)
+
+		_, ok := err.(*DockerError)
+		Expect(ok).To(BeTrue())
+	})
+})
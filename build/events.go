@@ -0,0 +1,72 @@
+package build
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// types of build events
+const (
+	EventBuildStarted   = "build_started"
+	EventBuildFinished  = "build_finished"
+	EventStepStarted    = "step_started"
+	EventStepFinished   = "step_finished"
+	EventArtifactCopied = "artifact_copied"
+	EventCommandExited  = "command_exited"
+)
+
+// Event is a structured build event for tools following the build
+type Event struct {
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Step     string    `json:"step,omitempty"`
+	Command  string    `json:"command,omitempty"`
+	ExitCode *int      `json:"exit_code,omitempty"`
+	Artifact string    `json:"artifact,omitempty"`
+	Dest     string    `json:"dest,omitempty"`
+	Duration float64   `json:"duration,omitempty"` // seconds
+	Error    string    `json:"error,omitempty"`
+}
+
+// EventSink receives the build events. Emit is called from parallel steps
+type EventSink interface {
+	Emit(event Event)
+}
+
+type noopEventSink struct{}
+
+func (noopEventSink) Emit(event Event) {}
+
+// JSONEventSink writes each event as a line of JSON
+type JSONEventSink struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+// NewJSONEventSink creates an event sink writing to w
+func NewJSONEventSink(w io.Writer) *JSONEventSink {
+	return &JSONEventSink{w: w}
+}
+
+// Emit writes the event to the underlying writer
+func (s *JSONEventSink) Emit(event Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// events are best effort and should never fail the build
+	json.NewEncoder(s.w).Encode(event)
+}
+
+func (b *Builder) emit(event Event) {
+	event.Time = time.Now().UTC()
+	b.Events.Emit(event)
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
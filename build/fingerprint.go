@@ -0,0 +1,147 @@
+package build
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// image label holding the fingerprint of the build of a step image
+const fingerprintLabel = "habitus.fingerprint"
+
+// image label holding the hash of the context a step image was built from
+const contextHashLabel = "habitus.context-hash"
+
+// step cache mode using the build cache only when the context didn't change
+const cacheModeContent = "content"
+
+// the fingerprint of a step build. It covers the files of the step context, which has the
+// generated Dockerfile, the build args and the images of the steps the Dockerfile is FROM.
+// Base images are not part of it
+func (b *Builder) stepFingerprint(step *Step) (string, error) {
+	h := sha256.New()
+	if err := b.hashContext(step, h); err != nil {
+		return "", err
+	}
+
+	for _, arg := range b.buildArgs(step) {
+		fmt.Fprintf(h, "arg %s=%s\n", arg.Name, arg.Value)
+	}
+
+	parsed, err := b.parseDockerfile(step)
+	if err != nil {
+		return "", err
+	}
+	for _, r := range parsed.Rewrites {
+		image, err := b.docker.InspectImage(r.To)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "from %s=%s\n", r.To, image.ID)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashes the names, modes, links and content of the files of the step context as they are
+// sent to the daemon. Times aren't hashed so a checkout of the same files has the same hash.
+// The generated Dockerfiles of other steps in the same context are left out
+func (b *Builder) hashContext(step *Step, h io.Writer) error {
+	context, err := b.buildContext(step)
+	if err != nil {
+		return err
+	}
+	defer context.Close()
+
+	dockerfile := b.contextDockerfile(step)
+	tr := tar.NewReader(context)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(hdr.Name, ".generated") && hdr.Name != dockerfile {
+			continue
+		}
+
+		fmt.Fprintf(h, "%s %o %s %d\n", hdr.Name, hdr.Mode, hdr.Linkname, hdr.Size)
+		if _, err := io.Copy(h, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// the hash of the files of the step context
+func (b *Builder) contextHash(step *Step) (string, error) {
+	h := sha256.New()
+	if err := b.hashContext(step, h); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// the value of a label of the current step image. ok is false without an image
+func (b *Builder) stepImageLabel(step *Step, label string) (string, bool) {
+	image, err := b.docker.InspectImage(b.uniqueStepName(step))
+	if err != nil {
+		return "", false
+	}
+	if image.Config == nil {
+		return "", true
+	}
+
+	return image.Config.Labels[label], true
+}
+
+// is the step image there with the fingerprint of this build
+func (b *Builder) upToDate(step *Step, fingerprint string) bool {
+	previous, ok := b.stepImageLabel(step, fingerprintLabel)
+	return ok && previous == fingerprint
+}
+
+// with the content cache mode, the build cache isn't used when the step context changed
+// since the current step image was built. The hash is added to the image as a label
+func (b *Builder) contentNoCache(step *Step) (bool, error) {
+	if step.CacheMode != cacheModeContent {
+		return false, nil
+	}
+
+	hash, err := b.contextHash(step)
+	if err != nil {
+		return false, err
+	}
+	if err := b.addLabel(step, contextHashLabel, hash); err != nil {
+		return false, err
+	}
+
+	previous, ok := b.stepImageLabel(step, contextHashLabel)
+	if ok && previous != hash {
+		b.Conf.Logger.Noticef("Building %s without the cache as its context changed", step.Name)
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// adds a label to the generated Dockerfile of the step. It's the last
+// instruction so only the last layer changes with it
+func (b *Builder) addLabel(step *Step, label string, value string) error {
+	generated, err := ioutil.ReadFile(b.uniqueDockerfile(step))
+	if err != nil {
+		return err
+	}
+	if len(generated) > 0 && generated[len(generated)-1] != '\n' {
+		generated = append(generated, '\n')
+	}
+	generated = append(generated, "LABEL "+label+"="+value+"\n"...)
+
+	return ioutil.WriteFile(b.uniqueDockerfile(step), generated, 0644)
+}
@@ -0,0 +1,52 @@
+package build
+
+import (
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/dchest/uniuri"
+)
+
+var invalidUniqueIDChars = regexp.MustCompile("[^a-z0-9_.-]+")
+
+// runs a git command in the given folder and returns its trimmed output
+func git(workdir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = workdir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// returns the short SHA of the HEAD commit in workdir
+func gitShortSHA(workdir string) (string, error) {
+	return git(workdir, "rev-parse", "--short", "HEAD")
+}
+
+// UniqueIDFromGit builds a unique id from the git branch and short commit SHA
+// of workdir, sanitized to be usable in an image name. It falls back to a
+// random id when workdir is not a git repository
+func UniqueIDFromGit(workdir string) string {
+	sha, err := gitShortSHA(workdir)
+	if err != nil {
+		return strings.ToLower(uniuri.New())
+	}
+
+	id := sha
+	// detached heads report HEAD as the branch
+	if branch, err := git(workdir, "rev-parse", "--abbrev-ref", "HEAD"); err == nil && branch != "HEAD" {
+		id = branch + "-" + sha
+	}
+
+	id = invalidUniqueIDChars.ReplaceAllString(strings.ToLower(id), "-")
+	id = strings.Trim(id, ".-")
+	if len(id) > 64 {
+		id = id[len(id)-64:]
+	}
+
+	return id
+}
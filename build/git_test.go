@@ -0,0 +1,58 @@
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Unique IDs from git", func() {
+	var dir string
+
+	run := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=habitus", "-c", "user.email=habitus@example.com"}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		Expect(err).NotTo(HaveOccurred(), string(out))
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "habitus-git-")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("uses the sanitized branch and the short commit SHA", func() {
+		run("init", "-q")
+		run("checkout", "-q", "-b", "Feature/Login_Page")
+		run("commit", "-q", "--allow-empty", "-m", "first")
+		sha, err := gitShortSHA(dir)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(UniqueIDFromGit(dir)).To(Equal("feature-login_page-" + sha))
+	})
+
+	It("uses the short commit SHA only on a detached head", func() {
+		run("init", "-q")
+		run("commit", "-q", "--allow-empty", "-m", "first")
+		run("checkout", "-q", "--detach")
+		sha, err := gitShortSHA(dir)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(UniqueIDFromGit(dir)).To(Equal(sha))
+	})
+
+	It("falls back to a random ID outside a git repository", func() {
+		id := UniqueIDFromGit(dir)
+		Expect(id).NotTo(BeEmpty())
+		Expect(id).To(MatchRegexp("^[a-z0-9]+$"))
+		Expect(UniqueIDFromGit(dir)).NotTo(Equal(id))
+	})
+})
@@ -0,0 +1,90 @@
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// ToDOT renders the step dependency graph in Graphviz DOT format. Nodes are the steps
+// labeled with their name and build level and edges go from a dependency to the step
+// depending on it. depends_on edges are solid and FROM references found in the
+// Dockerfiles under workdir are dashed. Unreadable Dockerfiles are skipped
+func (m *Manifest) ToDOT(workdir string) string {
+	var out bytes.Buffer
+	out.WriteString("digraph habitus {\n")
+	out.WriteString("  rankdir=LR;\n")
+	out.WriteString("  node [shape=box];\n")
+
+	for idx, level := range m.buildLevels {
+		labels := make([]string, 0, len(level))
+		for _, step := range level {
+			labels = append(labels, step.Label)
+		}
+		sort.Strings(labels)
+
+		fmt.Fprintf(&out, "  subgraph level_%d {\n", idx)
+		out.WriteString("    rank=same;\n")
+		for _, label := range labels {
+			step, _ := m.FindStepByLabel(label)
+			fmt.Fprintf(&out, "    %s [label=%s];\n", strconv.Quote(label), strconv.Quote(fmt.Sprintf("%s\nlevel %d", step.Name, idx)))
+		}
+		out.WriteString("  }\n")
+	}
+
+	labels := make([]string, 0, len(m.Steps))
+	for _, step := range m.Steps {
+		labels = append(labels, step.Label)
+	}
+	sort.Strings(labels)
+
+	for _, label := range labels {
+		step, _ := m.FindStepByLabel(label)
+
+		dependencies := make(map[string]bool)
+		for _, d := range step.DependsOn {
+			dependencies[d.Label] = true
+			fmt.Fprintf(&out, "  %s -> %s;\n", strconv.Quote(d.Label), strconv.Quote(label))
+		}
+
+		froms, err := dockerfileFroms(step, workdir)
+		if err != nil {
+			continue
+		}
+		for _, from := range froms {
+			found, _ := m.FindStepByImage(from, step)
+			if found == nil || dependencies[found.Label] {
+				continue
+			}
+			dependencies[found.Label] = true
+			fmt.Fprintf(&out, "  %s -> %s [style=dashed, label=\"FROM\"];\n", strconv.Quote(found.Label), strconv.Quote(label))
+		}
+	}
+
+	out.WriteString("}\n")
+	return out.String()
+}
+
+// returns the images of the FROM instructions of the Dockerfile of a step
+func dockerfileFroms(step *Step, workdir string) ([]string, error) {
+	f, err := step.openDockerfile(workdir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	node, _, err := parseDockerfileSource(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var froms []string
+	for _, child := range node.Children {
+		if child.Value == "from" && child.Next != nil {
+			froms = append(froms, child.Next.Value)
+		}
+	}
+
+	return froms, nil
+}
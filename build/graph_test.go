@@ -0,0 +1,33 @@
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Graph", func() {
+	It("renders depends_on and FROM edges with the build levels", func() {
+		dir, err := ioutil.TempDir("", "habitus-test-")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		Expect(ioutil.WriteFile(filepath.Join(dir, "Dockerfile.app"), []byte("FROM base\nRUN make\n"), 0644)).To(Succeed())
+
+		manifest, err := loadManifest(testConfig(), diamondManifest)
+		Expect(err).NotTo(HaveOccurred())
+
+		// app uses base through FROM only, without depends_on
+		manifest.Steps = append(manifest.Steps, Step{Name: "app", Label: "app", Dockerfile: "Dockerfile.app"})
+		dot := manifest.ToDOT(dir)
+
+		Expect(dot).To(HavePrefix("digraph habitus {\n"))
+		Expect(dot).To(ContainSubstring(`"base" [label="base\nlevel 0"];`))
+		Expect(dot).To(ContainSubstring(`"final" [label="final\nlevel 2"];`))
+		Expect(dot).To(ContainSubstring(`"left" -> "final";`))
+		Expect(dot).To(ContainSubstring(`"right" -> "final";`))
+		Expect(dot).To(ContainSubstring(`"base" -> "app" [style=dashed, label="FROM"];`))
+	})
+})
@@ -0,0 +1,47 @@
+package build
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// runs a host command of a step with /bin/sh in the workdir. A non zero exit is a
+// CommandError. The step and its image are given to the command as environment variables
+func (b *Builder) runHostCommand(step *Step, hook string, command string, env []string) error {
+	b.Conf.Logger.Noticef("Running %s command '%s' of step %s", hook, command, step.Name)
+
+	cmd := exec.CommandContext(b.context(), "/bin/sh", "-c", command)
+	cmd.Dir = b.Conf.Workdir
+	cmd.Env = append(os.Environ(),
+		"HABITUS_STEP="+step.Name,
+		"HABITUS_STEP_LABEL="+step.Label,
+		"HABITUS_IMAGE="+b.uniqueStepName(step),
+	)
+	cmd.Env = append(cmd.Env, env...)
+	cmd.Stdout = b.stepOutput(step)
+	cmd.Stderr = b.stepErrors(step)
+
+	err := cmd.Run()
+	if e, ok := err.(*exec.ExitError); ok {
+		if status, ok := e.Sys().(syscall.WaitStatus); ok {
+			return &CommandError{Command: command, ExitCode: status.ExitStatus()}
+		}
+	}
+
+	return err
+}
+
+// runs the post build command of a step once its image and artifacts are ready. The
+// host paths of the artifacts are in HABITUS_ARTIFACTS, separated like PATH
+func (b *Builder) runPostBuild(step *Step, artifacts []CopiedArtifact) error {
+	var paths []string
+	for _, a := range artifacts {
+		paths = append(paths, a.Dest)
+	}
+
+	return b.runHostCommand(step, "post build", step.PostBuild, []string{
+		"HABITUS_ARTIFACTS=" + strings.Join(paths, string(os.PathListSeparator)),
+	})
+}
@@ -0,0 +1,58 @@
+package build
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// container ids and the host ids they map to, like a line of /proc/<pid>/uid_map
+type idRange struct {
+	container int
+	host      int
+	size      int
+}
+
+// parses comma separated container:host:size ranges, as configured for the user
+// namespace of the daemon in /etc/subuid or with userns-remap
+func parseIDMap(value string) ([]idRange, error) {
+	var ranges []idRange
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid id map '%s'. Use container:host:size", entry)
+		}
+
+		var ids [3]int
+		for i, part := range parts {
+			id, err := strconv.Atoi(part)
+			if err != nil || id < 0 {
+				return nil, fmt.Errorf("invalid id map '%s'. The ids and the size should be positive numbers", entry)
+			}
+			ids[i] = id
+		}
+		if ids[2] == 0 {
+			return nil, fmt.Errorf("invalid id map '%s'. The size should be above 0", entry)
+		}
+
+		ranges = append(ranges, idRange{container: ids[0], host: ids[1], size: ids[2]})
+	}
+
+	return ranges, nil
+}
+
+// the host id of a container id. Ids outside of the mapped ranges are kept
+func mapID(ranges []idRange, id int) int {
+	for _, r := range ranges {
+		if id >= r.container && id < r.container+r.size {
+			return id - r.container + r.host
+		}
+	}
+
+	return id
+}
@@ -1,33 +1,61 @@
 package build
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 
 	"github.com/cloud66/habitus/configuration"
 	"github.com/cloud66/habitus/secrets"
+	"github.com/docker/go-units"
 
 	"gopkg.in/yaml.v2"
 )
 
 var (
-	validTypes = []string{"file"}
+	validTypes = []string{"file", "env"}
 )
 
+const defaultShell = "/bin/bash"
+
+// the dockerfile of a step read with ReadDockerfileInput, usually from stdin
+const stdinDockerfile = "-"
+
 // Artifact holds a parsed source for a build artifact
 type Artifact struct {
 	Step   Step
 	Source string
-	Dest   string // this is only the folder. Filename comes from the source
+	Dest   string // this is only the folder. Filename comes from the source or As
+	// host command to run after the artifact is copied. {{.Path}} and {{.Step}} are replaced
+	// with the host path of the artifact and the step name
+	PostCopy string
+	// docker volume the artifact is copied to instead of the host. Dest is then the
+	// folder in the volume. Steps depending on this one mount the volume
+	Volume string
+	// keep the artifact as an archive in Dest instead of extracting it. Only tar.gz is supported
+	Archive string
+	// expected sha256 of the file copied to the host, in hex
+	SHA256 string
+	// a missing source is skipped with a warning instead of failing the step
+	Optional bool
+	// file name of the artifact in Dest instead of the source name
+	As string
+	// the glob of the step artifact this one matched. Empty for the artifacts of the build file
+	glob string
 }
 
 // Cleanup holds everything that's needed for a cleanup
 type Cleanup struct {
-	Commands []string
+	Commands     []string
+	IgnoreErrors bool // don't fail the build when a cleanup command exits with non-zero
+	SingleShell  bool // run the commands joined with && in one shell so they share its state
 }
 
 // holds a single secret
@@ -43,12 +71,78 @@ type Step struct {
 	Name       string
 	Label      string
 	Dockerfile string
-	Artifacts  []Artifact
-	Manifest   Manifest
-	Cleanup    *Cleanup
-	DependsOn  []*Step
-	Command    string
-	Secrets    []Secret
+	// Dockerfile content given in the build file instead of Dockerfile
+	DockerfileInline string
+	Artifacts        []Artifact
+	Manifest         Manifest
+	Cleanup          *Cleanup
+	DependsOn        []*Step
+	Command          string
+	Secrets          []Secret
+	// image removal options used when cleaning up this step's image at the end of the build
+	ForceRmImages   bool
+	NoPruneRmImages bool
+	Push            *Push
+	// shell used to keep the step container running and to run cleanup commands in it
+	Shell string
+	// build args scoped to the dependencies of this step, in depends_on order
+	EdgeArgs []EdgeArgs
+	// build args of this step. they override global and edge build args
+	Args map[string]string
+	// don't copy the owner of artifacts from the container. The owner is only copied when running as root
+	IgnoreOwnership bool
+	// target platform of the image, like linux/amd64. empty uses the daemon platform. The step
+	// container runs on the daemon platform, so steps with one need a daemon of that platform
+	Platform string
+	// network used by RUN instructions and the step container. empty keeps the docker default (bridge)
+	NetworkMode string
+	// images used as a build cache. they are pulled before the build
+	CacheFrom []string
+	// environment variables of the cleanup commands and the step command
+	Env map[string]string
+	// squash the step image into a single layer. set by default for steps with cleanup commands
+	Squash bool
+	// where the squash starts: root, a step label or name whose image layers are kept or a layer ID
+	SquashFrom string
+	// extra tags of the step image, without the unique ID
+	Tags []string
+	// labels of the step image. they override the global labels
+	Labels map[string]string
+	// other image names the step can be referred to by in FROM
+	Aliases []string
+	// build context folder, relative to the workdir. Dockerfile is relative to it. Empty uses the workdir
+	Context string
+	// command run on the host once the step image and artifacts are ready
+	PostBuild string
+	// command run on the host before the step image is built
+	PreBuild string
+	// memory limit in bytes and number of CPUs of the build and the step container. 0 is no limit
+	Memory int64
+	CPUs   float64
+	// host folders mounted in the step container as host:container[:ro]. Relative host paths are in the workdir
+	Volumes []string
+	// content only uses the build cache when the context didn't change since the last build
+	CacheMode string
+	// tar file the step image is saved to once it's built. Relative to the workdir
+	Output string
+	// caches kept from one build to the next, keyed by name with the path they are mounted on.
+	// They are in the step container and, with BuildKit, mounted on the RUN instructions
+	Caches map[string]string
+}
+
+// EdgeArgs holds the build args a step gets from its dependency on another step.
+// Build args are resolved in this order, later ones overriding earlier ones:
+// global build args, the args of each dependency edge, in the order
+// the dependencies are listed in depends_on, and the args of the step itself
+type EdgeArgs struct {
+	Dependency string // label or name of the dependency, as in depends_on
+	Args       map[string]string
+}
+
+// Push holds the registry settings used to push a step's image after it is built
+type Push struct {
+	Registry string
+	Tag      string
 }
 
 // Manifest Holds the whole build process
@@ -58,10 +152,58 @@ type Manifest struct {
 	SecretProviders map[string]secrets.SecretProvider
 
 	buildLevels [][]Step
+	stepLines   map[string]int // line of each step (by label) in the build file
 }
 
 type cleanup struct {
-	Commands []string `yaml:"commands"`
+	Commands     []string `yaml:"commands"`
+	IgnoreErrors bool     `yaml:"ignore_errors"`
+	SingleShell  bool     `yaml:"single_shell"`
+}
+
+// artifacts can be a short "source:dest" string or a map
+type artifact struct {
+	Source   artifactSources `yaml:"source"`
+	Dest     string          `yaml:"dest"`
+	PostCopy string          `yaml:"post_copy"`
+	Volume   string          `yaml:"volume"`
+	Archive  string          `yaml:"archive"`
+	SHA256   string          `yaml:"sha256"`
+	Optional bool            `yaml:"optional"`
+	As       string          `yaml:"as"`
+}
+
+func (a *artifact) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var short string
+	if err := unmarshal(&short); err == nil {
+		parts := strings.Split(short, ":")
+		a.Source = artifactSources{parts[0]}
+		if len(parts) > 1 {
+			a.Dest = parts[1]
+		}
+		return nil
+	}
+
+	type plain artifact
+	return unmarshal((*plain)(a))
+}
+
+// the source of an artifact is a path or a list of paths copied to the same dest
+type artifactSources []string
+
+func (s *artifactSources) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+	if err := unmarshal(&single); err == nil {
+		*s = artifactSources{single}
+		return nil
+	}
+
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*s = list
+	return nil
 }
 
 type secret struct {
@@ -71,13 +213,43 @@ type secret struct {
 
 // Private structs. They are used to load from yaml
 type step struct {
-	Name       string            `yaml:"name"`
-	Dockerfile string            `yaml:"dockerfile"`
-	Artifacts  []string          `yaml:"artifacts"`
-	Cleanup    *cleanup          `yaml:"cleanup"`
-	DependsOn  []string          `yaml:"depends_on"`
-	Command    string            `yaml:"command"`
-	Secrets    map[string]secret `yaml:"secrets"`
+	Name             string            `yaml:"name"`
+	Dockerfile       string            `yaml:"dockerfile"`
+	DockerfileInline string            `yaml:"dockerfile_inline"`
+	Context          string            `yaml:"context"`
+	PreBuild         string            `yaml:"pre_build"`
+	PostBuild        string            `yaml:"post_build"`
+	Artifacts        []artifact        `yaml:"artifacts"`
+	Cleanup          *cleanup          `yaml:"cleanup"`
+	DependsOn        []string          `yaml:"depends_on"`
+	Command          string            `yaml:"command"`
+	Secrets          map[string]secret `yaml:"secrets"`
+	// nil means use the global flags
+	ForceRmImages   *bool  `yaml:"force_rmi"`
+	NoPruneRmImages *bool  `yaml:"noprune_rmi"`
+	Push            bool   `yaml:"push"`
+	PushRegistry    string `yaml:"push_registry"`
+	PushTag         string `yaml:"push_tag"`
+	Shell           string `yaml:"shell"`
+	// build args keyed by the label of a step in depends_on
+	DependsOnArgs   map[string]map[string]string `yaml:"depends_on_args"`
+	IgnoreOwnership bool                         `yaml:"ignore_ownership"`
+	Args            map[string]string            `yaml:"args"`
+	Platform        string                       `yaml:"platform"`
+	NetworkMode     string                       `yaml:"network_mode"`
+	CacheFrom       []string                     `yaml:"cache_from"`
+	Env             map[string]string            `yaml:"env"`
+	Squash          *bool                        `yaml:"squash"`
+	SquashFrom      string                       `yaml:"squash_from"`
+	Tags            []string                     `yaml:"tags"`
+	Labels          map[string]string            `yaml:"labels"`
+	Aliases         []string                     `yaml:"aliases"`
+	Memory          string                       `yaml:"memory"`
+	CPUs            float64                      `yaml:"cpus"`
+	Volumes         []string                     `yaml:"volumes"`
+	Caches          map[string]string            `yaml:"caches"`
+	CacheMode       string                       `yaml:"cache_mode"`
+	Output          string                       `yaml:"output"`
 }
 
 // This is loaded from the build.yml file
@@ -90,24 +262,26 @@ type build struct {
 // Habitus build namespace
 type namespace struct {
 	BuildConfig build `yaml:"build"`
-	Config      *configuration.Config
+	// build files whose steps are added to this one, relative to this file
+	Include []string `yaml:"include"`
+	Config  *configuration.Config
 }
 
-// LoadBuildFromFile loads Build from a yaml file
+// LoadBuildFromFile loads Build from a yaml file. The file can be an http(s) URL
 func LoadBuildFromFile(config *configuration.Config) (*Manifest, error) {
 	config.Logger.Noticef("Using '%s' as build file", config.Buildfile)
 
-	n := namespace{Config: config}
-
-	data, err := ioutil.ReadFile(config.Buildfile)
+	n, data, err := loadNamespace(config, config.Buildfile)
 	if err != nil {
 		return nil, err
 	}
 
-	data = parseForEnvVars(config, data)
-
-	err = yaml.Unmarshal([]byte(data), &n)
-	if err != nil {
+	// the steps of a build file are owned by the file defining them
+	stepFiles := make(map[string]string)
+	for label := range n.BuildConfig.Steps {
+		stepFiles[label] = config.Buildfile
+	}
+	if err := n.mergeIncludes(config.Buildfile, n.Include, stepFiles, []string{config.Buildfile}); err != nil {
 		return nil, err
 	}
 
@@ -117,7 +291,92 @@ func LoadBuildFromFile(config *configuration.Config) (*Manifest, error) {
 		return nil, errors.New("Invalid build schema version")
 	}
 
-	return n.convertToBuild(n.BuildConfig.Version)
+	m, err := n.convertToBuild(n.BuildConfig.Version)
+	if err != nil {
+		return nil, err
+	}
+	m.stepLines = findStepLines(data)
+
+	return m, nil
+}
+
+// reads, interpolates and parses a single build file
+func loadNamespace(config *configuration.Config, buildfile string) (*namespace, []byte, error) {
+	n := &namespace{Config: config}
+
+	data, err := readBuildfile(config, buildfile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err = parseForEnvVars(config, data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = unmarshalManifest(buildfileName(buildfile), data, n)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return n, data, nil
+}
+
+// adds the steps of the included build files, and the ones they include, to n.
+// a step label can only be defined once across all the files
+func (n *namespace) mergeIncludes(buildfile string, includes []string, stepFiles map[string]string, chain []string) error {
+	for _, include := range includes {
+		includePath, err := resolveInclude(buildfile, include)
+		if err != nil {
+			return fmt.Errorf("invalid include %s in %s: %s", include, buildfile, err.Error())
+		}
+		if stringInSlice(includePath, chain) {
+			return fmt.Errorf("include cycle detected: %s -> %s", strings.Join(chain, " -> "), includePath)
+		}
+
+		n.Config.Logger.Debugf("Including '%s'", includePath)
+		included, _, err := loadNamespace(n.Config, includePath)
+		if err != nil {
+			return fmt.Errorf("failed to include %s: %s", includePath, err.Error())
+		}
+
+		for label, s := range included.BuildConfig.Steps {
+			if other, ok := stepFiles[label]; ok {
+				return fmt.Errorf("step %s in %s is already defined in %s", label, includePath, other)
+			}
+			stepFiles[label] = includePath
+
+			if n.BuildConfig.Steps == nil {
+				n.BuildConfig.Steps = make(map[string]step)
+			}
+			n.BuildConfig.Steps[label] = s
+		}
+
+		if err := n.mergeIncludes(includePath, included.Include, stepFiles, append(chain, includePath)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// build files are yaml unless they have a .json extension or look like JSON.
+// JSON is checked with the JSON parser first for clearer errors and then loaded
+// with the yaml parser like any other build file, since yaml is a superset of JSON
+func unmarshalManifest(filename string, data []byte, n *namespace) error {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext == ".toml" {
+		return errors.New("TOML build files are not supported. Use yaml or JSON")
+	}
+
+	if ext == ".json" || bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var js interface{}
+		if err := json.Unmarshal(data, &js); err != nil {
+			return fmt.Errorf("invalid JSON build file: %s", err.Error())
+		}
+	}
+
+	return yaml.Unmarshal(data, n)
 }
 
 func (n *namespace) convertToBuild(version string) (*Manifest, error) {
@@ -125,6 +384,7 @@ func (n *namespace) convertToBuild(version string) (*Manifest, error) {
 		SecretProviders: make(map[string]secrets.SecretProvider),
 	}
 	r.SecretProviders["file"] = &secrets.FileProvider{}
+	r.SecretProviders["env"] = &secrets.EnvProvider{}
 
 	r.IsPrivileged = false
 	r.Steps = []Step{}
@@ -134,16 +394,74 @@ func (n *namespace) convertToBuild(version string) (*Manifest, error) {
 
 		convertedStep.Manifest = r
 		convertedStep.Dockerfile = s.Dockerfile
+		convertedStep.DockerfileInline = s.DockerfileInline
+		convertedStep.Context = s.Context
+		convertedStep.PreBuild = s.PreBuild
+		convertedStep.PostBuild = s.PostBuild
 		convertedStep.Name = s.Name
 		convertedStep.Label = name
 		convertedStep.Artifacts = []Artifact{}
 		convertedStep.Command = s.Command
+		convertedStep.ForceRmImages = n.Config.FroceRmImages
+		if s.ForceRmImages != nil {
+			convertedStep.ForceRmImages = *s.ForceRmImages
+		}
+		convertedStep.NoPruneRmImages = n.Config.NoPruneRmImages
+		if s.NoPruneRmImages != nil {
+			convertedStep.NoPruneRmImages = *s.NoPruneRmImages
+		}
+		convertedStep.Args = s.Args
+		convertedStep.Env = s.Env
+		convertedStep.Tags = s.Tags
+		convertedStep.Labels = s.Labels
+		convertedStep.Aliases = s.Aliases
+		if s.Memory != "" {
+			memory, err := units.RAMInBytes(s.Memory)
+			if err != nil {
+				return nil, fmt.Errorf("Step '%s' has an invalid memory limit: %s", convertedStep.Name, err.Error())
+			}
+			convertedStep.Memory = memory
+		}
+		convertedStep.CPUs = s.CPUs
+		convertedStep.Volumes = s.Volumes
+		convertedStep.Caches = s.Caches
+		convertedStep.CacheMode = s.CacheMode
+		convertedStep.Output = s.Output
+		convertedStep.IgnoreOwnership = s.IgnoreOwnership
+		convertedStep.Shell = s.Shell
+		if convertedStep.Shell == "" {
+			convertedStep.Shell = defaultShell
+		}
+		convertedStep.Platform = n.Config.Platform
+		if s.Platform != "" {
+			convertedStep.Platform = s.Platform
+		}
+		convertedStep.NetworkMode = n.Config.NetworkMode
+		if s.NetworkMode != "" {
+			convertedStep.NetworkMode = s.NetworkMode
+		}
+		convertedStep.CacheFrom = s.CacheFrom
+		if len(convertedStep.CacheFrom) == 0 && n.Config.CacheFrom != "" {
+			convertedStep.CacheFrom = strings.Split(n.Config.CacheFrom, ",")
+		}
+		if s.Push {
+			convertedStep.Push = &Push{Registry: s.PushRegistry, Tag: s.PushTag}
+		}
 		if s.Cleanup != nil && !n.Config.NoSquash {
-			convertedStep.Cleanup = &Cleanup{Commands: s.Cleanup.Commands}
+			convertedStep.Cleanup = &Cleanup{Commands: s.Cleanup.Commands, IgnoreErrors: s.Cleanup.IgnoreErrors, SingleShell: s.Cleanup.SingleShell}
 			r.IsPrivileged = true
 		} else {
 			convertedStep.Cleanup = &Cleanup{}
 		}
+		convertedStep.Squash = len(convertedStep.Cleanup.Commands) > 0
+		if s.Squash != nil && !n.Config.NoSquash {
+			convertedStep.Squash = *s.Squash
+		}
+		convertedStep.SquashFrom = s.SquashFrom
+		if convertedStep.Squash {
+			// squashing extracts the image layers keeping their owners
+			r.IsPrivileged = true
+		}
 
 		// TODO: should done through proper schema validation
 		if version == "2016-03-14" {
@@ -167,19 +485,39 @@ func (n *namespace) convertToBuild(version string) (*Manifest, error) {
 		}
 
 		for _, a := range s.Artifacts {
-			convertedArt := Artifact{}
-
-			convertedArt.Step = convertedStep
-			parts := strings.Split(a, ":")
-			convertedArt.Source = parts[0]
-			if len(parts) == 1 {
-				// only one use the base
-				convertedArt.Dest = "."
-			} else {
-				convertedArt.Dest = parts[1]
+			if len(a.Source) > 1 && a.SHA256 != "" {
+				return nil, fmt.Errorf("Step '%s' has an artifact with a sha256 and several sources", convertedStep.Name)
+			}
+			if len(a.Source) > 1 && a.As != "" {
+				return nil, fmt.Errorf("Step '%s' has an artifact renamed with as and several sources", convertedStep.Name)
+			}
+			sources := a.Source
+			if len(sources) == 0 {
+				// left to Validate to report
+				sources = artifactSources{""}
 			}
 
-			convertedStep.Artifacts = append(convertedStep.Artifacts, convertedArt)
+			// each source becomes an artifact. They are all copied from the same container
+			for _, source := range sources {
+				convertedArt := Artifact{}
+
+				convertedArt.Step = convertedStep
+				convertedArt.Source = source
+				if a.Dest == "" {
+					// only one use the base
+					convertedArt.Dest = "."
+				} else {
+					convertedArt.Dest = a.Dest
+				}
+				convertedArt.PostCopy = a.PostCopy
+				convertedArt.Volume = a.Volume
+				convertedArt.Archive = a.Archive
+				convertedArt.SHA256 = strings.ToLower(strings.TrimPrefix(a.SHA256, "sha256:"))
+				convertedArt.Optional = a.Optional
+				convertedArt.As = a.As
+
+				convertedStep.Artifacts = append(convertedStep.Artifacts, convertedArt)
+			}
 		}
 
 		// is it unique?
@@ -196,19 +534,39 @@ func (n *namespace) convertToBuild(version string) (*Manifest, error) {
 	for idx, step := range r.Steps {
 		bStep := n.BuildConfig.Steps[step.Label]
 
+		// depends_on can refer to steps by label or by name
 		for _, d := range bStep.DependsOn {
 			convertedStep, err := r.FindStepByLabel(d)
 			if err != nil {
 				return nil, err
 			}
 			if convertedStep == nil {
-				return nil, fmt.Errorf("can't find step %s", d)
+				convertedStep, err = r.FindStepByName(d)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if convertedStep == nil {
+				return nil, fmt.Errorf("step %s depends on %s which is not a step label or name", step.Label, d)
 			}
 
 			r.Steps[idx].DependsOn = append(r.Steps[idx].DependsOn, convertedStep)
+			if args, ok := bStep.DependsOnArgs[d]; ok {
+				r.Steps[idx].EdgeArgs = append(r.Steps[idx].EdgeArgs, EdgeArgs{Dependency: d, Args: args})
+			}
+		}
+
+		for d := range bStep.DependsOnArgs {
+			if !stringInSlice(d, bStep.DependsOn) {
+				return nil, fmt.Errorf("step %s has depends_on_args for %s which is not in its depends_on", step.Label, d)
+			}
 		}
 	}
 
+	if cycle := r.findCycle(); cycle != nil {
+		return nil, fmt.Errorf("cycle detected: %s", strings.Join(cycle, " -> "))
+	}
+
 	// build the dependency tree
 	bl, err := r.serviceOrder(r.Steps)
 	if err != nil {
@@ -227,11 +585,66 @@ func (m *Manifest) getStepsByLevel(level int) ([]Step, error) {
 	return m.buildLevels[level], nil
 }
 
+// looks for a circular dependency between the steps and returns the names of the
+// steps in the cycle, starting and ending with the same step. nil if there is none
+func (m *Manifest) findCycle() []string {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+
+	state := make(map[string]int)
+	var path []string
+
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		switch state[name] {
+		case visiting:
+			// the cycle starts where we first saw this step
+			for idx, p := range path {
+				if p == name {
+					return append(append([]string(nil), path[idx:]...), name)
+				}
+			}
+		case visited:
+			return nil
+		}
+
+		state[name] = visiting
+		path = append(path, name)
+
+		step, _ := m.FindStepByName(name)
+		if step != nil {
+			for _, dep := range step.DependsOn {
+				if cycle := visit(dep.Name); cycle != nil {
+					return cycle
+				}
+			}
+		}
+
+		path = path[:len(path)-1]
+		state[name] = visited
+		return nil
+	}
+
+	for _, step := range m.Steps {
+		if cycle := visit(step.Name); cycle != nil {
+			return cycle
+		}
+	}
+
+	return nil
+}
+
 // takes in a list of steps and returns an array of steps ordered by their dependency order
 // result[0] will be an array of all steps with no dependency
 // result[1] will be an array of steps depending on one or more of result[0] steps and so on
 func (m *Manifest) serviceOrder(mainList []Step) ([][]Step, error) {
 	list := append([]Step(nil), mainList...)
+	// clone the dependency lists as well so resolving them doesn't modify the steps in mainList
+	for idx := range list {
+		list[idx].DependsOn = append([]*Step(nil), list[idx].DependsOn...)
+	}
 
 	if len(list) == 0 {
 		return [][]Step{}, nil
@@ -257,14 +670,20 @@ func (m *Manifest) serviceOrder(mainList []Step) ([][]Step, error) {
 
 		// now take out all of those found from the list of other items (they are now 'resolved')
 		for idx, step := range list { // for every step
-			stepDeps := append([]*Step(nil), step.DependsOn...) // clone the dependency list so we can remove items from it
-			for kdx, dep := range stepDeps {                    // iterate through its dependeneis
-				for _, resolved := range level { // and find any resolved step in them and take it out
-					if resolved.Name == dep.Name {
-						list[idx].DependsOn = append(list[idx].DependsOn[:kdx], list[idx].DependsOn[kdx+1:]...)
+			var remaining []*Step
+			for _, dep := range step.DependsOn { // keep the dependencies which are not resolved yet
+				resolved := false
+				for _, l := range level {
+					if l.Name == dep.Name {
+						resolved = true
+						break
 					}
 				}
+				if !resolved {
+					remaining = append(remaining, dep)
+				}
 			}
+			list[idx].DependsOn = remaining
 		}
 
 		// take out everything we have in this level from the list
@@ -286,6 +705,54 @@ func (m *Manifest) serviceOrder(mainList []Step) ([][]Step, error) {
 	return result, nil
 }
 
+// the build context folder of the step
+func (s *Step) contextDir(workdir string) string {
+	if s.Context == "" {
+		return workdir
+	}
+	if filepath.IsAbs(s.Context) {
+		return filepath.Clean(s.Context)
+	}
+
+	return filepath.Join(workdir, s.Context)
+}
+
+// opens the Dockerfile of the step, which is either a file in the step context or inline content
+func (s *Step) openDockerfile(workdir string) (io.ReadCloser, error) {
+	if s.DockerfileInline != "" {
+		return ioutil.NopCloser(strings.NewReader(s.DockerfileInline)), nil
+	}
+
+	return os.Open(filepath.Join(s.contextDir(workdir), s.Dockerfile))
+}
+
+// ReadDockerfileInput reads the Dockerfile of the step with "-" as dockerfile from r.
+// It's then used like an inline Dockerfile. Nothing is read when no step uses it
+func (m *Manifest) ReadDockerfileInput(r io.Reader) error {
+	var step *Step
+	for idx := range m.Steps {
+		if m.Steps[idx].Dockerfile != stdinDockerfile {
+			continue
+		}
+		if step != nil {
+			return fmt.Errorf("Steps '%s' and '%s' both read their Dockerfile from the input", step.Label, m.Steps[idx].Label)
+		}
+		step = &m.Steps[idx]
+	}
+	if step == nil {
+		return nil
+	}
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("Failed to read the Dockerfile of step '%s': %s", step.Label, err.Error())
+	}
+	step.Dockerfile = ""
+	step.DockerfileInline = string(content)
+
+	return nil
+}
+
 // FindStepByName finds a step by name. Returns nil if not found
 func (m *Manifest) FindStepByName(name string) (*Step, error) {
 	for _, step := range m.Steps {
@@ -297,6 +764,59 @@ func (m *Manifest) FindStepByName(name string) (*Step, error) {
 	return nil, nil
 }
 
+// FindStepByImage finds the step a FROM image refers to, ignoring the step from.
+// The image matches a step by name or by one of the step aliases. An image without a
+// tag is the latest one, so mystep matches a step named mystep:latest. Images with
+// another registry or namespace only match through an alias. Returns nil if not found
+func (m *Manifest) FindStepByImage(image string, from *Step) (*Step, error) {
+	found, err := m.FindStepByName(image)
+	if err != nil || found != nil {
+		return found, err
+	}
+
+	ref := normalizeImage(image)
+	var matches []Step
+	for _, step := range m.Steps {
+		if from != nil && step.Label == from.Label {
+			continue
+		}
+
+		for _, name := range append([]string{step.Name}, step.Aliases...) {
+			if normalizeImage(name) == ref {
+				matches = append(matches, step)
+				break
+			}
+		}
+	}
+
+	if len(matches) > 1 {
+		var names []string
+		for _, s := range matches {
+			names = append(names, s.Name)
+		}
+		return nil, fmt.Errorf("image %s matches more than one step: %s. Use the step name or an alias", image, strings.Join(names, ", "))
+	}
+	if len(matches) == 1 {
+		return &matches[0], nil
+	}
+
+	return nil, nil
+}
+
+// returns the image with the latest tag when it has no tag. Digest references are kept
+func normalizeImage(image string) string {
+	if strings.Contains(image, "@") {
+		return image
+	}
+
+	repo, tag := splitImageTag(image)
+	if tag == "" {
+		tag = "latest"
+	}
+
+	return repo + ":" + tag
+}
+
 func (m *Manifest) FindStepByLabel(label string) (*Step, error) {
 	for _, step := range m.Steps {
 		if step.Label == label {
@@ -307,21 +827,49 @@ func (m *Manifest) FindStepByLabel(label string) (*Step, error) {
 	return nil, nil
 }
 
-func parseForEnvVars(config *configuration.Config, value []byte) []byte {
+// replaces _env(VAR), ${VAR} and $VAR in the build file with the environment variables
+// passed in the config or the process environment when none are passed. This covers the
+// whole file, commands included, so $$ is a literal $ for the variables of the container
+// or the shell. undefined variables are replaced with an empty string unless StrictEnv is set
+func parseForEnvVars(config *configuration.Config, value []byte) ([]byte, error) {
+	var undefined []string
+	lookup := func(name string) string {
+		var v string
+		var ok bool
+		if len(config.EnvVars) == 0 {
+			v, ok = os.LookupEnv(name)
+		} else {
+			v = config.EnvVars.Find(name)
+			ok = config.EnvVars.Has(name)
+		}
+		if !ok && !stringInSlice(name, undefined) {
+			undefined = append(undefined, name)
+		}
+		return v
+	}
+
+	// expand $VAR first so values coming from _env(VAR) are not expanded again
+	expanded := []byte(os.Expand(string(value), func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		return lookup(name)
+	}))
+
 	r, _ := regexp.Compile("(?U)_env\\((.*)\\)")
 
-	matched := r.ReplaceAllFunc(value, func(s []byte) []byte {
+	matched := r.ReplaceAllFunc(expanded, func(s []byte) []byte {
 		m := string(s)
 		parts := r.FindStringSubmatch(m)
 
-		if len(config.EnvVars) == 0 {
-			return []byte(os.Getenv(parts[1]))
-		} else {
-			return []byte(config.EnvVars.Find(parts[1]))
-		}
+		return []byte(lookup(parts[1]))
 	})
 
-	return matched
+	if config.StrictEnv && len(undefined) > 0 {
+		return nil, fmt.Errorf("undefined environment variables in build file: %s. Use $$ for a $ which isn't a habitus variable", strings.Join(undefined, ", "))
+	}
+
+	return matched, nil
 }
 
 func stringInSlice(a string, list []string) bool {
@@ -0,0 +1,576 @@
+package build
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Manifest", func() {
+	Describe("dependency cycles", func() {
+		It("reports the steps in the cycle", func() {
+			_, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    a:
+      name: a
+      dockerfile: Dockerfile
+      depends_on:
+        - b
+    b:
+      name: b
+      dockerfile: Dockerfile
+      depends_on:
+        - c
+    c:
+      name: c
+      dockerfile: Dockerfile
+      depends_on:
+        - a
+`)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(MatchRegexp(`^cycle detected: (a -> b -> c -> a|b -> c -> a -> b|c -> a -> b -> c)$`))
+		})
+
+		It("reports a step depending on itself", func() {
+			_, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    a:
+      name: a
+      dockerfile: Dockerfile
+      depends_on:
+        - a
+`)
+			Expect(err).To(MatchError("cycle detected: a -> a"))
+		})
+	})
+
+	Describe("Validate", func() {
+		It("reports missing fields with the step line", func() {
+			manifest, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    builder:
+      name: builder
+      dockerfile: Dockerfile
+    broken:
+      name: broken
+      artifacts:
+        - source: ""
+          dest: ./out
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = manifest.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("step 'broken' (line 8): missing dockerfile"))
+			Expect(err.Error()).To(ContainSubstring("step 'broken' (line 8): artifact 1 has no source"))
+			Expect(err.Error()).NotTo(ContainSubstring("builder"))
+		})
+	})
+
+	Describe("Validate artifact destinations", func() {
+		It("rejects relative destinations outside the workdir", func() {
+			manifest, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    builder:
+      name: builder
+      dockerfile: Dockerfile
+      artifacts:
+        - /app/bin:out/bin
+        - /app/foo:../../foo
+        - /app/lib:/tmp/lib
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			err = manifest.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("artifact 2 destination ../../foo is outside the work directory"))
+			Expect(err.Error()).NotTo(ContainSubstring("artifact 1"))
+			Expect(err.Error()).NotTo(ContainSubstring("artifact 3"))
+		})
+	})
+
+	Describe("artifact sources", func() {
+		It("copies a list of sources to the same destination", func() {
+			manifest, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    builder:
+      name: builder
+      dockerfile: Dockerfile
+      artifacts:
+        - /app/README.md
+        - source:
+            - /app/bin/server
+            - /app/bin/worker
+          dest: bin
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			step, _ := manifest.FindStepByLabel("builder")
+			var copied []string
+			for _, art := range step.Artifacts {
+				copied = append(copied, art.Source+":"+art.Dest)
+			}
+			Expect(copied).To(Equal([]string{"/app/README.md:.", "/app/bin/server:bin", "/app/bin/worker:bin"}))
+		})
+	})
+
+	Describe("Dockerfile input", func() {
+		It("reads the Dockerfile of the step with - as dockerfile", func() {
+			manifest, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    builder:
+      name: builder
+      dockerfile: "-"
+`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(manifest.Validate()).To(MatchError(ContainSubstring("the dockerfile is read from the input but none was given")))
+
+			Expect(manifest.ReadDockerfileInput(strings.NewReader("FROM scratch\n"))).To(Succeed())
+			step, _ := manifest.FindStepByLabel("builder")
+			Expect(step.Dockerfile).To(BeEmpty())
+			Expect(step.DockerfileInline).To(Equal("FROM scratch\n"))
+			Expect(manifest.Validate()).To(Succeed())
+		})
+
+		It("rejects several steps reading the input", func() {
+			manifest, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    builder:
+      name: builder
+      dockerfile: "-"
+    app:
+      name: app
+      dockerfile: "-"
+`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(manifest.ReadDockerfileInput(strings.NewReader("FROM scratch\n"))).To(MatchError(ContainSubstring("both read their Dockerfile from the input")))
+		})
+	})
+
+	Describe("environment variables", func() {
+		It("replaces ${VAR} and $VAR", func() {
+			conf := testConfig()
+			Expect(conf.EnvVars.Set("TAG=1.2")).To(Succeed())
+			Expect(conf.EnvVars.Set("DOCKERFILE=Dockerfile.app")).To(Succeed())
+
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app:${TAG}
+      dockerfile: $DOCKERFILE
+      command: echo $$HOME
+`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(manifest.Steps[0].Name).To(Equal("app:1.2"))
+			Expect(manifest.Steps[0].Dockerfile).To(Equal("Dockerfile.app"))
+			Expect(manifest.Steps[0].Command).To(Equal("echo $HOME"))
+		})
+
+		It("fails on undefined variables in strict mode", func() {
+			conf := testConfig()
+			conf.StrictEnv = true
+			Expect(conf.EnvVars.Set("TAG=1.2")).To(Succeed())
+
+			_, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app:${TAG}
+      dockerfile: ${MISSING}
+`)
+			Expect(err).To(MatchError("undefined environment variables in build file: MISSING. Use $$ for a $ which isn't a habitus variable"))
+		})
+
+		It("keeps escaped variables for the container in strict mode", func() {
+			conf := testConfig()
+			conf.StrictEnv = true
+			Expect(conf.EnvVars.Set("TAG=1.2")).To(Succeed())
+
+			manifest, err := loadManifest(conf, `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app:${TAG}
+      dockerfile: Dockerfile
+      command: go test $$GOFLAGS ./...
+      cleanup:
+        commands:
+          - rm -rf $${HOME}/.cache
+      post_build: echo $$HABITUS_IMAGE
+`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(manifest.Steps[0].Name).To(Equal("app:1.2"))
+			Expect(manifest.Steps[0].Command).To(Equal("go test $GOFLAGS ./..."))
+			Expect(manifest.Steps[0].Cleanup.Commands).To(Equal([]string{"rm -rf ${HOME}/.cache"}))
+			Expect(manifest.Steps[0].PostBuild).To(Equal("echo $HABITUS_IMAGE"))
+		})
+	})
+
+	Describe("depends_on", func() {
+		It("accepts step names as well as labels", func() {
+			manifest, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    builder:
+      name: my-builder
+      dockerfile: Dockerfile.builder
+    app:
+      name: app
+      dockerfile: Dockerfile
+      depends_on:
+        - my-builder
+`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(manifest.buildLevels).To(HaveLen(2))
+			Expect(manifest.buildLevels[0][0].Name).To(Equal("my-builder"))
+			Expect(manifest.buildLevels[1][0].Name).To(Equal("app"))
+		})
+
+		It("fails for unknown steps", func() {
+			_, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    app:
+      name: app
+      dockerfile: Dockerfile
+      depends_on:
+        - missing
+`)
+			Expect(err).To(MatchError("step app depends on missing which is not a step label or name"))
+		})
+	})
+
+	Describe("JSON build files", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "habitus-json")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		// loads a build file with the given name and content
+		load := func(name string, content string) (*Manifest, error) {
+			conf := testConfig()
+			conf.Buildfile = filepath.Join(dir, name)
+			Expect(ioutil.WriteFile(conf.Buildfile, []byte(content), 0644)).To(Succeed())
+			return LoadBuildFromFile(conf)
+		}
+
+		It("loads the steps and their dependencies", func() {
+			manifest, err := load("build.json", `{
+  "build": {
+    "version": "2016-03-14",
+    "steps": {
+      "builder": {"name": "builder", "dockerfile": "Dockerfile.builder"},
+      "app": {"name": "app", "dockerfile": "Dockerfile", "depends_on": ["builder"]}
+    }
+  }
+}`)
+			Expect(err).NotTo(HaveOccurred())
+
+			app, err := manifest.FindStepByLabel("app")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(app.Dockerfile).To(Equal("Dockerfile"))
+			Expect(app.DependsOn).To(HaveLen(1))
+			Expect(app.DependsOn[0].Name).To(Equal("builder"))
+			Expect(manifest.buildLevels).To(HaveLen(2))
+			Expect(manifest.buildLevels[0][0].Name).To(Equal("builder"))
+		})
+
+		It("reports invalid JSON with the JSON parser error", func() {
+			_, err := load("build.json", `{"build": {"version": "2016-03-14",}}`)
+			Expect(err).To(MatchError(HavePrefix("invalid JSON build file: invalid character '}'")))
+		})
+
+		It("rejects TOML build files", func() {
+			_, err := load("build.toml", "[build]\nversion = \"2016-03-14\"\n")
+			Expect(err).To(MatchError("TOML build files are not supported. Use yaml or JSON"))
+		})
+	})
+
+	Describe("build file URLs", func() {
+		It("fetches the build file with the auth header", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer secret" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				w.Write([]byte(`{"build": {"version": "2016-03-14", "steps": {"app": {"name": "app", "dockerfile": "Dockerfile"}}}}`))
+			}))
+			defer server.Close()
+
+			conf := testConfig()
+			conf.Buildfile = server.URL + "/builds/app.json?ref=master"
+
+			_, err := LoadBuildFromFile(conf)
+			Expect(err).To(MatchError(ContainSubstring("401 Unauthorized")))
+
+			conf.BuildfileAuth = "Bearer secret"
+			manifest, err := LoadBuildFromFile(conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(manifest.Steps).To(HaveLen(1))
+		})
+
+		It("only sends the auth header to the host of the build file", func() {
+			var includeAuth []string
+			other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				includeAuth = append(includeAuth, r.Header.Get("Authorization"))
+				w.Write([]byte(`{"build": {"steps": {"tools": {"name": "tools", "dockerfile": "Dockerfile"}}}}`))
+			}))
+			defer other.Close()
+
+			var server *httptest.Server
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer secret" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				if r.URL.Path == "/builds/base.json" {
+					w.Write([]byte(`{"build": {"steps": {"base": {"name": "base", "dockerfile": "Dockerfile"}}}}`))
+					return
+				}
+				w.Write([]byte(`{"include": ["base.json", "` + other.URL + `/tools.json"], "build": {"version": "2016-03-14", "steps": {"app": {"name": "app", "dockerfile": "Dockerfile"}}}}`))
+			}))
+			defer server.Close()
+
+			conf := testConfig()
+			conf.Buildfile = server.URL + "/builds/app.json"
+			conf.BuildfileAuth = "Bearer secret"
+			manifest, err := LoadBuildFromFile(conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(manifest.Steps).To(HaveLen(3))
+			Expect(includeAuth).To(Equal([]string{""}))
+		})
+	})
+
+	Describe("includes", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "habitus-test-")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.MkdirAll(filepath.Join(dir, "components"), 0755)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		write := func(name string, content string) string {
+			path := filepath.Join(dir, name)
+			Expect(ioutil.WriteFile(path, []byte(content), 0644)).To(Succeed())
+			return path
+		}
+
+		It("merges the steps of included files relative to the including file", func() {
+			write("components/api.yml", `
+include:
+  - worker.yml
+build:
+  steps:
+    api:
+      name: api
+      dockerfile: api/Dockerfile
+      depends_on:
+        - base
+`)
+			write("components/worker.yml", `
+build:
+  steps:
+    worker:
+      name: worker
+      dockerfile: worker/Dockerfile
+`)
+			conf := testConfig()
+			conf.Buildfile = write("build.yml", `
+include:
+  - components/api.yml
+build:
+  version: 2016-03-14
+  steps:
+    base:
+      name: base
+      dockerfile: Dockerfile
+`)
+
+			manifest, err := LoadBuildFromFile(conf)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(manifest.Steps).To(HaveLen(3))
+			api, _ := manifest.FindStepByLabel("api")
+			Expect(api.DependsOn[0].Label).To(Equal("base"))
+		})
+
+		It("rejects steps defined in more than one file", func() {
+			write("components/base.yml", `
+build:
+  steps:
+    base:
+      name: other-base
+      dockerfile: Dockerfile
+`)
+			conf := testConfig()
+			conf.Buildfile = write("build.yml", `
+include:
+  - components/base.yml
+build:
+  version: 2016-03-14
+  steps:
+    base:
+      name: base
+      dockerfile: Dockerfile
+`)
+
+			_, err := LoadBuildFromFile(conf)
+			Expect(err).To(MatchError(ContainSubstring("step base in " + filepath.Join(dir, "components", "base.yml") + " is already defined in " + conf.Buildfile)))
+		})
+
+		It("rejects include cycles", func() {
+			write("components/a.yml", "include:\n  - ../build.yml\n")
+			conf := testConfig()
+			conf.Buildfile = write("build.yml", `
+include:
+  - components/a.yml
+build:
+  version: 2016-03-14
+`)
+
+			_, err := LoadBuildFromFile(conf)
+			Expect(err).To(MatchError(ContainSubstring("include cycle detected")))
+		})
+	})
+
+	Describe("squash", func() {
+		It("squashes steps with cleanup commands unless disabled", func() {
+			manifest, err := loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    cleaned:
+      name: cleaned
+      dockerfile: Dockerfile
+      cleanup:
+        commands:
+          - rm -rf /src
+    unsquashed:
+      name: unsquashed
+      dockerfile: Dockerfile
+      squash: false
+      cleanup:
+        commands:
+          - rm -rf /src
+    squashed:
+      name: squashed
+      dockerfile: Dockerfile
+      squash: true
+    plain:
+      name: plain
+      dockerfile: Dockerfile
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			for label, squash := range map[string]bool{"cleaned": true, "unsquashed": false, "squashed": true, "plain": false} {
+				step, _ := manifest.FindStepByLabel(label)
+				Expect(step.Squash).To(Equal(squash), label)
+			}
+			Expect(manifest.IsPrivileged).To(BeTrue())
+		})
+	})
+
+	Describe("FROM references", func() {
+		var manifest *Manifest
+
+		BeforeEach(func() {
+			var err error
+			manifest, err = loadManifest(testConfig(), `
+build:
+  version: 2016-03-14
+  steps:
+    builder:
+      name: mystep
+      dockerfile: Dockerfile
+      aliases:
+        - registry.example.com/team/mystep:tag
+    node:
+      name: node
+      dockerfile: Dockerfile
+    tagged:
+      name: tools:1.0
+      dockerfile: Dockerfile
+      aliases:
+        - ci/toolbox
+    app:
+      name: app
+      dockerfile: Dockerfile
+`)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		label := func(image string) string {
+			app, _ := manifest.FindStepByLabel("app")
+			found, err := manifest.FindStepByImage(image, app)
+			Expect(err).NotTo(HaveOccurred())
+			if found == nil {
+				return ""
+			}
+			return found.Label
+		}
+
+		It("resolves step names with the latest tag", func() {
+			Expect(label("mystep")).To(Equal("builder"))
+			Expect(label("mystep:latest")).To(Equal("builder"))
+			Expect(label("tools:1.0")).To(Equal("tagged"))
+		})
+
+		It("resolves fully qualified references through aliases", func() {
+			Expect(label("registry.example.com/team/mystep:tag")).To(Equal("builder"))
+			Expect(label("ci/toolbox")).To(Equal("tagged"))
+			Expect(label("ci/toolbox:latest")).To(Equal("tagged"))
+		})
+
+		It("doesn't resolve other images", func() {
+			Expect(label("mystep:tag")).To(BeEmpty())
+			Expect(label("localhost:5000/mystep")).To(BeEmpty())
+			Expect(label("registry.example.com/tools:1.0")).To(BeEmpty())
+			Expect(label("tools:2.0")).To(BeEmpty())
+			Expect(label("node:18-alpine")).To(BeEmpty())
+			Expect(label("docker.io/library/node:20")).To(BeEmpty())
+			Expect(label("ubuntu:16.04")).To(BeEmpty())
+		})
+
+		It("doesn't resolve a step to itself", func() {
+			Expect(label("app:latest")).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,130 @@
+package build
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cloud66/habitus/configuration"
+	"github.com/op/go-logging"
+)
+
+// values shorter than this aren't masked as they would hide too much of the logs
+const minSecretLength = 4
+
+const secretMask = "****"
+
+// secretValues are the sensitive strings of the build masked in the logs
+type secretValues struct {
+	values []string
+	lock   sync.RWMutex
+}
+
+func (s *secretValues) add(value string) {
+	if len(value) < minSecretLength {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if stringInSlice(value, s.values) {
+		return
+	}
+	s.values = append(s.values, value)
+	// the longest values first so a secret containing another one is fully masked
+	sort.Slice(s.values, func(i, j int) bool { return len(s.values[i]) > len(s.values[j]) })
+}
+
+func (s *secretValues) mask(text string) string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, value := range s.values {
+		text = strings.Replace(text, value, secretMask, -1)
+	}
+
+	return text
+}
+
+// AddSecretValue registers a sensitive value which is masked in all the build logs
+func (b *Builder) AddSecretValue(value string) {
+	b.secrets.add(value)
+}
+
+// the sensitive values given to habitus in its config: the authorization header of the
+// build file and the values of the build args read from the environment
+func (s *secretValues) addConfig(conf *configuration.Config) {
+	if conf.BuildfileAuth != "" {
+		s.add(conf.BuildfileAuth)
+		// the credentials of the header without their scheme
+		if i := strings.Index(conf.BuildfileAuth, " "); i >= 0 {
+			s.add(strings.TrimSpace(conf.BuildfileAuth[i:]))
+		}
+	}
+
+	for _, name := range strings.Split(conf.BuildEnv, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			s.add(os.Getenv(name))
+		}
+	}
+}
+
+// MaskedLogger returns a copy of the logger of conf which masks the sensitive values of
+// conf. It is for the logs outside a build, like loading the build file
+func MaskedLogger(conf *configuration.Config) *logging.Logger {
+	secrets := &secretValues{}
+	secrets.addConfig(conf)
+
+	logger := conf.Logger
+	logger.SetBackend(newMaskingBackend(conf.Logger, secrets))
+
+	return &logger
+}
+
+// maskingBackend masks the secret values in the log messages. The masked message
+// is logged with the original logger so its backend, format and level are kept
+type maskingBackend struct {
+	logger  logging.Logger
+	secrets *secretValues
+}
+
+func newMaskingBackend(logger logging.Logger, secrets *secretValues) *maskingBackend {
+	return &maskingBackend{logger: logger, secrets: secrets}
+}
+
+func (m *maskingBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	msg := m.secrets.mask(rec.Message())
+
+	switch level {
+	case logging.CRITICAL:
+		m.logger.Critical(msg)
+	case logging.ERROR:
+		m.logger.Error(msg)
+	case logging.WARNING:
+		m.logger.Warning(msg)
+	case logging.NOTICE:
+		m.logger.Notice(msg)
+	case logging.INFO:
+		m.logger.Info(msg)
+	default:
+		m.logger.Debug(msg)
+	}
+
+	return nil
+}
+
+// the levels are the ones of the wrapped logger whatever the module of the masked one.
+// go-logging doesn't give the backend of a logger so they go through its module
+func (m *maskingBackend) GetLevel(module string) logging.Level {
+	return logging.GetLevel(m.logger.Module)
+}
+
+func (m *maskingBackend) SetLevel(level logging.Level, module string) {
+	logging.SetLevel(level, m.logger.Module)
+}
+
+func (m *maskingBackend) IsEnabledFor(level logging.Level, module string) bool {
+	return m.logger.IsEnabledFor(level)
+}
@@ -0,0 +1,46 @@
+package build
+
+import (
+	"regexp"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+var invalidNetworkChars = regexp.MustCompile("[^a-zA-Z0-9_.-]+")
+
+// creates a network used only by the containers of this step so they
+// can't reach containers of other steps
+func (b *Builder) createStepNetwork(step *Step) (*docker.Network, error) {
+	name := "habitus-" + b.builderId[:8] + "-" + invalidNetworkChars.ReplaceAllString(b.uniqueStepName(step), "-")
+
+	b.Conf.Logger.Debugf("Creating network %s for %s", name, step.Name)
+	return b.docker.CreateNetwork(docker.CreateNetworkOptions{
+		Name:           name,
+		Driver:         "bridge",
+		CheckDuplicate: true,
+		Labels:         map[string]string{"habitus.builder": b.builderId},
+	})
+}
+
+// removes a step network. Any containers left attached to it (when the step failed)
+// are disconnected first so the network doesn't leak
+func (b *Builder) removeStepNetwork(network *docker.Network) {
+	b.Conf.Logger.Debugf("Removing network %s", network.Name)
+
+	info, err := b.docker.NetworkInfo(network.ID)
+	if err != nil {
+		b.Conf.Logger.Warningf("Failed to inspect network %s: %s", network.Name, err.Error())
+		return
+	}
+
+	for containerID := range info.Containers {
+		err := b.docker.DisconnectNetwork(network.ID, docker.NetworkConnectionOptions{Container: containerID, Force: true})
+		if err != nil {
+			b.Conf.Logger.Warningf("Failed to disconnect container %s from network %s: %s", containerID, network.Name, err.Error())
+		}
+	}
+
+	if err := b.docker.RemoveNetwork(network.ID); err != nil {
+		b.Conf.Logger.Warningf("Failed to remove network %s: %s", network.Name, err.Error())
+	}
+}
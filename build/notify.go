@@ -0,0 +1,110 @@
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"text/tabwriter"
+	"time"
+)
+
+const notifyTimeout = 30 * time.Second
+
+// colors of the Slack message attachment
+var slackColors = map[string]string{
+	BuildSucceeded: "good",
+	BuildFailed:    "danger",
+	BuildCancelled: "warning",
+}
+
+type slackMessage struct {
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+type slackAttachment struct {
+	Fallback string       `json:"fallback"`
+	Color    string       `json:"color"`
+	Title    string       `json:"title"`
+	Text     string       `json:"text"`
+	Fields   []slackField `json:"fields,omitempty"`
+	MrkdwnIn []string     `json:"mrkdwn_in"`
+}
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+// sends the build notifications which are set up. A failed notification is only
+// warned about so it never fails the build
+func (b *Builder) notify(result *BuildResult) {
+	if result == nil {
+		return
+	}
+
+	if b.Conf.NotifyURL != "" {
+		b.Conf.Logger.Debugf("Sending the build notification to %s", b.Conf.NotifyURL)
+		if err := postJSON(b.Conf.NotifyURL, result); err != nil {
+			b.Conf.Logger.Warningf("Failed to send the build notification: %s", err.Error())
+		}
+	}
+
+	if b.Conf.SlackWebhook != "" {
+		b.Conf.Logger.Debug("Sending the build notification to Slack")
+		if err := postJSON(b.Conf.SlackWebhook, b.slackMessage(result)); err != nil {
+			b.Conf.Logger.Warningf("Failed to send the Slack notification: %s", err.Error())
+		}
+	}
+}
+
+// a message with an attachment colored by the build status and the step table
+func (b *Builder) slackMessage(result *BuildResult) *slackMessage {
+	title := "Habitus build " + result.Status
+	if b.UniqueID != "" {
+		title = fmt.Sprintf("Habitus build %s %s", b.UniqueID, result.Status)
+	}
+
+	var table bytes.Buffer
+	w := tabwriter.NewWriter(&table, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STEP\tSTATUS\tDURATION")
+	for _, s := range result.Steps {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", s.Step, s.Status, s.Duration-s.Duration%time.Millisecond)
+	}
+	w.Flush()
+
+	attachment := slackAttachment{
+		Fallback: title,
+		Color:    slackColors[result.Status],
+		Title:    title,
+		Text:     "```" + table.String() + "```",
+		Fields:   []slackField{{Title: "Duration", Value: (result.Duration - result.Duration%time.Second).String(), Short: true}},
+		MrkdwnIn: []string{"text"},
+	}
+	if result.Error != "" {
+		attachment.Fields = append(attachment.Fields, slackField{Title: "Error", Value: result.Error})
+	}
+
+	return &slackMessage{Attachments: []slackAttachment{attachment}}
+}
+
+func postJSON(url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,52 @@
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// the tar file the step image is saved to, or empty. The step output wins over the
+// output folder of the build. Relative paths are in the workdir
+func (b *Builder) outputPath(step *Step) string {
+	output := step.Output
+	if output == "" && b.Conf.OutputDir != "" {
+		output = filepath.Join(b.Conf.OutputDir, strings.Replace(step.Label, string(filepath.Separator), "_", -1)+".tar")
+	}
+	if output == "" || filepath.IsAbs(output) {
+		return output
+	}
+
+	return filepath.Join(b.Conf.Workdir, output)
+}
+
+// saves the step image to a tar file like docker save. The image stays in the daemon
+func (b *Builder) saveImage(step *Step, output string) error {
+	if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+
+	b.Conf.Logger.Noticef("Saving image %s to %s", b.uniqueStepName(step), output)
+	err = b.docker.ExportImage(docker.ExportImageOptions{
+		Context:      b.context(),
+		Name:         b.uniqueStepName(step),
+		OutputStream: f,
+	})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// a partial tar is no use
+		os.Remove(output)
+		return err
+	}
+
+	return nil
+}
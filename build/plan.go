@@ -0,0 +1,61 @@
+package build
+
+import (
+	"fmt"
+	"strings"
+)
+
+// prints what the build would do without calling docker or changing any files
+func (b *Builder) printPlan() error {
+	out := b.OutputStream
+
+	fmt.Fprintf(out, "Build plan for %d steps\n", len(b.Build.Steps))
+	for idx, level := range b.Build.buildLevels {
+		fmt.Fprintf(out, "Level %d\n", idx)
+
+		for _, step := range level {
+			dockerfile := step.Dockerfile
+			if step.DockerfileInline != "" {
+				dockerfile = "inline Dockerfile"
+			}
+			fmt.Fprintf(out, "  %s (%s) from %s\n", b.uniqueStepName(&step), step.Label, dockerfile)
+
+			parsed, err := b.parseDockerfile(&step)
+			if err != nil {
+				return fmt.Errorf("step %s: %s", step.Name, err.Error())
+			}
+			for _, r := range parsed.Rewrites {
+				fmt.Fprintf(out, "    FROM %s -> %s\n", r.From, r.To)
+			}
+
+			for _, art := range step.Artifacts {
+				fmt.Fprintf(out, "    artifact %s -> %s\n", art.Source, art.Dest)
+			}
+
+			if !b.Conf.NoSquash && len(step.Cleanup.Commands) > 0 {
+				fmt.Fprintf(out, "    cleanup: %s\n", strings.Join(step.Cleanup.Commands, "; "))
+			}
+
+			if !b.Conf.NoSquash && step.Squash {
+				fmt.Fprintln(out, "    squash")
+			}
+
+			for _, tag := range step.Tags {
+				fmt.Fprintf(out, "    tag %s\n", tag)
+			}
+
+			if step.Command != "" {
+				fmt.Fprintf(out, "    command: %s\n", step.Command)
+			}
+		}
+	}
+
+	if !b.Conf.KeepSteps && len(b.Build.Steps) > 0 {
+		fmt.Fprintln(out, "Images removed after the build")
+		for _, step := range b.removableSteps() {
+			fmt.Fprintf(out, "  %s\n", b.uniqueStepName(&step))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package build
+
+import (
+	"strings"
+)
+
+// the os/arch of the daemon, like linux/amd64. It's asked once per builder
+func (b *Builder) daemonPlatform() (string, error) {
+	b.platformOnce.Do(func() {
+		env, err := b.docker.Version()
+		if err != nil {
+			b.platformErr = err
+			return
+		}
+		b.platform = env.Get("Os") + "/" + env.Get("Arch")
+	})
+
+	return b.platform, b.platformErr
+}
+
+// true when the platform is the os and arch of the daemon. The variant of the
+// platform, like v8 in linux/arm64/v8, isn't compared
+func samePlatform(platform string, daemon string) bool {
+	parts := strings.Split(strings.ToLower(platform), "/")
+	daemonParts := strings.Split(strings.ToLower(daemon), "/")
+	for i := 0; i < len(parts) && i < 2; i++ {
+		if i >= len(daemonParts) || parts[i] != daemonParts[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,123 @@
+package build
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// how often the exit of an exec is checked on podman
+const podmanExecPollInterval = 100 * time.Millisecond
+
+// registry credentials as stored in podman's auth.json
+type podmanAuthFile struct {
+	Auths map[string]struct {
+		Auth string `json:"auth"`
+	} `json:"auths"`
+}
+
+// true when the daemon is podman. Podman sockets are found by their path, other
+// endpoints by the components of the daemon version
+func detectPodman(client versionClient, endpoint *url.URL) bool {
+	if strings.Contains(endpoint.Path, "podman") {
+		return true
+	}
+
+	env, err := client.Version()
+	if err != nil {
+		return false
+	}
+
+	return strings.Contains(env.Get("Components"), "Podman Engine")
+}
+
+// finds podman's auth.json. REGISTRY_AUTH_FILE takes precedence over the runtime
+// folder and the config folder of the home
+func podmanAuthPath(homeDir string) string {
+	if authFile := os.Getenv("REGISTRY_AUTH_FILE"); authFile != "" {
+		return authFile
+	}
+
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		authFile := filepath.Join(runtimeDir, "containers", "auth.json")
+		if _, err := os.Stat(authFile); err == nil {
+			return authFile
+		}
+	}
+
+	return filepath.Join(homeDir, ".config", "containers", "auth.json")
+}
+
+// loads the registry credentials of podman's auth.json when it's there. They
+// override the docker ones in podman mode and only fill the gaps otherwise
+func (b *Builder) loadPodmanAuth(homeDir string) error {
+	authPath := podmanAuthPath(homeDir)
+	data, err := ioutil.ReadFile(authPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var auths podmanAuthFile
+	if err := json.Unmarshal(data, &auths); err != nil {
+		return fmt.Errorf("invalid %s: %s", authPath, err.Error())
+	}
+
+	if b.auth == nil {
+		b.auth = &docker.AuthConfigurations{}
+	}
+	if b.auth.Configs == nil {
+		b.auth.Configs = make(map[string]docker.AuthConfiguration)
+	}
+
+	for registry, auth := range auths.Auths {
+		if _, ok := b.auth.Configs[registry]; ok && !b.Conf.Podman {
+			continue
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return fmt.Errorf("invalid credentials for %s in %s: %s", registry, authPath, err.Error())
+		}
+		userpass := strings.SplitN(string(decoded), ":", 2)
+		if len(userpass) != 2 {
+			return fmt.Errorf("invalid credentials for %s in %s", registry, authPath)
+		}
+
+		b.Conf.Logger.Debugf("Using the credentials for %s from %s", registry, authPath)
+		b.auth.Configs[registry] = docker.AuthConfiguration{
+			Username:      userpass[0],
+			Password:      userpass[1],
+			ServerAddress: registry,
+		}
+	}
+
+	return nil
+}
+
+// inspects an exec once it's done. Podman can return from an attached exec start
+// before the exit code of the command is recorded, so it is waited for there
+func (b *Builder) inspectExec(id string) (*docker.ExecInspect, error) {
+	for {
+		inspect, err := b.docker.InspectExec(id)
+		if err != nil || !b.Conf.Podman || !inspect.Running {
+			return inspect, err
+		}
+
+		select {
+		case <-b.context().Done():
+			return nil, b.context().Err()
+		case <-time.After(podmanExecPollInterval):
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package build
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// prefixWriter writes each line with a prefix. Only whole lines are written so lines
+// of steps running at the same time don't mix. Flush writes an unfinished last line
+type prefixWriter struct {
+	w      io.Writer
+	prefix []byte
+	buf    []byte
+	lock   sync.Mutex
+}
+
+func newPrefixWriter(w io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{w: w, prefix: []byte(prefix)}
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.buf = append(p.buf, data...)
+	for {
+		idx := bytes.IndexByte(p.buf, '\n')
+		if idx < 0 {
+			break
+		}
+		if err := p.writeLine(p.buf[:idx+1]); err != nil {
+			return 0, err
+		}
+		p.buf = p.buf[idx+1:]
+	}
+
+	return len(data), nil
+}
+
+// Flush writes what is left of an unfinished line
+func (p *prefixWriter) Flush() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.buf) == 0 {
+		return nil
+	}
+	err := p.writeLine(append(p.buf, '\n'))
+	p.buf = nil
+
+	return err
+}
+
+func (p *prefixWriter) writeLine(line []byte) error {
+	_, err := p.w.Write(append(append([]byte{}, p.prefix...), line...))
+	return err
+}
@@ -0,0 +1,32 @@
+package build
+
+import (
+	"github.com/fsouza/go-dockerclient"
+)
+
+// CFS period the CPU limit of a step is a quota of, as with docker run --cpus
+const cpuPeriod = 100000
+
+// the CPU quota of the step in the CPU period. 0 is no limit
+func (s *Step) cpuQuota() int64 {
+	return int64(s.CPUs * cpuPeriod)
+}
+
+// sets the memory and CPU limits of the step on the host config of its container
+func (s *Step) limitResources(hostConfig *docker.HostConfig) {
+	hostConfig.Memory = s.Memory
+	if quota := s.cpuQuota(); quota > 0 {
+		hostConfig.CPUPeriod = cpuPeriod
+		hostConfig.CPUQuota = quota
+	}
+}
+
+// sets the memory and CPU limits of the step on the build. These are applied by the
+// classic builder to the containers of the RUN instructions
+func (s *Step) limitBuildResources(opts *docker.BuildImageOptions) {
+	opts.Memory = s.Memory
+	if quota := s.cpuQuota(); quota > 0 {
+		opts.CPUPeriod = cpuPeriod
+		opts.CPUQuota = quota
+	}
+}
@@ -0,0 +1,80 @@
+package build
+
+import (
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// error messages returned by the daemon or registry which are worth retrying. The
+// daemon reports the connection errors of its registry pulls as text
+var retryableMessages = []string{
+	"TLS handshake timeout",
+	"i/o timeout",
+	"connection reset by peer",
+	"connection refused",
+	"500 Internal Server Error",
+	"502 Bad Gateway",
+	"503 Service Unavailable",
+	"504 Gateway Timeout",
+	"received unexpected HTTP status: 5",
+}
+
+// tells transient network and registry errors apart from real build failures
+// like a RUN command returning a non-zero code
+func isRetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	msg := err.Error()
+	if strings.Contains(msg, "returned a non-zero code") {
+		return false
+	}
+
+	// a connection to the daemon which was dropped or couldn't be made. The client
+	// wraps the errors of its requests in a url.Error
+	cause := err
+	if e, ok := err.(*url.Error); ok {
+		cause = e.Err
+	}
+	if cause == io.EOF || cause == io.ErrUnexpectedEOF {
+		return true
+	}
+	if _, ok := cause.(net.Error); ok {
+		return true
+	}
+	if isConnectionError(err) {
+		return true
+	}
+
+	for _, m := range retryableMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runs fn and retries it for retryable errors as many times as configured
+// doubling the wait between each attempt. A cancelled build isn't retried
+func (b *Builder) withRetry(name string, fn func() error) error {
+	backoff := b.Conf.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= b.Conf.Retries || !isRetryableError(err) || b.context().Err() != nil {
+			return err
+		}
+
+		b.Conf.Logger.Warningf("%s failed due to %s. Retrying in %s (%d/%d)", name, err.Error(), backoff, attempt+1, b.Conf.Retries)
+		select {
+		case <-time.After(backoff):
+		case <-b.context().Done():
+			return b.context().Err()
+		}
+		backoff *= 2
+	}
+}
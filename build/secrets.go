@@ -0,0 +1,44 @@
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// step secrets are available as files under this folder in the step container
+const secretsMountPath = "/run/secrets"
+
+// writes the secrets of a step to a private temp folder so it can be mounted
+// into the step container. the caller should remove the folder after the step.
+// secrets are read from their provider so files and environment variables work the same.
+// this needs the docker daemon to run on the same host as Habitus
+func (b *Builder) writeStepSecrets(step *Step) (string, error) {
+	dir, err := ioutil.TempDir("", "habitus-secrets-")
+	if err != nil {
+		return "", err
+	}
+
+	for _, secret := range step.Secrets {
+		if secret.Name != filepath.Base(secret.Name) {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("invalid secret name %s in step %s", secret.Name, step.Name)
+		}
+
+		value, err := b.Build.SecretProviders[secret.Type].GetSecret(secret.Name)
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+		b.AddSecretValue(value)
+
+		err = ioutil.WriteFile(filepath.Join(dir, secret.Name), []byte(value), 0600)
+		if err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+
+	return dir, nil
+}
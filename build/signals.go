@@ -0,0 +1,83 @@
+package build
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// cancels the returned context on SIGINT or SIGTERM. The returned function stops
+// listening for the signals and should be called once the build is over
+func (b *Builder) handleSignals(parent context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(parent)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-signals:
+			b.Conf.Logger.Warningf("Received %s. Stopping the build", sig)
+			cancel()
+		case <-done:
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel()
+	}
+}
+
+func (b *Builder) trackContainer(id string) {
+	b.containersLock.Lock()
+	defer b.containersLock.Unlock()
+
+	if b.containers == nil {
+		b.containers = make(map[string]bool)
+	}
+	b.containers[id] = true
+}
+
+func (b *Builder) untrackContainer(id string) {
+	b.containersLock.Lock()
+	defer b.containersLock.Unlock()
+
+	delete(b.containers, id)
+}
+
+// stops and removes the containers the build created and removes the generated
+// Dockerfiles. This doesn't use the build context as it's cancelled
+func (b *Builder) cleanupCancelledBuild() {
+	b.containersLock.Lock()
+	var ids []string
+	for id := range b.containers {
+		ids = append(ids, id)
+	}
+	b.containers = nil
+	b.containersLock.Unlock()
+
+	for _, id := range ids {
+		b.Conf.Logger.Noticef("Removing container %s of the cancelled build", id)
+		if err := b.docker.StopContainer(id, 0); err != nil {
+			b.Conf.Logger.Debugf("Failed to stop container %s: %s", id, err.Error())
+		}
+		err := b.docker.RemoveContainer(docker.RemoveContainerOptions{ID: id, RemoveVolumes: true, Force: true})
+		if err != nil {
+			b.Conf.Logger.Warningf("Failed to remove container %s: %s", id, err.Error())
+		}
+	}
+
+	if b.Conf.KeepGenerated {
+		return
+	}
+	for _, step := range b.Build.Steps {
+		if err := os.Remove(b.uniqueDockerfile(&step)); err == nil {
+			b.Conf.Logger.Debugf("Removed %s of the cancelled build", b.uniqueDockerfile(&step))
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package build
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/cloud66/habitus/squash"
+	"github.com/docker/go-units"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// exports an image, squashes it into a single layer and loads it back as the step image.
+// The export is streamed into the squash and the squashed image into the load, so the
+// image isn't written to disk as a tar file. The squash still extracts the image layers
+// to a temp folder
+func (b *Builder) squashImage(step *Step, imageID string) error {
+	squasher := squash.Squasher{Conf: b.Conf, Progress: func(p squash.Progress) {
+		if p.Total > 0 {
+			b.Conf.Logger.Infof("Squashing %s: %s %d/%d layers", step.Name, p.Stage, p.Layers, p.Total)
+		} else {
+			b.Conf.Logger.Infof("Squashing %s: %s %s", step.Name, p.Stage, units.HumanSize(float64(p.Bytes)))
+		}
+	}}
+	if err := b.setSquashBoundary(step, &squasher); err != nil {
+		return err
+	}
+
+	exportReader, exportWriter := io.Pipe()
+	// closing the reader stops the export if the squash fails before reading all of it
+	defer exportReader.Close()
+	go func() {
+		b.Conf.Logger.Noticef("Exporting image %s", imageID)
+		err := b.docker.ExportImage(docker.ExportImageOptions{
+			Context:      b.context(),
+			Name:         imageID,
+			OutputStream: exportWriter,
+		})
+		exportWriter.CloseWithError(err)
+	}()
+
+	loadReader, loadWriter := io.Pipe()
+	loadErr := make(chan error, 1)
+	go func() {
+		b.Conf.Logger.Debugf("Loading squashed image into docker")
+		err := b.docker.LoadImage(docker.LoadImageOptions{Context: b.context(), InputStream: loadReader})
+		// stops the squash writing to a load which is over
+		if err != nil {
+			loadReader.CloseWithError(err)
+		} else {
+			loadReader.Close()
+		}
+		loadErr <- err
+	}()
+
+	b.Conf.Logger.Noticef("Squashing image %s", imageID)
+	err := squasher.SquashStream(exportReader, loadWriter, b.uniqueStepName(step))
+	loadWriter.CloseWithError(err)
+	if lerr := <-loadErr; err == nil {
+		err = lerr
+	}
+
+	return err
+}
+
+// sets where the squash of a step starts. A step reference keeps all the layers of
+// that step's image so they can still be shared with it in registries
+func (b *Builder) setSquashBoundary(step *Step, squasher *squash.Squasher) error {
+	if step.SquashFrom == "" || step.SquashFrom == "root" {
+		squasher.From = step.SquashFrom
+		return nil
+	}
+
+	base, err := b.Build.FindStepByLabel(step.SquashFrom)
+	if err != nil {
+		return err
+	}
+	if base == nil {
+		if base, err = b.Build.FindStepByName(step.SquashFrom); err != nil {
+			return err
+		}
+	}
+	if base == nil {
+		// not a step so it's a layer ID
+		squasher.From = step.SquashFrom
+		return nil
+	}
+
+	history, err := b.docker.ImageHistory(b.uniqueStepName(base))
+	if err != nil {
+		return fmt.Errorf("failed to find the layers of %s to squash %s from: %s", base.Name, step.Name, err.Error())
+	}
+	b.Conf.Logger.Debugf("Squashing %s above the %d layers of %s", step.Name, len(history), base.Name)
+	squasher.KeepLayers = len(history)
+
+	return nil
+}
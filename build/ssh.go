@@ -0,0 +1,136 @@
+package build
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// connects to the daemon of a ssh://user@host:port endpoint like the docker CLI does, by
+// running docker system dial-stdio on the host through the ssh command. The ssh config,
+// keys and agent of the user are used as they are
+type sshDialer struct {
+	endpoint *url.URL
+}
+
+// the ssh command for the endpoint
+func (d *sshDialer) command() *exec.Cmd {
+	var args []string
+	if d.endpoint.User != nil {
+		args = append(args, "-l", d.endpoint.User.Username())
+	}
+	if port := d.endpoint.Port(); port != "" {
+		args = append(args, "-p", port)
+	}
+	args = append(args, "--", d.endpoint.Hostname(), "docker", "system", "dial-stdio")
+
+	return exec.Command("ssh", args...)
+}
+
+// the network and address are the ones of the fake endpoint of the client and are not used
+func (d *sshDialer) Dial(network string, address string) (net.Conn, error) {
+	cmd := d.command()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &commandConn{cmd: cmd, stdin: stdin, stdout: stdout}, nil
+}
+
+// a connection to the stdin and stdout of a command
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	once   sync.Once
+}
+
+func (c *commandConn) Read(p []byte) (int, error) {
+	return c.stdout.Read(p)
+}
+
+func (c *commandConn) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+// stops the command. Its exit error is expected as it's killed
+func (c *commandConn) Close() error {
+	c.once.Do(func() {
+		c.stdin.Close()
+		c.cmd.Process.Kill()
+		c.cmd.Wait()
+	})
+
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr {
+	return sshAddr{}
+}
+
+func (c *commandConn) RemoteAddr() net.Addr {
+	return sshAddr{}
+}
+
+// deadlines are not supported on the pipes. The docker client doesn't set them
+func (c *commandConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *commandConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *commandConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type sshAddr struct{}
+
+func (sshAddr) Network() string {
+	return "ssh"
+}
+
+func (sshAddr) String() string {
+	return "ssh"
+}
+
+// creates a client for a ssh:// endpoint. The API calls and the hijacked connections
+// of execs all go through ssh
+func newSSHClient(endpoint *url.URL, apiVersion string) (*docker.Client, error) {
+	if endpoint.Hostname() == "" {
+		return nil, errors.New("no host in the ssh docker host")
+	}
+
+	dialer := &sshDialer{endpoint: endpoint}
+	// the address of the client is only used as the host of the requests
+	client, err := docker.NewVersionedClient("tcp://"+net.JoinHostPort(endpoint.Hostname(), "2375"), apiVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, ok := client.HTTPClient.Transport.(*http.Transport)
+	if !ok {
+		return nil, errors.New("unexpected transport of the docker client")
+	}
+	transport.Dial = dialer.Dial
+	transport.DialContext = nil
+	client.Dialer = dialer
+
+	return client, nil
+}
@@ -0,0 +1,110 @@
+package build
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// the output streams of a step
+type stepStreams struct {
+	out io.Writer
+	err io.Writer
+	// the <step>.log file when step logs are on
+	log *os.File
+	// prefixing writers to flush once the step is done
+	prefixed []*prefixWriter
+}
+
+// sets up the streams of the steps. Output of steps building at the same time is
+// prefixed with the step name. With step logs, the build and command output of a
+// step is also written to a <step>.log file in the step logs folder
+func (b *Builder) openStepStreams() error {
+	if b.Conf.StepLogsDir != "" {
+		if err := os.MkdirAll(b.Conf.StepLogsDir, 0755); err != nil {
+			return err
+		}
+	}
+
+	prefix := false
+	for _, level := range b.Build.buildLevels {
+		if len(level) > 1 {
+			prefix = true
+		}
+	}
+
+	b.streams = make(map[string]*stepStreams)
+	for _, step := range b.Build.Steps {
+		streams := &stepStreams{out: b.OutputStream, err: b.ErrorStream}
+		b.streams[step.Label] = streams
+
+		if prefix {
+			out := newPrefixWriter(streams.out, "["+step.Name+"] ")
+			errs := newPrefixWriter(streams.err, "["+step.Name+"] ")
+			streams.out, streams.err = out, errs
+			streams.prefixed = []*prefixWriter{out, errs}
+		}
+
+		if b.Conf.StepLogsDir != "" {
+			f, err := os.Create(b.stepLogPath(&step))
+			if err != nil {
+				b.closeStepStreams()
+				return err
+			}
+			streams.log = f
+			streams.out = io.MultiWriter(streams.out, f)
+			streams.err = io.MultiWriter(streams.err, f)
+		}
+	}
+
+	return nil
+}
+
+func (b *Builder) closeStepStreams() {
+	for label, streams := range b.streams {
+		for _, p := range streams.prefixed {
+			p.Flush()
+		}
+		if streams.log == nil {
+			continue
+		}
+		if err := streams.log.Close(); err != nil {
+			b.Conf.Logger.Warningf("Failed to close the log of step %s: %s", label, err.Error())
+		}
+	}
+	b.streams = nil
+}
+
+// step labels are used as file names, without the path separators
+func (b *Builder) stepLogPath(step *Step) string {
+	return filepath.Join(b.Conf.StepLogsDir, strings.Replace(step.Label, string(filepath.Separator), "_", -1)+".log")
+}
+
+// the log file of a step or a discarding writer when step logs are off
+func (b *Builder) stepLog(step *Step) io.Writer {
+	if streams, ok := b.streams[step.Label]; ok && streams.log != nil {
+		return streams.log
+	}
+
+	return ioutil.Discard
+}
+
+// the stream the output of a step is written to
+func (b *Builder) stepOutput(step *Step) io.Writer {
+	if streams, ok := b.streams[step.Label]; ok {
+		return streams.out
+	}
+
+	return b.OutputStream
+}
+
+// the stream the errors of a step are written to
+func (b *Builder) stepErrors(step *Step) io.Writer {
+	if streams, ok := b.streams[step.Label]; ok {
+		return streams.err
+	}
+
+	return b.ErrorStream
+}
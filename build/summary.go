@@ -0,0 +1,173 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+// statuses of a step in the build summary
+const (
+	StepBuilt   = "built"
+	StepFailed  = "failed"
+	StepSkipped = "skipped"
+)
+
+// statuses of a build in its result
+const (
+	BuildSucceeded = "succeeded"
+	BuildFailed    = "failed"
+	BuildCancelled = "cancelled"
+)
+
+// StepSummary is the outcome of a step reported at the end of the build. Durations
+// are in nanoseconds in JSON
+type StepSummary struct {
+	Step      string           `json:"step"`
+	Label     string           `json:"label"`
+	Status    string           `json:"status"`
+	Duration  time.Duration    `json:"duration"`
+	Artifacts []CopiedArtifact `json:"artifacts"`
+	ImageID   string           `json:"image_id,omitempty"`
+	Tags      []string         `json:"tags,omitempty"`
+	Size      int64            `json:"size,omitempty"`
+}
+
+// CopiedArtifact is an artifact copied from a step container to the host
+type CopiedArtifact struct {
+	Source string `json:"source"`
+	Dest   string `json:"dest"`
+}
+
+// BuildResult is the outcome of a build for callers embedding the builder. It is
+// also the payload of the build notification
+type BuildResult struct {
+	Status   string        `json:"status"`
+	Error    string        `json:"error,omitempty"`
+	Started  time.Time     `json:"started"`
+	Finished time.Time     `json:"finished"`
+	Duration time.Duration `json:"duration"`
+	Steps    []StepSummary `json:"steps"`
+	// short SHA of the workdir when the images are tagged with it
+	GitSHA string `json:"git_sha,omitempty"`
+}
+
+// the result holds a copy of the summaries so it doesn't change after the build
+func (b *Builder) buildResult(start time.Time, err error) *BuildResult {
+	status := BuildSucceeded
+	if err == context.Canceled {
+		status = BuildCancelled
+	} else if err != nil {
+		status = BuildFailed
+	}
+
+	finished := time.Now()
+	return &BuildResult{
+		Status:   status,
+		Error:    errorString(err),
+		Started:  start,
+		Finished: finished,
+		Duration: finished.Sub(start),
+		Steps:    b.Summaries(),
+		GitSHA:   b.gitSHA,
+	}
+}
+
+// creates an empty summary for each step. steps which never run stay skipped
+func (b *Builder) initSummaries() {
+	b.summaries = make(map[string]*StepSummary)
+	for _, s := range b.Build.Steps {
+		b.summaries[s.Label] = &StepSummary{Step: s.Name, Label: s.Label, Status: StepSkipped}
+	}
+}
+
+// the summary entries are created before the steps run and each one is only
+// changed by the goroutine of its step
+func (b *Builder) stepSummary(step *Step) *StepSummary {
+	if b.summaries == nil {
+		return nil
+	}
+
+	return b.summaries[step.Label]
+}
+
+func (b *Builder) recordArtifacts(step *Step, artifacts []CopiedArtifact) {
+	if s := b.stepSummary(step); s != nil {
+		s.Artifacts = artifacts
+	}
+}
+
+func (b *Builder) recordStep(step *Step, duration time.Duration, err error) {
+	s := b.stepSummary(step)
+	if s == nil {
+		return
+	}
+
+	s.Duration = duration
+	s.Status = StepBuilt
+	if err != nil {
+		s.Status = StepFailed
+	}
+}
+
+// Summaries returns the outcome of each step of the last build in build order
+func (b *Builder) Summaries() []StepSummary {
+	var summaries []StepSummary
+	for _, level := range b.Build.buildLevels {
+		for _, step := range level {
+			if s := b.stepSummary(&step); s != nil {
+				summaries = append(summaries, *s)
+			}
+		}
+	}
+
+	return summaries
+}
+
+// adds the image of the built steps to their summary and prints the summary table.
+// this runs before the unwanted images are removed
+func (b *Builder) printSummary() {
+	for _, level := range b.Build.buildLevels {
+		for _, step := range level {
+			s := b.stepSummary(&step)
+			if s == nil || s.Status != StepBuilt {
+				continue
+			}
+
+			image, err := b.docker.InspectImage(b.uniqueStepName(&step))
+			if err != nil {
+				b.Conf.Logger.Debugf("Failed to inspect the image of %s: %s", step.Name, err.Error())
+				continue
+			}
+			s.ImageID = image.ID
+			s.Size = image.Size
+			s.Tags = append([]string{b.uniqueStepName(&step)}, b.stepTags(&step)...)
+		}
+	}
+
+	w := tabwriter.NewWriter(b.OutputStream, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STEP\tSTATUS\tDURATION\tARTIFACTS\tIMAGE\tSIZE")
+	for _, s := range b.Summaries() {
+		image, size := "-", "-"
+		if s.ImageID != "" {
+			image = shortImageID(s.ImageID)
+			size = units.HumanSize(float64(s.Size))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", s.Step, s.Status, s.Duration-s.Duration%time.Millisecond, len(s.Artifacts), image, size)
+	}
+	w.Flush()
+}
+
+func shortImageID(id string) string {
+	if len(id) > 7 && id[:7] == "sha256:" {
+		id = id[7:]
+	}
+	if len(id) > 12 {
+		id = id[:12]
+	}
+
+	return id
+}
@@ -0,0 +1,77 @@
+package build
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+
+	"github.com/cloud66/habitus/configuration"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// TLS versions the connection to the daemon can start at
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// the TLS config of the connection to the daemon with the client certificate of the
+// docker cert folder. The daemon is verified with its ca.pem unless verification is skipped
+func daemonTLSConfig(conf *configuration.Config) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(conf.DockerCert, "cert.pem"), filepath.Join(conf.DockerCert, "key.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if conf.TLSMinVersion != "" {
+		version, ok := tlsVersions[conf.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid TLS version %s. Use 1.0, 1.1, 1.2 or 1.3", conf.TLSMinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if conf.InsecureSkipVerify {
+		config.InsecureSkipVerify = true
+		return config, nil
+	}
+
+	ca, err := ioutil.ReadFile(filepath.Join(conf.DockerCert, "ca.pem"))
+	if err != nil {
+		return nil, err
+	}
+	config.RootCAs = x509.NewCertPool()
+	if !config.RootCAs.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificate found in ca.pem")
+	}
+
+	return config, nil
+}
+
+// creates a client for a TCP daemon using the TLS config for the API calls and the
+// hijacked connections of execs
+func newTLSClient(endpoint *url.URL, config *tls.Config, apiVersion string) (*docker.Client, error) {
+	https := *endpoint
+	https.Scheme = "https"
+	client, err := docker.NewVersionedClient(https.String(), apiVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, ok := client.HTTPClient.Transport.(*http.Transport)
+	if !ok {
+		return nil, errors.New("unexpected transport of the docker client")
+	}
+	transport.TLSClientConfig = config
+	client.TLSConfig = config
+
+	return client, nil
+}
@@ -0,0 +1,178 @@
+package build
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// docker volume names, as used for artifact volumes
+var volumeNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Validate checks the manifest for missing or conflicting fields and returns
+// an error listing all the problems found, referencing the step labels
+func (m *Manifest) Validate() error {
+	var problems []string
+	problem := func(step *Step, format string, args ...interface{}) {
+		location := fmt.Sprintf("step '%s'", step.Label)
+		if line, ok := m.stepLines[step.Label]; ok {
+			location = fmt.Sprintf("%s (line %d)", location, line)
+		}
+		problems = append(problems, location+": "+fmt.Sprintf(format, args...))
+	}
+
+	names := make(map[string]string)
+	for idx := range m.Steps {
+		step := &m.Steps[idx]
+
+		if step.Name == "" {
+			problem(step, "missing name")
+		} else if other, ok := names[step.Name]; ok {
+			problem(step, "name '%s' is already used by step '%s'", step.Name, other)
+		} else {
+			names[step.Name] = step.Label
+		}
+
+		if step.Dockerfile == "" && step.DockerfileInline == "" {
+			problem(step, "missing dockerfile")
+		} else if step.Dockerfile != "" && step.DockerfileInline != "" {
+			problem(step, "dockerfile and dockerfile_inline can't be used together")
+		} else if step.Dockerfile == stdinDockerfile {
+			problem(step, "the dockerfile is read from the input but none was given")
+		}
+
+		if step.CacheMode != "" && step.CacheMode != cacheModeContent {
+			problem(step, "cache_mode '%s' is not supported. Use %s", step.CacheMode, cacheModeContent)
+		}
+		if step.CPUs < 0 {
+			problem(step, "cpus can't be negative")
+		}
+
+		for vidx, volume := range step.Volumes {
+			host, rest := splitHostVolume(volume)
+			parts := strings.Split(rest, ":")
+			target := path.Clean(parts[0])
+			switch {
+			case host == "" || parts[0] == "":
+				problem(step, "volume %d '%s' is not host:container", vidx+1, volume)
+			case !path.IsAbs(target):
+				problem(step, "volume %d container path %s is not absolute", vidx+1, parts[0])
+			case len(parts) > 2 || (len(parts) == 2 && parts[1] != "ro" && parts[1] != "rw"):
+				problem(step, "volume %d '%s' has an invalid mode. Use ro or rw", vidx+1, volume)
+			case pathsOverlap(target, artifactVolumesPath) || pathsOverlap(target, secretsMountPath):
+				problem(step, "volume %d container path %s is used by habitus", vidx+1, parts[0])
+			}
+		}
+
+		for _, name := range step.cacheNames() {
+			target := path.Clean(step.Caches[name])
+			if !volumeNamePattern.MatchString(name) {
+				problem(step, "cache '%s' is not a valid volume name", name)
+			}
+			if !path.IsAbs(target) {
+				problem(step, "cache %s path %s is not absolute", name, step.Caches[name])
+			} else if pathsOverlap(target, artifactVolumesPath) || pathsOverlap(target, secretsMountPath) {
+				problem(step, "cache %s path %s is used by habitus", name, step.Caches[name])
+			}
+		}
+
+		for aidx, art := range step.Artifacts {
+			if art.Source == "" {
+				problem(step, "artifact %d has no source", aidx+1)
+			}
+			if art.As != "" {
+				if art.As == "." || art.As == ".." || strings.ContainsAny(art.As, "/\\") {
+					problem(step, "artifact %d name %s is not a file name", aidx+1, art.As)
+				}
+				if strings.ContainsAny(art.Source, "*?[") {
+					problem(step, "artifact %d can't be renamed as its source is a glob", aidx+1)
+				}
+			}
+			if art.Archive != "" && art.Archive != archiveTarGz {
+				problem(step, "artifact %d archive '%s' is not supported. Use %s", aidx+1, art.Archive, archiveTarGz)
+			}
+			if art.SHA256 != "" && !sha256Pattern.MatchString(art.SHA256) {
+				problem(step, "artifact %d sha256 %s is not a sha256 checksum", aidx+1, art.SHA256)
+			}
+			if art.Volume != "" {
+				if art.SHA256 != "" {
+					problem(step, "artifact %d can't have a sha256 as it is copied to a volume", aidx+1)
+				}
+				if art.Archive != "" {
+					problem(step, "artifact %d can't be archived as it is copied to a volume", aidx+1)
+				}
+				if !volumeNamePattern.MatchString(art.Volume) {
+					problem(step, "artifact %d volume '%s' is not a valid volume name", aidx+1, art.Volume)
+				}
+				if dest := path.Clean("./" + art.Dest); dest == ".." || strings.HasPrefix(dest, "../") {
+					problem(step, "artifact %d destination %s is outside its volume", aidx+1, art.Dest)
+				}
+				if art.PostCopy != "" {
+					problem(step, "artifact %d can't have a post copy command as it is copied to a volume", aidx+1)
+				}
+				continue
+			}
+			if dest := filepath.Clean(art.Dest); !filepath.IsAbs(dest) && (dest == ".." || strings.HasPrefix(dest, "../")) {
+				problem(step, "artifact %d destination %s is outside the work directory. Use an absolute path instead", aidx+1, art.Dest)
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid build file:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
+
+// is one of the absolute paths the other one or in it. A mount on either hides the other
+func pathsOverlap(a string, b string) bool {
+	return a == "/" || b == "/" || a == b || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
+// finds the line each step is defined on in the build file. this is a best effort
+// for error messages, so it only looks for step keys under the steps key
+func findStepLines(data []byte) map[string]int {
+	lines := make(map[string]int)
+	keyRegex := regexp.MustCompile(`^(\s*)([^\s#:]+):`)
+
+	stepsIndent := -1
+	stepIndent := -1
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		match := keyRegex.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		indent := len(match[1])
+		key := strings.Trim(match[2], `"'`)
+
+		if stepsIndent >= 0 && indent <= stepsIndent {
+			// left the steps section
+			stepsIndent = -1
+		}
+
+		if stepsIndent < 0 {
+			if key == "steps" {
+				stepsIndent = indent
+				stepIndent = -1
+			}
+			continue
+		}
+
+		if stepIndent < 0 {
+			stepIndent = indent
+		}
+		if indent == stepIndent {
+			lines[key] = line
+		}
+	}
+
+	return lines
+}
@@ -0,0 +1,125 @@
+package build
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// artifact volumes are mounted in the step containers under this folder, one folder per volume
+const artifactVolumesPath = "/habitus/volumes"
+
+// the docker volume of an artifact volume. It is unique to the builder session so
+// concurrent builds don't share their artifacts
+func (b *Builder) artifactVolume(name string) string {
+	if b.builderId == "" {
+		return "habitus-" + name
+	}
+
+	return "habitus-" + name + "-" + b.builderId
+}
+
+// returns the path of an artifact in its volume, as mounted in the step containers
+func volumeArtifactPath(a *Artifact) string {
+	return path.Join(artifactVolumesPath, a.Volume, a.Dest, a.fileName())
+}
+
+// the volumes a step container mounts. These are the volumes the step artifacts
+// are copied to and the ones the artifacts of its dependencies are in
+func (b *Builder) stepVolumes(step *Step) []string {
+	volumes := make(map[string]bool)
+	addVolumes := func(s *Step) {
+		for _, a := range s.Artifacts {
+			if a.Volume != "" {
+				volumes[a.Volume] = true
+			}
+		}
+	}
+
+	addVolumes(step)
+	for _, dep := range step.DependsOn {
+		if found, _ := b.Build.FindStepByLabel(dep.Label); found != nil {
+			addVolumes(found)
+		}
+	}
+
+	var names []string
+	for name := range volumes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// bind mounts of the volumes of a step container
+func (b *Builder) volumeBinds(step *Step) []string {
+	var binds []string
+	for _, name := range b.stepVolumes(step) {
+		binds = append(binds, b.artifactVolume(name)+":"+path.Join(artifactVolumesPath, name))
+	}
+
+	return binds
+}
+
+// bind mounts of the host folders of a step container. Artifacts in these folders are
+// copied from the host folder, as the container archive includes its mounts
+func (b *Builder) hostBinds(step *Step) []string {
+	var binds []string
+	for _, volume := range step.Volumes {
+		host, rest := splitHostVolume(volume)
+		if !filepath.IsAbs(host) {
+			host = filepath.Join(b.Conf.Workdir, host)
+		}
+		binds = append(binds, host+":"+rest)
+	}
+
+	return binds
+}
+
+// splits a host volume into the host path and the container path with its mode
+func splitHostVolume(volume string) (string, string) {
+	parts := strings.SplitN(volume, ":", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+
+	return parts[0], parts[1]
+}
+
+// copies an artifact to its volume inside the running step container
+func (b *Builder) copyToVolume(step *Step, containerID string, a *Artifact) error {
+	dest := volumeArtifactPath(a)
+	b.Conf.Logger.Infof("Copying from %s to %s in volume %s", a.Source, dest, a.Volume)
+
+	cmd := fmt.Sprintf("mkdir -p %s && cp -a %s %s", shellQuote(path.Dir(dest)), shellQuote(a.Source), shellQuote(dest))
+	out, exitCode, err := b.execOutput(step, containerID, cmd)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("failed to copy artifact %s to volume %s: %s", a.Source, a.Volume, out)
+	}
+
+	return nil
+}
+
+// removes the artifact volumes of the build. Failures are only warned about
+func (b *Builder) removeArtifactVolumes() {
+	removed := make(map[string]bool)
+	for _, step := range b.Build.Steps {
+		for _, a := range step.Artifacts {
+			if a.Volume == "" || removed[a.Volume] {
+				continue
+			}
+			removed[a.Volume] = true
+
+			b.Conf.Logger.Debugf("Removing artifact volume %s", b.artifactVolume(a.Volume))
+			if err := b.docker.RemoveVolume(b.artifactVolume(a.Volume)); err != nil {
+				b.Conf.Logger.Warningf("Failed to remove artifact volume %s: %s", b.artifactVolume(a.Volume), err.Error())
+			}
+		}
+	}
+}
@@ -3,10 +3,18 @@ package configuration
 import (
 	"errors"
 	"strings"
+	"time"
 
 	"github.com/op/go-logging"
 )
 
+const (
+	// ArtifactsNoticeWarn logs a warning when a step with artifacts produces none
+	ArtifactsNoticeWarn = "warn"
+	// ArtifactsNoticeStrict fails the build when a step with artifacts produces none
+	ArtifactsNoticeStrict = "strict"
+)
+
 type TupleItem struct {
 	Key   string
 	Value string
@@ -20,6 +28,7 @@ type Config struct {
 	Workdir             string
 	NoCache             bool
 	SuppressOutput      bool
+	Quiet               bool
 	RmTmpContainers     bool
 	ForceRmTmpContainer bool
 	UniqueID            string
@@ -28,16 +37,52 @@ type Config struct {
 	DockerCert          string
 	EnvVars             TupleArray
 	BuildArgs           TupleArray
+	BuildArgsFile       string
+	BuildEnv            string
 	KeepSteps           bool
 	KeepArtifacts       bool
 	NoSquash            bool
 	NoPruneRmImages     bool
 	UseTLS              bool
+	InsecureSkipVerify  bool
+	TLSMinVersion       string
 	FroceRmImages       bool
 	ApiPort             int
 	ApiBinding          string
 	SecretService       bool
 	SecretProviders     string
+	ArtifactsNotice     string
+	Retries             int
+	RetryBackoff        time.Duration
+	IsolateNetworks     bool
+	EventsFile          string
+	DryRun              bool
+	StrictEnv           bool
+	UseBuildKit         bool
+	Platform            string
+	NetworkMode         string
+	CacheFrom           string
+	StrictCleanup       bool
+	KeepGenerated       bool
+	GeneratedDir        string
+	BuildfileAuth       string
+	TempDir             string
+	Labels              TupleArray
+	HandleSignals       bool
+	DebugOnFailure      bool
+	ArtifactChecksums   bool
+	NoColor             bool
+	StepLogsDir         string
+	NotifyURL           string
+	SlackWebhook        string
+	BuildTimeout        time.Duration
+	TagGitSHA           bool
+	WriteBuildInfo      string
+	Incremental         bool
+	OutputDir           string
+	Podman              bool
+	IDMap               string
+	IgnoreOwnership     bool
 }
 
 func (i *TupleArray) String() string {
@@ -66,6 +111,17 @@ func (i *TupleArray) Find(key string) string {
 	return ""
 }
 
+// Has returns true if there is an item with the key
+func (i *TupleArray) Has(key string) bool {
+	for _, item := range *i {
+		if item.Key == key {
+			return true
+		}
+	}
+
+	return false
+}
+
 // CreateConfig creates a new configuration object
 func CreateConfig() Config {
 	return Config{}
@@ -0,0 +1,104 @@
+package configuration
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ReadEnvFile reads the KEY=VALUE lines of a .env style file. Empty lines and lines
+// starting with # are skipped, a leading export is allowed and values can be single
+// quoted (as is) or double quoted (with \n, \" and \\ escapes)
+func ReadEnvFile(path string) (TupleArray, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	items, err := parseEnvFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	return items, nil
+}
+
+func parseEnvFile(r io.Reader) (TupleArray, error) {
+	var items TupleArray
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		idx := strings.Index(line, "=")
+		if idx < 0 {
+			return nil, fmt.Errorf("line %d: invalid key/value format (key=value)", lineNo)
+		}
+		key := strings.TrimSpace(line[:idx])
+		if !envKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("line %d: invalid key %q", lineNo, key)
+		}
+
+		value, err := parseEnvValue(strings.TrimSpace(line[idx+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNo, err.Error())
+		}
+
+		items = append(items, TupleItem{Key: key, Value: value})
+	}
+
+	return items, scanner.Err()
+}
+
+func parseEnvValue(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	switch value[0] {
+	case '\'':
+		end := strings.Index(value[1:], "'")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated quote in %s", value)
+		}
+		return value[1 : end+1], nil
+	case '"':
+		var unquoted []byte
+		for i := 1; i < len(value); i++ {
+			switch value[i] {
+			case '"':
+				return string(unquoted), nil
+			case '\\':
+				if i+1 < len(value) {
+					i++
+					if value[i] == 'n' {
+						unquoted = append(unquoted, '\n')
+					} else {
+						unquoted = append(unquoted, value[i])
+					}
+					continue
+				}
+			}
+			unquoted = append(unquoted, value[i])
+		}
+		return "", fmt.Errorf("unterminated quote in %s", value)
+	}
+
+	// unquoted values can end with a comment
+	if idx := strings.Index(value, " #"); idx >= 0 {
+		value = strings.TrimSpace(value[:idx])
+	}
+
+	return value, nil
+}
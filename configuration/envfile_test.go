@@ -0,0 +1,37 @@
+package configuration
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Env files", func() {
+	It("reads keys and values with comments and quotes", func() {
+		items, err := parseEnvFile(strings.NewReader(`
+# registry settings
+REGISTRY=registry.example.com # the private one
+export VERSION=1.2
+GREETING="hello \"world\"\nbye"
+PATTERN='$HOME #not a comment'
+EMPTY=
+`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(items).To(Equal(TupleArray{
+			{Key: "REGISTRY", Value: "registry.example.com"},
+			{Key: "VERSION", Value: "1.2"},
+			{Key: "GREETING", Value: "hello \"world\"\nbye"},
+			{Key: "PATTERN", Value: "$HOME #not a comment"},
+			{Key: "EMPTY", Value: ""},
+		}))
+	})
+
+	It("reports the line of invalid entries", func() {
+		_, err := parseEnvFile(strings.NewReader("VERSION=1.2\nnot an entry\n"))
+		Expect(err).To(MatchError("line 2: invalid key/value format (key=value)"))
+
+		_, err = parseEnvFile(strings.NewReader("TOKEN=\"abc\n"))
+		Expect(err).To(MatchError("line 1: unterminated quote in \"abc"))
+	})
+})
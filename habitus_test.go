@@ -0,0 +1,33 @@
+package main_test
+
+import (
+	"os"
+	"os/exec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Habitus", func() {
+	Describe("log colors", func() {
+		// an invalid flag value is the first thing habitus logs
+		run := func(env []string, args ...string) string {
+			cmd := exec.Command(binPath, append(args, "-artifacts-notice", "bogus")...)
+			cmd.Env = append(os.Environ(), env...)
+			out, err := cmd.CombinedOutput()
+			Expect(err).To(HaveOccurred())
+			Expect(string(out)).To(ContainSubstring("Invalid artifacts-notice value 'bogus'"))
+			return string(out)
+		}
+
+		It("logs without color with no-color", func() {
+			Expect(run(nil, "-no-color")).NotTo(ContainSubstring("\x1b["))
+			Expect(run(nil, "-no-color=false")).To(ContainSubstring("\x1b["))
+		})
+
+		It("logs without color by default when NO_COLOR is set or the logs don't go to a terminal", func() {
+			Expect(run([]string{"NO_COLOR=1"})).NotTo(ContainSubstring("\x1b["))
+			Expect(run([]string{"NO_COLOR="})).NotTo(ContainSubstring("\x1b["))
+		})
+	})
+})
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/cloud66/habitus/build"
 	"github.com/cloud66/habitus/configuration"
@@ -16,6 +18,9 @@ import (
 var prettyFormat = logging.MustStringFormatter(
 	"%{color}▶ %{message} %{color:reset}",
 )
+var prettyNoColorFormat = logging.MustStringFormatter(
+	"▶ %{message}",
+)
 var plainFormat = logging.MustStringFormatter(
 	"[%{level}] - %{message}",
 )
@@ -25,6 +30,7 @@ var (
 	flagShowHelp    bool
 	flagShowVersion bool
 	flagPrettyLog   bool
+	flagUIDFromGit  bool
 	VERSION         string = "dev"
 	BUILD_DATE      string = ""
 )
@@ -44,36 +50,76 @@ func main() {
 	logging.SetFormatter(plainFormat)
 
 	config := configuration.CreateConfig()
-	flag.StringVar(&config.Buildfile, "f", "build.yml", "Build file path. Defaults to build.yml in the workdir")
+	flag.StringVar(&config.Buildfile, "f", "build.yml", "Build file path or http(s) URL. Defaults to build.yml in the workdir")
+	flag.StringVar(&config.BuildfileAuth, "f-auth", os.Getenv("HABITUS_BUILDFILE_AUTH"), "Authorization header used to fetch a build file URL and the includes on its host. Uses HABITUS_BUILDFILE_AUTH if missing")
 	flag.StringVar(&config.Workdir, "d", "", "Work directory for this build. Defaults to the current directory")
 	flag.BoolVar(&config.NoCache, "no-cache", false, "Don't use cache in build")
 	flag.BoolVar(&config.SuppressOutput, "suppress", false, "Suppress build output")
+	flag.BoolVar(&config.Quiet, "quiet", false, "Only display warnings and errors. Implies suppress")
 	flag.BoolVar(&config.RmTmpContainers, "rm", true, "Remove intermediate containers")
 	flag.BoolVar(&config.ForceRmTmpContainer, "force-rm", false, "Force remove intermediate containers")
 	flag.StringVar(&config.UniqueID, "uid", "", "Unique ID for the build. Used only for multi-tenanted build environments")
+	flag.BoolVar(&config.TagGitSHA, "tag-git-sha", false, "Also tag each step image with the short git SHA of the workdir, like name:1a2b3c4")
+	flag.BoolVar(&flagUIDFromGit, "uid-from-git", false, "Use the git branch and commit of the workdir as the unique ID when uid is not provided")
 	flag.StringVar(&flagLevel, "level", "debug", "Log level: debug, info, notice, warning, error and critical")
 	flag.BoolVar(&flagPrettyLog, "pretty", true, "Display logs with color and formatting")
-	flag.StringVar(&config.DockerHost, "host", os.Getenv("DOCKER_HOST"), "Docker host link. Uses DOCKER_HOST if missing")
+	flag.BoolVar(&config.NoColor, "no-color", os.Getenv("NO_COLOR") != "" || !isTerminal(os.Stderr), "Display logs without color. Defaults to true when NO_COLOR is set or the logs don't go to a terminal")
+	flag.StringVar(&config.DockerHost, "host", os.Getenv("DOCKER_HOST"), "Docker host link: unix://, tcp:// or ssh://user@host. Uses DOCKER_HOST if missing")
 	flag.StringVar(&config.DockerCert, "certs", os.Getenv("DOCKER_CERT_PATH"), "Docker cert folder. Uses DOCKER_CERT_PATH if missing")
 	flag.Var(&config.EnvVars, "env", "Environment variables to be used during build. Uses parent process environment variables if empty")
+	flag.BoolVar(&config.StrictEnv, "strict-env", false, "Fail when the build file uses an undefined environment variable. Use $$ for a $ which isn't a habitus variable, like the ones of the step commands")
 	flag.Var(&config.BuildArgs, "build", "Build arguments to be used during build.")
-	flag.BoolVar(&config.KeepSteps, "keep-all", false, "Overrides the keep flag for all steps. Used for debugging")
+	flag.StringVar(&config.BuildEnv, "build-env", "", "Environment variables passed as build args with the same name, so their values aren't on the command line. Comma separated")
+	flag.StringVar(&config.BuildArgsFile, "build-args-file", "", "File of KEY=VALUE build arguments, like a .env file. The build flags override it")
+	flag.Var(&config.Labels, "label", "Labels added to all the step images (key=value)")
+	flag.BoolVar(&config.KeepSteps, "keep-all", false, "Keep the images of all steps. Without it, the images of the steps other steps depend on are removed at the end of the build, unless they are a parent of a kept image. The final steps nothing depends on are kept")
 	flag.BoolVar(&config.KeepArtifacts, "keep-artifacts", false, "Keep the temporary artifacts created on the host during build. Used for debugging")
+	flag.BoolVar(&config.DebugOnFailure, "debug-on-failure", false, "Leave the container of a step running when its command or a cleanup command fails, to attach to it for debugging")
+	flag.BoolVar(&config.KeepGenerated, "keep-generated", false, "Keep the generated Dockerfiles next to the original ones. Used for debugging")
+	flag.StringVar(&config.GeneratedDir, "generated-dir", "", "Save a copy of the generated Dockerfile of each step to this folder, as <step>.Dockerfile")
+	flag.StringVar(&config.TempDir, "temp-dir", "", "Folder for the intermediate files of image exports and squashes. Defaults to the system temp folder")
 	flag.BoolVar(&config.UseTLS, "use-tls", true, "Uses TLS connection with Docker daemon")
+	flag.StringVar(&config.TLSMinVersion, "tls-min-version", "1.2", "Oldest TLS version used with the Docker daemon: 1.0, 1.1, 1.2 or 1.3")
+	flag.BoolVar(&config.InsecureSkipVerify, "tls-skip-verify", false, "Don't verify the certificate of the Docker daemon, like for self-signed daemons. No CA is needed then")
 	flag.BoolVar(&config.NoSquash, "no-cleanup", false, "Skip cleanup commands for this run. Used for debugging")
 	flag.BoolVar(&config.FroceRmImages, "force-rmi", false, "Force remove of unwanted images")
 	flag.BoolVar(&config.NoPruneRmImages, "noprune-rmi", false, "No pruning of unwanted images")
+	flag.BoolVar(&config.StrictCleanup, "strict-cleanup", false, "Fail the build when unwanted images can't be removed")
+	flag.BoolVar(&config.HandleSignals, "handle-signals", false, "Stop the build and remove its containers and generated Dockerfiles on SIGINT or SIGTERM")
 	flag.BoolVar(&flagShowHelp, "help", false, "Display the help")
 	flag.BoolVar(&flagShowVersion, "version", false, "Display version information")
 	flag.IntVar(&config.ApiPort, "port", 8080, "Port to server the API")
 	flag.StringVar(&config.ApiBinding, "binding", "192.168.99.1", "Network address to bind the API to. (see documentation for more info)")
 	flag.BoolVar(&config.SecretService, "secrets", true, "Turn Secrets Service on or off")
-	flag.StringVar(&config.SecretProviders, "sec-providers", "file", "All available secret providers. Comma separated")
+	flag.StringVar(&config.SecretProviders, "sec-providers", "file,env", "All available secret providers. Comma separated")
+	flag.IntVar(&config.Retries, "retries", 0, "Number of times to retry a build step after a transient docker or registry error")
+	flag.DurationVar(&config.RetryBackoff, "retry-backoff", 2*time.Second, "Wait before the first retry. Doubles after each retry")
+	flag.DurationVar(&config.BuildTimeout, "timeout", 0, "Stop the whole build when it takes longer than this, like 30m. No timeout by default")
+	flag.BoolVar(&config.IsolateNetworks, "isolate-networks", false, "Run the container of each step in its own network which is removed after the step")
+	flag.StringVar(&config.Platform, "platform", "", "Default target platform of the step images, like linux/amd64. Builds with BuildKit when set")
+	flag.StringVar(&config.NetworkMode, "network", "", "Default network mode of the step builds and containers, like host. Builds with BuildKit when set")
+	flag.StringVar(&config.CacheFrom, "cache-from", "", "Default images to use as a build cache. Comma separated. Builds with BuildKit when set")
+	flag.BoolVar(&config.UseBuildKit, "buildkit", os.Getenv("DOCKER_BUILDKIT") == "1", "Build with BuildKit through the docker CLI. Uses DOCKER_BUILDKIT if missing")
+	flag.BoolVar(&config.DryRun, "dry-run", false, "Print the build plan without building anything")
+	flag.BoolVar(&config.Incremental, "incremental", false, "Don't build the steps whose image was built from the same context, Dockerfile, build args and step images")
+	flag.BoolVar(&config.Podman, "podman", false, "Work around the differences of the Podman Docker API, like reading podman's auth.json. Detected from the daemon if missing")
+	flag.StringVar(&config.OutputDir, "output", "", "Also save each step image to <step>.tar in this folder, like docker save. The output of a step in the build file wins")
+	flag.StringVar(&config.StepLogsDir, "step-logs", "", "Also write the build and command output of each step to <step>.log in this folder. Use with quiet to only write them to the files")
+	flag.StringVar(&config.NotifyURL, "notify-url", "", "POST the build result as JSON to this URL when the build finishes")
+	flag.StringVar(&config.SlackWebhook, "slack-webhook", os.Getenv("HABITUS_SLACK_WEBHOOK"), "Slack incoming webhook URL to post the build result to. Uses HABITUS_SLACK_WEBHOOK if missing")
+	flag.StringVar(&config.EventsFile, "events", "", "Write structured build events as JSON lines to this file")
+	flag.StringVar(&config.WriteBuildInfo, "build-info", "", "Write the build result with the step images and the git SHA as JSON to this file at the end of the build. Relative to the workdir")
+	flag.BoolVar(&config.ArtifactChecksums, "artifact-checksums", false, "Write a <file>.sha256 file next to each artifact copied to the host")
+	flag.StringVar(&config.IDMap, "id-map", "", "Container to host id ranges of a daemon with a user namespace, as container:host:size. Comma separated. The owners of artifacts copied as root are mapped with them")
+	flag.BoolVar(&config.IgnoreOwnership, "ignore-ownership", false, "Don't copy the owner of artifacts from the containers, only their mode. Like ignore_ownership on all the steps")
+	flag.StringVar(&config.ArtifactsNotice, "artifacts-notice", "", "Notify when a step with artifacts produces none on the host: warn or strict (fails the build)")
 
 	config.Logger = *log
 	flag.Parse()
 
-	if flagPrettyLog {
+	if flagPrettyLog && config.NoColor {
+		logging.SetFormatter(prettyNoColorFormat)
+	} else if flagPrettyLog {
 		logging.SetFormatter(prettyFormat)
 	}
 
@@ -97,8 +143,25 @@ func main() {
 		fmt.Println("Invalid log level value. Falling back to debug")
 		level = logging.DEBUG
 	}
+	if config.Quiet {
+		level = logging.WARNING
+		config.SuppressOutput = true
+	}
 	logging.SetLevel(level, "habitus")
 
+	if config.ArtifactsNotice != "" && config.ArtifactsNotice != configuration.ArtifactsNoticeWarn && config.ArtifactsNotice != configuration.ArtifactsNoticeStrict {
+		log.Fatalf("Invalid artifacts-notice value '%s'. Valid values are warn and strict", config.ArtifactsNotice)
+	}
+
+	if config.BuildArgsFile != "" {
+		fileArgs, err := configuration.ReadEnvFile(config.BuildArgsFile)
+		if err != nil {
+			log.Fatalf("Failed to read the build args file: %s", err.Error())
+		}
+		// later args win so the command line ones override the file
+		config.BuildArgs = append(fileArgs, config.BuildArgs...)
+	}
+
 	if config.Workdir == "" {
 		if curr, err := os.Getwd(); err != nil {
 			log.Fatal("Failed to get the current directory")
@@ -108,34 +171,95 @@ func main() {
 		}
 	}
 
+	if config.UniqueID == "" && flagUIDFromGit {
+		config.UniqueID = build.UniqueIDFromGit(config.Workdir)
+		log.Infof("Using '%s' as the unique ID", config.UniqueID)
+	}
+
 	if config.Buildfile == "build.yml" {
 		config.Buildfile = filepath.Join(config.Workdir, "build.yml")
 	}
 
+	// the errors of the build file can hold its authorization header or the build env values
+	masked := build.MaskedLogger(&config)
 	c, err := build.LoadBuildFromFile(&config)
 	if err != nil {
-		log.Fatalf("Failed: %s", err.Error())
+		masked.Fatalf("Failed: %s", err.Error())
+	}
+	// a step with - as dockerfile reads it from stdin
+	if err := c.ReadDockerfileInput(os.Stdin); err != nil {
+		masked.Fatalf("Failed: %s", err.Error())
 	}
 
-	if c.IsPrivileged && os.Getenv("SUDO_USER") == "" {
+	// print the step graph without building
+	if flag.Arg(0) == "graph" {
+		fmt.Print(c.ToDOT(config.Workdir))
+		return
+	}
+
+	if c.IsPrivileged && os.Getenv("SUDO_USER") == "" && !config.DryRun {
 		log.Fatal("Some of the build steps require admin privileges (sudo). Please run with sudo\nYou might want to use --certs=$DOCKER_CERT_PATH --host=$DOCKER_HOST params to make sure all environment variables are available to the process")
 		os.Exit(1)
 	}
 
 	b := build.NewBuilder(c, &config)
 
-	if config.SecretService {
+	if config.EventsFile != "" {
+		eventsFile, err := os.Create(config.EventsFile)
+		if err != nil {
+			b.Conf.Logger.Fatalf("Cannot create events file %s", err.Error())
+		}
+		defer eventsFile.Close()
+		b.Events = build.NewJSONEventSink(eventsFile)
+	}
+
+	if config.SecretService && !config.DryRun {
 		// start the API
 		api := &server{builder: b}
 		err = api.StartServer()
 		if err != nil {
-			log.Fatalf("Cannot start API server due to %s", err.Error())
+			b.Conf.Logger.Fatalf("Cannot start API server due to %s", err.Error())
 			os.Exit(2)
 		}
 	}
 
-	err = b.StartBuild()
+	_, err = b.StartBuild(context.Background())
+	if err != nil {
+		// logged with the builder logger so the secrets of the build are masked
+		b.Conf.Logger.Errorf("Error during build %s", err.Error())
+		os.Exit(exitCode(err))
+	}
+}
+
+// true when the file is a terminal rather than a pipe or a regular file
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
 	if err != nil {
-		log.Errorf("Error during build %s", err.Error())
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// process exit codes for build failures
+const (
+	exitFailed           = 1
+	exitStepFailed       = 2
+	exitDockerConnection = 3
+	exitInterrupted      = 130
+)
+
+func exitCode(err error) int {
+	if err == context.Canceled {
+		return exitInterrupted
+	}
+
+	switch err.(type) {
+	case *build.StepError:
+		return exitStepFailed
+	case *build.DockerError:
+		return exitDockerConnection
+	default:
+		return exitFailed
 	}
 }
@@ -0,0 +1,35 @@
+package secrets
+
+import (
+	"fmt"
+	"os"
+)
+
+// EnvProvider serves secrets from environment variables of the Habitus process
+type EnvProvider struct {
+	registry map[string]string
+}
+
+func (e *EnvProvider) GetSecret(name string) (string, error) {
+	variable, ok := e.registry[name]
+	if !ok {
+		return "", fmt.Errorf("secret %s not found", name)
+	}
+
+	value, ok := os.LookupEnv(variable)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s for secret %s is not set", variable, name)
+	}
+
+	return value, nil
+}
+
+func (e *EnvProvider) RegisterSecret(name string, value string) error {
+	if e.registry == nil {
+		e.registry = make(map[string]string)
+	}
+
+	e.registry[name] = value
+
+	return nil
+}
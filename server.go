@@ -61,6 +61,7 @@ func (a *server) serveSecret(w rest.ResponseWriter, r *rest.Request) {
 		rest.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	a.builder.AddSecretValue(result)
 	w.Header().Set("Content-Type", "text/plain")
 	w.(http.ResponseWriter).Write([]byte(result))
 }
@@ -27,7 +27,8 @@ type Export struct {
 	Repositories map[string]*TagInfo
 	Path         string
 
-	conf *configuration.Config
+	conf     *configuration.Config
+	progress ProgressFunc
 }
 
 type Port string
@@ -131,34 +132,45 @@ func (l *LayerConfig) ContainerConfig() *ContainerConfig {
 	return l.V2ContainerConfig
 }
 
-// LoadExport loads a tarball export created by docker save.
-func LoadExport(conf *configuration.Config, image, location string) (*Export, error) {
+// LoadExport loads a tarball export created by docker save. progress can be nil
+func LoadExport(conf *configuration.Config, image, location string, progress ProgressFunc) (*Export, error) {
+	if image == "" {
+		conf.Logger.Debugf("Loading export from STDIN using %s for tempdir", location)
+		return ReadExport(conf, os.Stdin, location, progress)
+	}
+
+	conf.Logger.Debugf("Loading export from %s using %s for tempdir", image, location)
+	ir, err := os.Open(image)
+	if err != nil {
+		return nil, err
+	}
+	defer ir.Close()
+
+	return ReadExport(conf, ir, location, progress)
+}
+
+// ReadExport loads an export created by docker save from a stream, like the output
+// of the docker API, extracting it to location. The stream is read to the end
+func ReadExport(conf *configuration.Config, r io.Reader, location string, progress ProgressFunc) (*Export, error) {
 	export := &Export{
 		Entries:      map[string]*ExportedImage{},
 		Repositories: map[string]*TagInfo{},
 		Path:         location,
 		conf:         conf,
+		progress:     progress,
 	}
 
-	if image == "" {
-		conf.Logger.Debugf("Loading export from STDIN using %s for tempdir", location)
-	} else {
-		conf.Logger.Debugf("Loading export from %s using %s for tempdir", image, location)
-	}
-
-	ir := os.Stdin
-	if image != "" {
-		var err error
-		ir, err = os.Open(image)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	err := export.Extract(ir)
+	pr := newProgressReader(r, StageExtracting, progress)
+	err := export.Extract(pr)
 	if err != nil {
 		return nil, err
 	}
+	// the tar reader stops at the end of archive marker. read the padding after it
+	// so writers streaming into a pipe don't block
+	if _, err := io.Copy(ioutil.Discard, pr); err != nil {
+		return nil, err
+	}
+	pr.done()
 
 	dirs, err := ioutil.ReadDir(export.Path)
 	if err != nil {
@@ -251,12 +263,15 @@ func (e *Export) Extract(r io.Reader) error {
 func (e *Export) ExtractLayers() error {
 	e.conf.Logger.Debug("Extracting layers...")
 
+	done := 0
 	for _, entry := range e.Entries {
 		e.conf.Logger.Debugf("  -  %s", entry.LayerTarPath)
 		err := entry.ExtractLayerDir()
 		if err != nil {
 			return err
 		}
+		done++
+		e.progress.report(Progress{Stage: StageExtracting, Layers: done, Total: len(e.Entries)})
 	}
 	return nil
 }
@@ -290,6 +305,15 @@ func (e *Export) Root() *ExportedImage {
 	return e.ChildOf("")
 }
 
+// LayerAt returns the nth layer from the root (1 is the root) or nil if there are less layers
+func (e *Export) LayerAt(n int) *ExportedImage {
+	c := e.Root()
+	for i := 1; i < n && c != nil; i++ {
+		c = e.ChildOf(c.LayerConfig.Id)
+	}
+	return c
+}
+
 func (e *Export) LastChild() *ExportedImage {
 	c := e.Root()
 	for {
@@ -495,7 +519,7 @@ func (e *Export) SquashLayers(to, from *ExportedImage) error {
 		}
 	}
 
-	for _, entry := range order {
+	for idx, entry := range order {
 		if _, err := os.Stat(entry.LayerTarPath); os.IsNotExist(err) {
 			continue
 		}
@@ -505,6 +529,7 @@ func (e *Export) SquashLayers(to, from *ExportedImage) error {
 			println(string(out))
 			return err
 		}
+		e.progress.report(Progress{Stage: StageSquashing, Layers: idx + 1, Total: len(order)})
 	}
 	e.conf.Logger.Debug("  -  Deleting whiteouts")
 	err = e.deleteWhiteouts(layerDir)
@@ -549,10 +574,12 @@ func (e *Export) TarLayers(w io.Writer) error {
 		return err
 	}
 
-	_, err = io.Copy(w, stdout)
+	pw := newProgressWriter(w, StageWriting, e.progress)
+	_, err = io.Copy(pw, stdout)
 	if err != nil {
 		return err
 	}
+	pw.done()
 	_, err = io.Copy(os.Stderr, stderr)
 	if err != nil {
 		return err
@@ -0,0 +1,20 @@
+package squash
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Export", func() {
+	It("finds the layers by their position from the root", func() {
+		export := &Export{Entries: map[string]*ExportedImage{
+			"c": {LayerConfig: newLayerConfig("c", "b", "")},
+			"a": {LayerConfig: newLayerConfig("a", "", "")},
+			"b": {LayerConfig: newLayerConfig("b", "a", "")},
+		}}
+
+		Expect(export.LayerAt(1).LayerConfig.Id).To(Equal("a"))
+		Expect(export.LayerAt(3).LayerConfig.Id).To(Equal("c"))
+		Expect(export.LayerAt(4)).To(BeNil())
+	})
+})
@@ -0,0 +1,82 @@
+package squash
+
+import (
+	"io"
+)
+
+// progress is reported every progressInterval bytes read or written
+const progressInterval = 64 * 1024 * 1024
+
+// stages of a squash reported in Progress
+const (
+	StageExtracting = "extracting"
+	StageSquashing  = "squashing"
+	StageWriting    = "writing"
+)
+
+// Progress describes how far a squash has come
+type Progress struct {
+	Stage  string
+	Layers int   // layers processed so far in this stage
+	Total  int   // total layers of this stage. 0 for stages which only count bytes
+	Bytes  int64 // bytes read or written so far in this stage
+}
+
+// ProgressFunc receives progress reports during a squash
+type ProgressFunc func(Progress)
+
+func (f ProgressFunc) report(p Progress) {
+	if f != nil {
+		f(p)
+	}
+}
+
+// counts the bytes going through a reader or writer and reports them
+type progressCounter struct {
+	stage    string
+	progress ProgressFunc
+	bytes    int64
+	next     int64
+}
+
+func (c *progressCounter) add(n int) {
+	c.bytes += int64(n)
+	if c.bytes >= c.next {
+		c.progress.report(Progress{Stage: c.stage, Bytes: c.bytes})
+		c.next = c.bytes + progressInterval
+	}
+}
+
+func (c *progressCounter) done() {
+	c.progress.report(Progress{Stage: c.stage, Bytes: c.bytes})
+}
+
+type progressReader struct {
+	progressCounter
+	r io.Reader
+}
+
+func newProgressReader(r io.Reader, stage string, progress ProgressFunc) *progressReader {
+	return &progressReader{progressCounter: progressCounter{stage: stage, progress: progress, next: progressInterval}, r: r}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.add(n)
+	return n, err
+}
+
+type progressWriter struct {
+	progressCounter
+	w io.Writer
+}
+
+func newProgressWriter(w io.Writer, stage string, progress ProgressFunc) *progressWriter {
+	return &progressWriter{progressCounter: progressCounter{stage: stage, progress: progress, next: progressInterval}, w: w}
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.add(n)
+	return n, err
+}
@@ -0,0 +1,13 @@
+package squash
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestSquash(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Squash Suite")
+}
@@ -3,6 +3,7 @@ package squash
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/signal"
@@ -15,17 +16,27 @@ import (
 
 var (
 	buildVersion string
-	signals      chan os.Signal
-	wg           sync.WaitGroup
 )
 
 type Squasher struct {
 	Conf *configuration.Config
+	// Progress is called as the squash processes the image. Optional
+	Progress ProgressFunc
+	// From is the layer the squash starts after: "root" or a layer ID prefix.
+	// Empty uses the last squash or the first FROM layer of the image
+	From string
+	// KeepLayers keeps this many layers from the root as they are and squashes the
+	// ones above them. Used to keep the layers of a base image. Overrides From
+	KeepLayers int
 }
 
-func (s *Squasher) shutdown(tempdir string) {
+// removes the tempdir when the squash finishes (done is closed) or the process is interrupted
+func (s *Squasher) shutdown(tempdir string, signals chan os.Signal, done chan struct{}, wg *sync.WaitGroup) {
 	defer wg.Done()
-	<-signals
+	select {
+	case <-signals:
+	case <-done:
+	}
 	s.Conf.Logger.Debugf("Removing tempdir %s", tempdir)
 	err := os.RemoveAll(tempdir)
 	if err != nil {
@@ -33,15 +44,43 @@ func (s *Squasher) shutdown(tempdir string) {
 	}
 }
 
+// Squash squashes the image export in the input file into the output file.
+// Empty input and output use stdin and stdout
 func (s *Squasher) Squash(input string, output string, tag string) error {
-	from := ""
-	keepTemp := false
+	ir := os.Stdin
+	if input != "" {
+		var err error
+		ir, err = os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer ir.Close()
+	}
 
-	tempdir, err := ioutil.TempDir("", "docker-squash")
-	if err != nil {
-		return err
+	ow := os.Stdout
+	if output != "" {
+		var err error
+		ow, err = os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer ow.Close()
+		s.Conf.Logger.Debugf("Tarring new image to %s", output)
+	} else {
+		s.Conf.Logger.Debugf("Tarring new image to STDOUT")
 	}
 
+	return s.SquashStream(ir, ow, tag)
+}
+
+// SquashStream squashes the image export read from r and writes the new image to w.
+// The export is fully read before anything is written to w, so r and w can be
+// streams connected to the docker API. The only copy of the image on disk are its
+// extracted layers in a temp folder in Conf.TempDir, which needs about twice the size of the image
+func (s *Squasher) SquashStream(r io.Reader, w io.Writer, tag string) error {
+	from := s.From
+	keepTemp := false
+
 	if tag != "" && strings.Contains(tag, ":") {
 		parts := strings.Split(tag, ":")
 		if parts[0] == "" || parts[1] == "" {
@@ -49,15 +88,30 @@ func (s *Squasher) Squash(input string, output string, tag string) error {
 		}
 	}
 
-	signals = make(chan os.Signal, 1)
+	// the extracted layers can be large. TempDir lets them go to a scratch volume
+	tempdir, err := ioutil.TempDir(s.Conf.TempDir, "docker-squash")
+	if err != nil {
+		return err
+	}
 
 	if !keepTemp {
+		// each squash has its own signal channel as steps are squashed in parallel
+		signals := make(chan os.Signal, 1)
+		done := make(chan struct{})
+		var wg sync.WaitGroup
 		wg.Add(1)
 		signal.Notify(signals, os.Interrupt, os.Kill, syscall.SIGTERM)
-		go s.shutdown(tempdir)
+		go s.shutdown(tempdir, signals, done, &wg)
+
+		// the tempdir is removed however the squash ends
+		defer func() {
+			signal.Stop(signals)
+			close(done)
+			wg.Wait()
+		}()
 	}
 
-	export, err := LoadExport(s.Conf, input, tempdir)
+	export, err := ReadExport(s.Conf, r, tempdir, s.Progress)
 	if err != nil {
 		return err
 	}
@@ -98,6 +152,16 @@ func (s *Squasher) Squash(input string, output string, tag string) error {
 		}
 	}
 
+	if s.KeepLayers > 0 {
+		start = export.LayerAt(s.KeepLayers)
+		if start == nil {
+			return fmt.Errorf("can't keep %d layers of an image with less layers", s.KeepLayers)
+		}
+		if export.ChildOf(start.LayerConfig.Id) == nil {
+			s.Conf.Logger.Noticef("Nothing to squash above the %d kept layers", s.KeepLayers)
+		}
+	}
+
 	if start == nil {
 		return fmt.Errorf("no layer matching %s", from)
 	}
@@ -176,19 +240,8 @@ func (s *Squasher) Squash(input string, output string, tag string) error {
 		}
 	}
 
-	ow := os.Stdout
-	if output != "" {
-		var err error
-		ow, err = os.Create(output)
-		if err != nil {
-			return err
-		}
-		s.Conf.Logger.Debugf("Tarring new image to %s", output)
-	} else {
-		s.Conf.Logger.Debugf("Tarring new image to STDOUT")
-	}
 	// bundle up the new image
-	err = export.TarLayers(ow)
+	err = export.TarLayers(w)
 	if err != nil {
 		return err
 	}
@@ -197,8 +250,5 @@ func (s *Squasher) Squash(input string, output string, tag string) error {
 	// print our new history
 	export.PrintHistory()
 
-	signals <- os.Interrupt
-	wg.Wait()
-
 	return nil
 }
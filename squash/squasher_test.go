@@ -0,0 +1,65 @@
+package squash
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloud66/habitus/configuration"
+	"github.com/op/go-logging"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Squasher", func() {
+	var (
+		tmp      string
+		squasher *Squasher
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = ioutil.TempDir("", "habitus-test-")
+		Expect(err).NotTo(HaveOccurred())
+
+		conf := configuration.CreateConfig()
+		conf.Logger = *logging.MustGetLogger("habitus")
+		conf.TempDir = tmp
+		squasher = &Squasher{Conf: &conf}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmp)
+	})
+
+	squashDirs := func() []string {
+		dirs, err := filepath.Glob(filepath.Join(tmp, "docker-squash*"))
+		Expect(err).NotTo(HaveOccurred())
+		return dirs
+	}
+
+	It("removes its temp folder when reading the export fails", func() {
+		export := io.MultiReader(strings.NewReader(strings.Repeat("x", 512)), &failingReader{})
+
+		err := squasher.SquashStream(export, ioutil.Discard, "app:latest")
+		Expect(err).To(HaveOccurred())
+		Expect(squashDirs()).To(BeEmpty())
+	})
+
+	It("removes its temp folder when the export is not an image", func() {
+		err := squasher.SquashStream(strings.NewReader(""), ioutil.Discard, "app:latest")
+		Expect(err).To(HaveOccurred())
+		Expect(squashDirs()).To(BeEmpty())
+	})
+})
+
+// fails like an export interrupted by the docker daemon
+type failingReader struct{}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("export failed")
+}